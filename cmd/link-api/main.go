@@ -3,194 +3,89 @@ package main
 import (
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"time"
 
-	"github.com/gin-contrib/cors"
-	"github.com/gin-gonic/gin"
+	"github.com/jamesjarvis/web-graph/pkg/linkapi"
+	"github.com/jamesjarvis/web-graph/pkg/linkcanon"
 	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
 )
 
 var (
 	dbUser     = os.Getenv("POSTGRES_USER")
 	dbPassword = os.Getenv("POSTGRES_PASSWORD")
 	dbDatabase = os.Getenv("POSTGRES_DB")
+
+	// storageType is either "postgres" (the default), "leveldb" to read a graph kept on disk in STORAGE_DATA,
+	// or "memory" for an empty graph that is thrown away when the API stops.
+	storageType    = os.Getenv("STORAGE_TYPE")
+	storageDataDir = os.Getenv("STORAGE_DATA")
+	// urlIdentity decides which urls are the same page, see linkcanon.PolicyByName. It must match everything else using the graph.
+	urlIdentity = os.Getenv("URL_IDENTITY")
 )
 
 const (
-	dbTablePage   = "pages_visited"
-	dbTableLink   = "links_visited"
-	queryLimit    = 100
-	welcomeString = `Welcome to the web-graph!
-You can find out more about this project at: https://github.com/jamesjarvis/web-graph
-If you want to explore the graph's UI you can visit: https://jamesjarvis.github.io/web-graph/
-
-If you want to just explore the API, there are the following paths:
-/                 - this page
-/page/:id         - pass a page hash and retrieve info about the page, and all links from the page
-/pages/:host      - easy way to find page hashes from a particular host (such as "wikipedia.com")
-/linksFrom/:id    - pass a page hash and retrieve all links from this page
-/linksTo/:id      - pass a page hash and retrieve all links to this page (that have been found so far, def not exhaustive)
-/countLinks       - returns the number of links found
-/countPages       - returns the number of pages found
-`
+	dbTablePage  = "pages_visited"
+	dbTableLink  = "links_visited"
+	dbTableFetch = "page_fetches"
 )
 
-type OutputJSON struct {
-	Node  NodeJSON `json:"node"`
-	Links []string `json:"links"`
-}
-
-type NodeJSON struct {
-	ID    string `json:"id"`
-	Group string `json:"group"`
-	URL   string `json:"url"`
-}
-
 func failOnError(err error, msg string) {
 	if err != nil {
 		log.Fatalf("%s: %s", msg, err)
 	}
 }
 
-func main() {
-	// Initialise database connections
-	linkStorage, err := linkstorage.NewStorage(
-		fmt.Sprintf(
-			"postgres://%s:%s@%s:5432/%s?sslmode=disable",
-			dbUser,
-			dbPassword,
-			"database",
-			dbDatabase,
-		),
-		dbTablePage,
-		dbTableLink,
-	)
-	failOnError(err, "Failed to connect to postgres")
-	defer linkStorage.Close()
-
-	// Send Pings periodically to the DB
-	pingDoneChan := linkStorage.KeepPingingOn(10 * time.Second)
-
-	r := gin.Default()
-
-	corsConfig := cors.DefaultConfig()
-
-	// OPTIONS method for ReactJS
-	corsConfig.AddAllowMethods("OPTIONS")
-	corsConfig.AllowAllOrigins = true
-
-	// Register the middleware
-	r.Use(cors.New(corsConfig))
-
-	r.GET("/", func(c *gin.Context) {
-		c.String(http.StatusOK, welcomeString)
-	})
-
-	r.GET("/page/:id", func(c *gin.Context) {
-		id := c.Param("id")
-		page, err := linkStorage.GetPage(id)
-		if err != nil {
-			log.Println(err)
-			c.String(http.StatusInternalServerError, "Something wrong with DB while fetching page info?")
-			return
-		}
-		if page == nil {
-			c.String(http.StatusNotFound, "Nothing found for %s", id)
-			return
-		}
-
-		linksFrom, err := linkStorage.GetLinksFrom(id, queryLimit)
-		if err != nil {
-			log.Println(err)
-			c.String(http.StatusInternalServerError, "Something wrong with DB while fetching links?")
-			return
-		}
-
-		outputjson := OutputJSON{
-			Node: NodeJSON{
-				ID:    id,
-				Group: page.U.Host,
-				URL:   page.U.String(),
-			},
-			Links: linksFrom,
-		}
-
-		c.JSON(http.StatusOK, outputjson)
-		// we want to return something like:
-		// {
-		// 	"node": {
-		// 		"id": "hash",
-		// 		"group": "jamesjarvis.io",
-		// 		"url": "https://jamesjarvis.io",
-		// 	},
-		// 	"links": [
-		// 		"hash_1",
-		// 		"hash_2",
-		// 	]
-		// }
-	})
-
-	r.GET("/pages/:host", func(c *gin.Context) {
-		host := c.Param("host")
-		hashes, err := linkStorage.GetPageHashesFromHost(host, queryLimit)
-		if err != nil {
-			log.Println(err)
-			c.String(http.StatusInternalServerError, "Something wrong with DB?")
-			return
-		}
-
-		c.JSON(http.StatusOK, hashes)
-	})
-
-	r.GET("/linksFrom/:id", func(c *gin.Context) {
-		id := c.Param("id")
-		hashes, err := linkStorage.GetLinksFrom(id, queryLimit)
+func openStorage() (linkstorage.Storage, error) {
+	switch storageType {
+	case "", "postgres":
+		return linkstorage.NewPostgresStorage(
+			fmt.Sprintf(
+				"postgres://%s:%s@%s:5432/%s?sslmode=disable",
+				dbUser,
+				dbPassword,
+				"database",
+				dbDatabase,
+			),
+			dbTablePage,
+			dbTableLink,
+			dbTableFetch,
+		)
+	case "leveldb":
+		storage, err := linkstorage.NewLevelDBStorage(storageDataDir)
 		if err != nil {
-			log.Println(err)
-			c.String(http.StatusInternalServerError, "Something wrong with DB?")
-			return
+			return nil, err
 		}
-
-		c.JSON(http.StatusOK, hashes)
-	})
-
-	r.GET("/linksTo/:id", func(c *gin.Context) {
-		id := c.Param("id")
-		hashes, err := linkStorage.GetLinksTo(id, queryLimit)
+		err = storage.CheckURLIdentity(urlIdentity)
 		if err != nil {
-			log.Println(err)
-			c.String(http.StatusInternalServerError, "Something wrong with DB?")
-			return
-		}
-
-		c.JSON(http.StatusOK, hashes)
-	})
-
-	r.GET("/countLinks", func(c *gin.Context) {
-		numLinks, err := linkStorage.CountLinks()
-		if err != nil {
-			log.Println(err)
-			c.String(http.StatusInternalServerError, "Something wrong with DB?")
-			return
+			storage.Close()
+			return nil, err
 		}
+		return storage, nil
+	case "memory":
+		return linkstorage.NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_TYPE %q", storageType)
+	}
+}
 
-		c.JSON(http.StatusOK, gin.H{"countLinks": numLinks})
-	})
+func main() {
+	policy, err := linkcanon.PolicyByName(urlIdentity)
+	failOnError(err, "Failed to parse URL_IDENTITY")
+	linkutils.SetPolicy(policy)
 
-	r.GET("/countPages", func(c *gin.Context) {
-		numLinks, err := linkStorage.CountPages()
-		if err != nil {
-			log.Println(err)
-			c.String(http.StatusInternalServerError, "Something wrong with DB?")
-			return
-		}
+	// Initialise database connections
+	linkStorage, err := openStorage()
+	failOnError(err, "Failed to open storage")
+	defer linkStorage.Close()
 
-		c.JSON(http.StatusOK, gin.H{"countPages": numLinks})
-	})
+	// Send Pings periodically to the DB
+	if postgres, ok := linkStorage.(*linkstorage.PostgresStorage); ok {
+		pingDoneChan := postgres.KeepPingingOn(10 * time.Second)
+		// After this point, you can kill the ping worker.
+		defer func() { pingDoneChan <- true }()
+	}
 
-	log.Fatal(r.Run())
-	// After this point, you can kill the ping worker.
-	pingDoneChan <- true
+	log.Fatal(linkapi.NewRouter(linkStorage).Run())
 }
@@ -0,0 +1,78 @@
+package main
+
+// This sends seeds to a running link-processor, so a crawl can be started without restarting it.
+// Pass a seeds file, or nothing (or "-") to read seeds from stdin, in any format the processor's SEEDS_FILE takes.
+// The processor has to be listening for seeds, with SEED_ADDR set.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkseed"
+)
+
+var (
+	processorURL = flag.String("processor", envOr("PROCESSOR_URL", "http://localhost:8082"), "where the link-processor is listening for seeds")
+)
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func failOnError(err error, msg string) {
+	if err != nil {
+		log.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	path := "-"
+	if flag.NArg() > 0 {
+		path = flag.Arg(0)
+	}
+
+	var body []byte
+	var err error
+	if path == "-" {
+		body, err = io.ReadAll(os.Stdin)
+	} else {
+		body, err = os.ReadFile(path)
+	}
+	failOnError(err, "Failed to read seeds")
+
+	// Check the seeds here, so mistakes are reported before anything is queued.
+	seeds, err := linkseed.Parse(bytes.NewReader(body))
+	failOnError(err, "Failed to parse seeds")
+	if len(seeds) == 0 {
+		log.Fatal("No seeds to send")
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+	response, err := client.Post(*processorURL+"/seeds", "text/plain", bytes.NewReader(body))
+	failOnError(err, "Failed to send seeds")
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(response.Body)
+		log.Fatalf("Processor refused the seeds: %s %s", response.Status, bytes.TrimSpace(message))
+	}
+
+	var result struct {
+		Queued int `json:"queued"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	failOnError(err, "Failed to read the processor's response")
+	fmt.Printf("Queued %d seeds\n", result.Queued)
+}
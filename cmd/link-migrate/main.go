@@ -0,0 +1,81 @@
+package main
+
+// This brings the postgres schema up to date, so you can migrate before rolling out the api and processor.
+// Run with -dry-run to print the SQL that would be run, without running it.
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+	_ "github.com/lib/pq"
+)
+
+var (
+	dbUser     = os.Getenv("POSTGRES_USER")
+	dbPassword = os.Getenv("POSTGRES_PASSWORD")
+	dbDatabase = os.Getenv("POSTGRES_DB")
+	dbHost     = os.Getenv("POSTGRES_HOST")
+
+	dbTablePage  = "pages_visited"
+	dbTableLink  = "links_visited"
+	dbTableFetch = "page_fetches"
+
+	dryRun = flag.Bool("dry-run", false, "print the pending migrations instead of applying them")
+)
+
+func failOnError(err error, msg string) {
+	if err != nil {
+		log.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	linkStorage := &linkstorage.PostgresStorage{
+		URI: fmt.Sprintf(
+			"postgres://%s:%s@%s:5432/%s?sslmode=disable",
+			dbUser,
+			dbPassword,
+			dbHost,
+			dbDatabase,
+		),
+		PageTable:  dbTablePage,
+		LinkTable:  dbTableLink,
+		FetchTable: dbTableFetch,
+	}
+	err := linkStorage.Open()
+	failOnError(err, "Failed to connect to postgres")
+	defer linkStorage.Close()
+
+	version, err := linkStorage.SchemaVersion()
+	failOnError(err, "Failed to read the schema version")
+	log.Printf("Schema is at version %d", version)
+
+	if !*dryRun {
+		err = linkStorage.Migrate()
+		failOnError(err, "Failed to migrate")
+		version, err = linkStorage.SchemaVersion()
+		failOnError(err, "Failed to read the schema version")
+		log.Printf("Schema is now at version %d", version)
+		return
+	}
+
+	pending, err := linkStorage.PendingMigrations()
+	failOnError(err, "Failed to find pending migrations")
+	if len(pending) == 0 {
+		log.Println("Nothing to do")
+		return
+	}
+	for _, migration := range pending {
+		fmt.Printf("-- %d: %s\n", migration.Version, migration.Description)
+		for _, statement := range migration.Statements {
+			fmt.Printf("%s;\n", strings.TrimSuffix(statement, ";"))
+		}
+		fmt.Println()
+	}
+}
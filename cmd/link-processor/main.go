@@ -15,18 +15,24 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log"
-	"net/url"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/jamesjarvis/massivelyconcurrentsystems/pool"
+	"github.com/jamesjarvis/web-graph/pkg/linkapi"
+	"github.com/jamesjarvis/web-graph/pkg/linkcanon"
 	"github.com/jamesjarvis/web-graph/pkg/linkprocessor"
 	"github.com/jamesjarvis/web-graph/pkg/linkqueue"
+	"github.com/jamesjarvis/web-graph/pkg/linkrecrawl"
+	"github.com/jamesjarvis/web-graph/pkg/linkscheduler"
+	"github.com/jamesjarvis/web-graph/pkg/linkscope"
+	"github.com/jamesjarvis/web-graph/pkg/linkseed"
 	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
 	"github.com/jamesjarvis/web-graph/pkg/linkutils"
 	_ "github.com/lib/pq"
@@ -38,12 +44,69 @@ var (
 	dbDatabase = os.Getenv("POSTGRES_DB")
 	dbHost     = os.Getenv("POSTGRES_HOST")
 
-	dbTablePage = "pages_visited"
-	dbTableLink = "links_visited"
+	dbTablePage  = "pages_visited"
+	dbTableLink  = "links_visited"
+	dbTableFetch = "page_fetches"
+
+	// storageType is either "postgres" (the default), "leveldb" to keep the graph on disk in STORAGE_DATA,
+	// or "memory" for a throwaway crawl.
+	storageType    = os.Getenv("STORAGE_TYPE")
+	storageDataDir = os.Getenv("STORAGE_DATA")
+	// urlIdentity decides which urls are the same page, see linkcanon.PolicyByName. It must match everything else using the graph.
+	urlIdentity = os.Getenv("URL_IDENTITY")
 
 	queueDataDir = os.Getenv("QUEUE_DATA")
+	// queueType is either "hosts" (the default) for a round-robin across hosts, or "priority" for best-first crawling.
+	queueType = os.Getenv("QUEUE_TYPE")
+	// maxDepth is how many links from a seed we are willing to go, unset or 0 means forever.
+	maxDepth = os.Getenv("MAX_DEPTH")
+	// extractElements is a comma separated list of where else to look for links as well as <a>, see linkprocessor.ParseElements.
+	extractElements = os.Getenv("EXTRACT_ELEMENTS")
+	// skipNofollow set to true stores links marked rel="nofollow" without following them.
+	skipNofollow = os.Getenv("SKIP_NOFOLLOW")
+	// readSitemaps set to true queues the urls in the sitemaps of every host we crawl.
+	readSitemaps = os.Getenv("SITEMAPS")
+	// headPreflight set to true sends a HEAD request before fetching urls whose extension doesn't say they are html,
+	// so we don't download images and the like just to find out they aren't pages.
+	headPreflight = os.Getenv("HEAD_PREFLIGHT")
+	// maxBodySize is how many bytes of each page we read, after decompressing it, 10MB if unset.
+	maxBodySize = os.Getenv("MAX_BODY_SIZE")
+	// scopeFile is a JSON file of rules for which urls we crawl, see linkscope.Rules. Unset means the defaults.
+	scopeFile = os.Getenv("SCOPE_FILE")
+	// seedsFile is queued every time we start, see linkseed.Parse for the format, or "-" to read seeds from stdin.
+	// If it isn't set, defaultSeedsFile is queued when the queue is empty.
+	seedsFile = os.Getenv("SEEDS_FILE")
+	// seedAddr is where to listen for seeds POSTed to /seeds by link-inject, such as ":8082". Unset means don't listen.
+	seedAddr = os.Getenv("SEED_ADDR")
+	// apiAddr is where to serve the graph api from the processor itself, such as ":8080".
+	// A leveldb or memory graph can't be read by anyone else while we crawl, so for those it defaults to defaultAPIAddr.
+	apiAddr = os.Getenv("API_ADDR")
+
+	defaultAPIAddr = ":8080"
+
+	defaultSeedsFile = "seeds.txt"
 
 	defaultBatchInterval = time.Second
+
+	// Politeness settings, so we don't get ourselves blocked.
+	hostMinDelay    = time.Second
+	hostMaxDelay    = time.Minute
+	hostMaxInFlight = 1
+	maxDeferredURLs = 10000
+	// maxDeferredPerHost stops one busy host filling up all the room for deferred urls, anything more goes back in the queue.
+	maxDeferredPerHost = 100
+	// hostBusyBackoff is how long we wait before dequeuing again after a url had to go back in the queue,
+	// so we don't spin taking the same busy host's urls out and putting them back.
+	hostBusyBackoff = 100 * time.Millisecond
+
+	// Recrawl settings, pages whose links change often are revisited more often.
+	recrawlPolicy = linkrecrawl.Policy{
+		Initial: 2 * 24 * time.Hour,
+		Min:     6 * time.Hour,
+		Max:     60 * 24 * time.Hour,
+	}
+	recrawlInterval  = time.Minute
+	recrawlBatchSize = 100
 )
 
 func failOnError(err error, msg string) {
@@ -52,68 +115,89 @@ func failOnError(err error, msg string) {
 	}
 }
 
-func seedInitialURLs(q *linkqueue.LinkQueue) error {
-	interestingURLs := []string{
-		"https://news.ycombinator.com/",
-		"https://www.startups-list.com/",
-		"https://www.indiehackers.com/",
-		"https://www.cisco.com/",
-		"https://thoughtmachine.net/",
-		"https://www.bbc.co.uk/",
-		"https://www.bbc.co.uk/news",
-		"https://www.kent.ac.uk/",
-		"https://home.cern/",
-		"https://www.nasa.gov/",
-		"https://www.engadget.com/",
-		"https://www.webdesign-inspiration.com/",
-		"https://moz.com/top500",
-		"https://www.wired.co.uk/",
-		"https://www.macrumors.com/",
-		"https://jamesjarvis.io/projects",
-		"https://en.wikipedia.org/wiki/Elon_Musk's_Tesla_Roadster",
-		"https://en.wikipedia.org/wiki/Six_Degrees_of_Kevin_Bacon",
-		"https://www.nhm.ac.uk/",
-		"https://www.sciencemuseum.org.uk/",
-		"https://www.businessinsider.com/uk-tech-100-2019-most-important-interesting-and-impactful-people-uk-tech-2019-9?r=US&IR=T#97-the-undergraduate-students-who-beat-apple-to-building-a-web-player-for-apple-music-4",
-		"http://info.cern.ch/hypertext/WWW/TheProject.html",
-		"https://www.nytimes.com/",
-		"https://www.kent.ac.uk/courses/profiles/undergraduate/computer-science-year-industry-musish",
-		"https://www.si.edu/",
-	}
-
-	for _, u := range interestingURLs {
-		uri, err := linkutils.ParseURL(u)
+func openQueue() (linkqueue.Queue, error) {
+	switch queueType {
+	case "", "hosts":
+		return linkqueue.NewHostFrontier(queueDataDir)
+	case "priority":
+		inLinks, err := linkqueue.NewInLinkScorer(100000)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		err = q.EnQueue(uri)
+		hosts, err := linkqueue.NewHostDiversityScorer(10000, 100)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return linkqueue.NewPriorityFrontier(queueDataDir, linkqueue.CombineScorers(
+			linkqueue.WeightedScorer{Scorer: inLinks, Weight: 2},
+			linkqueue.WeightedScorer{Scorer: hosts, Weight: 2},
+			linkqueue.WeightedScorer{Scorer: linkqueue.DepthScorer, Weight: 2},
+			linkqueue.WeightedScorer{Scorer: linkqueue.PathLengthScorer, Weight: 1},
+			linkqueue.WeightedScorer{Scorer: linkqueue.SitemapScorer, Weight: 1},
+		))
+	default:
+		return nil, fmt.Errorf("unknown QUEUE_TYPE %q", queueType)
 	}
+}
 
-	if q.Length() == 0 {
-		return errors.New("Queue is still empty??")
+func openStorage() (linkstorage.Storage, error) {
+	switch storageType {
+	case "", "postgres":
+		return linkstorage.NewPostgresStorage(
+			fmt.Sprintf(
+				"postgres://%s:%s@%s:5432/%s?sslmode=disable&client_encoding=UTF8",
+				dbUser,
+				dbPassword,
+				dbHost,
+				dbDatabase,
+			),
+			dbTablePage,
+			dbTableLink,
+			dbTableFetch,
+		)
+	case "leveldb":
+		storage, err := linkstorage.NewLevelDBStorage(storageDataDir)
+		if err != nil {
+			return nil, err
+		}
+		err = storage.CheckURLIdentity(urlIdentity)
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+		return storage, nil
+	case "memory":
+		return linkstorage.NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_TYPE %q", storageType)
 	}
+}
 
-	return nil
+// seedFromFile queues the seeds in the file.
+func seedFromFile(lp *linkprocessor.LinkProcessor, path string) error {
+	seeds, err := linkseed.Load(path)
+	if err != nil {
+		return err
+	}
+	queued, err := lp.AddSeeds(seeds)
+	log.Printf("Queued %d seeds from %s", queued, path)
+	return err
 }
 
 func main() {
+	policy, err := linkcanon.PolicyByName(urlIdentity)
+	failOnError(err, "Failed to parse URL_IDENTITY")
+	linkutils.SetPolicy(policy)
+
+	scope := linkscope.Default()
+	if scopeFile != "" {
+		scope, err = linkscope.Load(scopeFile)
+		failOnError(err, "Failed to load SCOPE_FILE")
+	}
+
 	// Initialise database connections
-	linkStorage, err := linkstorage.NewStorage(
-		fmt.Sprintf(
-			"postgres://%s:%s@%s:5432/%s?sslmode=disable&client_encoding=UTF8",
-			dbUser,
-			dbPassword,
-			dbHost,
-			dbDatabase,
-		),
-		dbTablePage,
-		dbTableLink,
-	)
-	failOnError(err, "Failed to connect to postgres")
+	linkStorage, err := openStorage()
+	failOnError(err, "Failed to open storage")
 	defer func() {
 		err := linkStorage.Close()
 		log.Println("===== closed link storage =====", err)
@@ -153,27 +237,118 @@ func main() {
 		log.Println("===== closed link batcher =====", err)
 	}()
 
-	queue, err := linkqueue.NewLinkQueue(queueDataDir)
+	fetchBatcher, err := linkstorage.NewFetchBatcher(
+		linkStorage,
+		pool.NewConfig(
+			pool.SetBufferSize(100),
+			pool.SetBatchSize(100),
+			pool.SetNumConsumers(1),
+			pool.SetBatchInterval(defaultBatchInterval),
+		),
+	)
+	if err != nil {
+		log.Fatal("failed to create fetch batcher", err)
+	}
+	defer func() {
+		err := fetchBatcher.Close()
+		log.Println("===== closed fetch batcher =====", err)
+	}()
+
+	queue, err := openQueue()
 	failOnError(err, "Failed to initialise queue")
 	defer func() {
 		err := queue.Close()
 		log.Println("===== closed link queue =====", err)
 	}()
 
-	linkProcessor, err := linkprocessor.NewLinkProcessor(
-		pageBatcher,
-		linkBatcher,
-		queue,
-	)
+	var depthLimit int
+	if maxDepth != "" {
+		depthLimit, err = strconv.Atoi(maxDepth)
+		failOnError(err, "Failed to parse MAX_DEPTH")
+	}
+
+	elements, err := linkprocessor.ParseElements(extractElements)
+	failOnError(err, "Failed to parse EXTRACT_ELEMENTS")
+
+	var noFollow bool
+	if skipNofollow != "" {
+		noFollow, err = strconv.ParseBool(skipNofollow)
+		failOnError(err, "Failed to parse SKIP_NOFOLLOW")
+	}
+
+	var sitemaps bool
+	if readSitemaps != "" {
+		sitemaps, err = strconv.ParseBool(readSitemaps)
+		failOnError(err, "Failed to parse SITEMAPS")
+	}
+
+	var preflight bool
+	if headPreflight != "" {
+		preflight, err = strconv.ParseBool(headPreflight)
+		failOnError(err, "Failed to parse HEAD_PREFLIGHT")
+	}
+
+	var bodyLimit int64 = linkprocessor.DefaultMaxBodySize
+	if maxBodySize != "" {
+		bodyLimit, err = strconv.ParseInt(maxBodySize, 10, 64)
+		failOnError(err, "Failed to parse MAX_BODY_SIZE")
+		if bodyLimit <= 0 {
+			log.Fatal("MAX_BODY_SIZE has to be more than 0")
+		}
+	}
+
+	linkProcessor, err := linkprocessor.NewLinkProcessor(linkprocessor.Options{
+		PageBatcher:   pageBatcher,
+		LinkBatcher:   linkBatcher,
+		FetchBatcher:  fetchBatcher,
+		Queue:         queue,
+		History:       linkStorage,
+		RecrawlPolicy: recrawlPolicy,
+		MaxDepth:      depthLimit,
+		Elements:      elements,
+		SkipNofollow:  noFollow,
+		Sitemaps:      sitemaps,
+		Scope:         scope,
+		HeadPreflight: preflight,
+		MaxBodySize:   bodyLimit,
+	})
 	if err != nil {
 		log.Fatal("failed to create link processor", err)
 	}
 
-	worker := func(u *url.URL) {
-		if u == nil {
+	scheduler := linkscheduler.NewHostScheduler(
+		hostMinDelay,
+		hostMaxDelay,
+		hostMaxInFlight,
+		maxDeferredURLs,
+		maxDeferredPerHost,
+		linkProcessor.CrawlDelay,
+		queue.ReQueue,
+	)
+	defer func() {
+		err := scheduler.Close()
+		log.Println("===== closed host scheduler =====", err)
+	}()
+
+	// Only top up with revisits while there is room, so they don't crowd out new pages.
+	recrawler := linkrecrawl.NewRecrawler(
+		linkStorage,
+		scheduler.Add,
+		func() bool { return scheduler.Length() > maxDeferredURLs/2 },
+		recrawlInterval,
+		recrawlBatchSize,
+	)
+	defer func() {
+		err := recrawler.Close()
+		log.Println("===== closed recrawler =====", err)
+	}()
+
+	worker := func(item *linkqueue.Item) {
+		if item == nil {
 			return
 		}
-		err := linkProcessor.ProcessURL(u)
+		defer scheduler.Done(item)
+		err := linkProcessor.ProcessURL(item)
 		if err != nil {
 			log.Printf("Error whilst processing: %v", err)
 		}
@@ -194,32 +369,99 @@ func main() {
 
 	log.Println("Processor initialised! 🤖")
 
-	if !queue.ContainsItems() {
+	log.Println("Begin processing...")
+	linkBatcher.Start()
+	pageBatcher.Start()
+	fetchBatcher.Start()
+
+	// Seeds are recorded as pages, so they have to wait for the batchers.
+	if seedsFile != "" {
+		err := seedFromFile(linkProcessor, seedsFile)
+		failOnError(err, "Failed to seed from SEEDS_FILE")
+	} else if !queue.ContainsItems() {
 		log.Println("Queue empty, seeding initial URLs to Queue...")
-		err := seedInitialURLs(queue)
+		err := seedFromFile(linkProcessor, defaultSeedsFile)
 		failOnError(err, "Failed to seed initial URLs")
+		if !queue.ContainsItems() {
+			log.Fatal("Queue is still empty??")
+		}
+	}
+
+	if seedAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/seeds", linkProcessor.SeedsHandler())
+		seedServer := &http.Server{Addr: seedAddr, Handler: mux}
+		go func() {
+			err := seedServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Printf("Seed server stopped: %v", err)
+			}
+		}()
+		defer func() {
+			err := seedServer.Close()
+			log.Println("===== closed seed server =====", err)
+		}()
+		log.Printf("Listening for seeds on %s/seeds", seedAddr)
+	}
+
+	if apiAddr == "" && (storageType == "leveldb" || storageType == "memory") {
+		apiAddr = defaultAPIAddr
+	}
+	if apiAddr != "" {
+		apiServer := &http.Server{Addr: apiAddr, Handler: linkapi.NewRouter(linkStorage)}
+		go func() {
+			err := apiServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Printf("API server stopped: %v", err)
+			}
+		}()
+		defer func() {
+			err := apiServer.Close()
+			log.Println("===== closed api server =====", err)
+		}()
+		log.Printf("Serving the graph api on %s", apiAddr)
 	}
 
-	log.Println("Begin processing...")
-	linkBatcher.Start()
-	pageBatcher.Start()
 	linkProcessorPool.Start()
+	scheduler.Start()
+	recrawler.Start()
 
 	sigs := make(chan os.Signal, 4)
 	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGKILL)
 	ticker := time.NewTicker(10 * time.Minute)
 	defer ticker.Stop()
 
+	// dequeued is only set while we are waiting on the queue, so we stop pulling urls whilst the scheduler is full.
+	var dequeued <-chan *linkqueue.Item
+	var dequeueFailed <-chan error
+	// backoff is only set while we are waiting to dequeue again, after the scheduler had no room for a url's host.
+	var backoff <-chan time.Time
+
 running:
 	for {
+		if dequeued == nil && backoff == nil && !scheduler.Full() {
+			dequeued, dequeueFailed = queue.DeQueue()
+		}
+
 		select {
 		case s := <-sigs:
 			log.Printf("Received signal %s, shutting down gracefully...\n", s)
 			break running
-		case url := <-queue.DeQueue():
-			linkProcessorPool.Put(context.TODO(), url)
+		case item := <-dequeued:
+			dequeued, dequeueFailed = nil, nil
+			if item != nil && !scheduler.Add(item) {
+				backoff = time.After(hostBusyBackoff)
+			}
+		case err := <-dequeueFailed:
+			// The queue is closed or broken, so there is nothing more we can crawl.
+			log.Printf("Could not take a url off the queue, shutting down: %v", err)
+			break running
+		case <-backoff:
+			backoff = nil
+		case item := <-scheduler.Ready():
+			linkProcessorPool.Put(context.TODO(), item)
 		case <-ticker.C:
-			log.Printf("%d urls in the queue", queue.Length())
+			log.Printf("%d urls in the queue, %d waiting on their host", queue.Length(), scheduler.Length())
 		}
 	}
 
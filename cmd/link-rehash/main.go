@@ -0,0 +1,83 @@
+package main
+
+// This moves an existing graph over to a new URL_IDENTITY, by recomputing every page id and merging pages which are now the same.
+// Stop the link processor and the api first, then start them again with the same URL_IDENTITY once it is done.
+// Run with -dry-run to see how many pages would move and merge, without changing anything.
+// Pages are moved in batches, so if it is interrupted, run it again with the same URL_IDENTITY to carry on.
+// Only postgres graphs can be rehashed, a leveldb graph stays with the url identity it was built with.
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkcanon"
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+	_ "github.com/lib/pq"
+)
+
+var (
+	dbUser     = os.Getenv("POSTGRES_USER")
+	dbPassword = os.Getenv("POSTGRES_PASSWORD")
+	dbDatabase = os.Getenv("POSTGRES_DB")
+	dbHost     = os.Getenv("POSTGRES_HOST")
+
+	// storageType is the same as for the processor and api, but only "postgres" can be rehashed.
+	storageType = os.Getenv("STORAGE_TYPE")
+
+	dbTablePage  = "pages_visited"
+	dbTableLink  = "links_visited"
+	dbTableFetch = "page_fetches"
+
+	// urlIdentity is the policy to move the graph over to, see linkcanon.PolicyByName.
+	urlIdentity = os.Getenv("URL_IDENTITY")
+
+	dryRun    = flag.Bool("dry-run", false, "count the pages that would move instead of moving them")
+	batchSize = flag.Int("batch-size", 1000, "how many new page ids to move in each transaction")
+)
+
+func failOnError(err error, msg string) {
+	if err != nil {
+		log.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if storageType != "" && storageType != "postgres" {
+		log.Fatalf("Only postgres graphs can be rehashed, a %s graph has to stay with the URL_IDENTITY it was built with", storageType)
+	}
+	if *batchSize <= 0 {
+		log.Fatal("-batch-size has to be more than 0")
+	}
+
+	policy, err := linkcanon.PolicyByName(urlIdentity)
+	failOnError(err, "Failed to parse URL_IDENTITY")
+	linkutils.SetPolicy(policy)
+
+	linkStorage, err := linkstorage.NewPostgresStorage(
+		fmt.Sprintf(
+			"postgres://%s:%s@%s:5432/%s?sslmode=disable",
+			dbUser,
+			dbPassword,
+			dbHost,
+			dbDatabase,
+		),
+		dbTablePage,
+		dbTableLink,
+		dbTableFetch,
+	)
+	failOnError(err, "Failed to connect to postgres")
+	defer linkStorage.Close()
+
+	stats, err := linkStorage.Rehash(*dryRun, *batchSize)
+	failOnError(err, "Failed to rehash pages")
+
+	verb := "moved"
+	if *dryRun {
+		verb = "would move"
+	}
+	log.Printf("Of %d pages, %s %d to a new id, merging %d into other pages", stats.Pages, verb, stats.Moved, stats.Merged)
+}
@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.1
+	github.com/andybalholm/brotli v1.0.6
 	github.com/beeker1121/goque v2.1.0+incompatible
 	github.com/gin-contrib/cors v1.3.1
 	github.com/gin-gonic/gin v1.6.3
@@ -12,6 +13,9 @@ require (
 	github.com/lib/pq v1.9.0
 	github.com/ncruces/go-dns v1.0.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/syndtr/goleveldb v1.0.0
+	golang.org/x/net v0.0.0-20200813134508-3edf25e44fcc
+	golang.org/x/text v0.13.0
 )
 
 require (
@@ -27,9 +31,7 @@ require (
 	github.com/mattn/go-isatty v0.0.12 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
 	github.com/modern-go/reflect2 v0.0.0-20180701023420-4b7aa43c6742 // indirect
-	github.com/syndtr/goleveldb v1.0.0 // indirect
 	github.com/ugorji/go/codec v1.1.7 // indirect
-	golang.org/x/net v0.0.0-20200813134508-3edf25e44fcc // indirect
-	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd // indirect
+	golang.org/x/sys v0.10.0 // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
@@ -0,0 +1,336 @@
+package linkapi
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// This is the http api for exploring the graph, served by link-api,
+// or by the link processor itself when it keeps the graph somewhere only it can read.
+
+const (
+	queryLimit    = 100
+	welcomeString = `Welcome to the web-graph!
+You can find out more about this project at: https://github.com/jamesjarvis/web-graph
+If you want to explore the graph's UI you can visit: https://jamesjarvis.github.io/web-graph/
+
+If you want to just explore the API, there are the following paths:
+/                 - this page
+/page/:id         - pass a page hash and retrieve info about the page, how fetching it went, and all links from the page
+/pages/:host      - easy way to find page hashes from a particular host (such as "wikipedia.com")
+/linksFrom/:id    - pass a page hash and retrieve all links from this page
+/linksTo/:id      - pass a page hash and retrieve all links to this page (that have been found so far, def not exhaustive)
+                    both of these take an optional ?at=2021-01-02T15:04:05Z (or just ?at=2021-01-02) to see the links as they were then
+                    pages which asked not to be indexed are left out of all of these lists, unless you add ?noindex=true
+/countLinks       - returns the number of links found
+/countPages       - returns the number of pages found
+`
+)
+
+type OutputJSON struct {
+	Node  NodeJSON   `json:"node"`
+	Links []string   `json:"links"`
+	Fetch *FetchJSON `json:"fetch,omitempty"`
+	// RedirectsTo is the page hash this page redirects to, if it does.
+	RedirectsTo string `json:"redirectsTo,omitempty"`
+	// Canonical is the page hash this page says is its canonical version, if it names one.
+	Canonical string `json:"canonical,omitempty"`
+}
+
+type NodeJSON struct {
+	ID    string `json:"id"`
+	Group string `json:"group"`
+	URL   string `json:"url"`
+	// Depth is the number of links from a seed, or -1 if we don't know.
+	Depth          int    `json:"depth"`
+	DiscoveredFrom string `json:"discoveredFrom,omitempty"`
+	// Seeds are the hashes of the seeds the crawl reached the page from.
+	Seeds []string `json:"seeds,omitempty"`
+	// These are what the page says about itself, if we have managed to fetch it.
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Lang        string `json:"lang,omitempty"`
+	Robots      string `json:"robots,omitempty"`
+	H1          string `json:"h1,omitempty"`
+	// Noindex is set when the page asked robots not to index it, so it shouldn't be shown.
+	Noindex bool `json:"noindex,omitempty"`
+	// Leaf is set when the page turned out not to be html, such as an image or a pdf, so it has no links of its own.
+	Leaf bool `json:"leaf,omitempty"`
+}
+
+// FetchJSON is how the last fetch of a page went, if we have tried to fetch it.
+type FetchJSON struct {
+	Status         int       `json:"status"`
+	ContentType    string    `json:"contentType"`
+	MIMEType       string    `json:"mimeType,omitempty"`
+	ContentLength  int64     `json:"contentLength"`
+	ResponseTimeMs int64     `json:"responseTimeMs"`
+	FetchedAt      time.Time `json:"fetchedAt"`
+	Error          string    `json:"error,omitempty"`
+	FinalURL       string    `json:"finalUrl,omitempty"`
+}
+
+// parseAt reads the optional "at" query parameter, returning nil if it isn't set.
+func parseAt(c *gin.Context) (*time.Time, error) {
+	at := c.Query("at")
+	if at == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", at)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// parseNoindex reads the optional "noindex" query parameter, which includes pages that asked not to be indexed when it is true.
+func parseNoindex(c *gin.Context) (bool, error) {
+	noindex := c.Query("noindex")
+	if noindex == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(noindex)
+}
+
+// NewRouter serves the graph kept in the storage.
+func NewRouter(linkStorage linkstorage.Storage) *gin.Engine {
+	r := gin.Default()
+
+	corsConfig := cors.DefaultConfig()
+
+	// OPTIONS method for ReactJS
+	corsConfig.AddAllowMethods("OPTIONS")
+	corsConfig.AllowAllOrigins = true
+
+	// Register the middleware
+	r.Use(cors.New(corsConfig))
+
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, welcomeString)
+	})
+
+	r.GET("/page/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		includeNoindex, err := parseNoindex(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Could not understand noindex=%s, try true or false", c.Query("noindex"))
+			return
+		}
+		page, err := linkStorage.GetPage(id)
+		if err != nil {
+			log.Println(err)
+			c.String(http.StatusInternalServerError, "Something wrong with DB while fetching page info?")
+			return
+		}
+		if page == nil {
+			c.String(http.StatusNotFound, "Nothing found for %s", id)
+			return
+		}
+
+		linksFrom, err := linkStorage.GetLinksFrom(id, queryLimit, includeNoindex)
+		if err != nil {
+			log.Println(err)
+			c.String(http.StatusInternalServerError, "Something wrong with DB while fetching links?")
+			return
+		}
+
+		outputjson := OutputJSON{
+			Node: NodeJSON{
+				ID:    id,
+				Group: page.U.Host,
+				URL:   page.U.String(),
+				Depth: page.Depth,
+			},
+			Links: linksFrom,
+		}
+		if page.DiscoveredFrom != nil {
+			outputjson.Node.DiscoveredFrom = linkutils.Hash(page.DiscoveredFrom)
+		}
+		for _, seed := range page.Seeds {
+			outputjson.Node.Seeds = append(outputjson.Node.Seeds, linkutils.Hash(seed))
+		}
+		if page.Metadata != nil {
+			outputjson.Node.Title = page.Metadata.Title
+			outputjson.Node.Description = page.Metadata.Description
+			outputjson.Node.Lang = page.Metadata.Lang
+			outputjson.Node.Robots = page.Metadata.Robots
+			outputjson.Node.H1 = page.Metadata.H1
+			outputjson.Node.Noindex = page.Metadata.Noindex
+		}
+
+		fetch, err := linkStorage.GetFetchResult(id)
+		if err != nil {
+			log.Println(err)
+			c.String(http.StatusInternalServerError, "Something wrong with DB while fetching fetch info?")
+			return
+		}
+		if fetch != nil {
+			outputjson.Fetch = &FetchJSON{
+				Status:         fetch.StatusCode,
+				ContentType:    fetch.ContentType,
+				MIMEType:       fetch.MIMEType,
+				ContentLength:  fetch.ContentLength,
+				ResponseTimeMs: fetch.ResponseTime.Milliseconds(),
+				FetchedAt:      fetch.FetchedAt,
+				Error:          fetch.ErrorClass,
+			}
+			outputjson.Node.Leaf = fetch.MIMEType != "" && fetch.MIMEType != "text/html" && fetch.MIMEType != "application/xhtml+xml"
+			if fetch.FinalURL != nil {
+				outputjson.Fetch.FinalURL = fetch.FinalURL.String()
+			}
+		}
+
+		outputjson.RedirectsTo, err = linkStorage.GetRedirect(id)
+		if err != nil {
+			log.Println(err)
+			c.String(http.StatusInternalServerError, "Something wrong with DB while fetching redirects?")
+			return
+		}
+
+		outputjson.Canonical, err = linkStorage.GetCanonical(id)
+		if err != nil {
+			log.Println(err)
+			c.String(http.StatusInternalServerError, "Something wrong with DB while fetching the canonical page?")
+			return
+		}
+
+		c.JSON(http.StatusOK, outputjson)
+		// we want to return something like:
+		// {
+		// 	"node": {
+		// 		"id": "hash",
+		// 		"group": "jamesjarvis.io",
+		// 		"url": "https://jamesjarvis.io",
+		// 		"depth": 1,
+		// 		"discoveredFrom": "hash_0",
+		// 		"seeds": ["hash_0"],
+		// 		"title": "James Jarvis",
+		// 		"description": "Some stuff I've made",
+		// 		"lang": "en",
+		// 		"h1": "Hello",
+		// 	},
+		// 	"links": [
+		// 		"hash_1",
+		// 		"hash_2",
+		// 	],
+		// 	"fetch": {
+		// 		"status": 200,
+		// 		"contentType": "text/html; charset=utf-8",
+		// 		"mimeType": "text/html",
+		// 		"contentLength": 12345,
+		// 		"responseTimeMs": 120,
+		// 		"fetchedAt": "2020-12-25T12:00:00Z",
+		// 		"finalUrl": "https://jamesjarvis.io/",
+		// 	},
+		// 	"redirectsTo": "hash_3",
+		// 	"canonical": "hash_4",
+		// }
+	})
+
+	r.GET("/pages/:host", func(c *gin.Context) {
+		host := c.Param("host")
+		includeNoindex, err := parseNoindex(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Could not understand noindex=%s, try true or false", c.Query("noindex"))
+			return
+		}
+		hashes, err := linkStorage.GetPageHashesFromHost(host, queryLimit, includeNoindex)
+		if err != nil {
+			log.Println(err)
+			c.String(http.StatusInternalServerError, "Something wrong with DB?")
+			return
+		}
+
+		c.JSON(http.StatusOK, hashes)
+	})
+
+	r.GET("/linksFrom/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		at, err := parseAt(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Could not understand the time %s, try something like 2021-01-02T15:04:05Z", c.Query("at"))
+			return
+		}
+		includeNoindex, err := parseNoindex(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Could not understand noindex=%s, try true or false", c.Query("noindex"))
+			return
+		}
+
+		var hashes []string
+		if at == nil {
+			hashes, err = linkStorage.GetLinksFrom(id, queryLimit, includeNoindex)
+		} else {
+			hashes, err = linkStorage.GetLinksFromAsOf(id, *at, queryLimit, includeNoindex)
+		}
+		if err != nil {
+			log.Println(err)
+			c.String(http.StatusInternalServerError, "Something wrong with DB?")
+			return
+		}
+
+		c.JSON(http.StatusOK, hashes)
+	})
+
+	r.GET("/linksTo/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		at, err := parseAt(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Could not understand the time %s, try something like 2021-01-02T15:04:05Z", c.Query("at"))
+			return
+		}
+		includeNoindex, err := parseNoindex(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Could not understand noindex=%s, try true or false", c.Query("noindex"))
+			return
+		}
+
+		var hashes []string
+		if at == nil {
+			hashes, err = linkStorage.GetLinksTo(id, queryLimit, includeNoindex)
+		} else {
+			hashes, err = linkStorage.GetLinksToAsOf(id, *at, queryLimit, includeNoindex)
+		}
+		if err != nil {
+			log.Println(err)
+			c.String(http.StatusInternalServerError, "Something wrong with DB?")
+			return
+		}
+
+		c.JSON(http.StatusOK, hashes)
+	})
+
+	r.GET("/countLinks", func(c *gin.Context) {
+		numLinks, err := linkStorage.CountLinks()
+		if err != nil {
+			log.Println(err)
+			c.String(http.StatusInternalServerError, "Something wrong with DB?")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"countLinks": numLinks})
+	})
+
+	r.GET("/countPages", func(c *gin.Context) {
+		numLinks, err := linkStorage.CountPages()
+		if err != nil {
+			log.Println(err)
+			c.String(http.StatusInternalServerError, "Something wrong with DB?")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"countPages": numLinks})
+	})
+
+	return r
+}
@@ -0,0 +1,146 @@
+package linkapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestRouter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(24 * time.Hour)
+
+	a := mustParse(t, "https://example.com/")
+	b := mustParse(t, "https://example.com/b.pdf")
+	c := mustParse(t, "https://other.com/c")
+	storage := linkstorage.NewMemoryStorage()
+	err := storage.BatchAddPages([]linkstorage.Page{
+		{U: a, Depth: 0, Seeds: []*url.URL{a}},
+		{U: b, Depth: 1, DiscoveredFrom: a, Seeds: []*url.URL{a}},
+		{U: c, Depth: 1, DiscoveredFrom: a, Seeds: []*url.URL{a}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.BatchAddLinks([]*linkstorage.Link{
+		{FromU: a, ToU: b, LinkText: "b", SeenAt: t0},
+		{FromU: a, ToU: c, LinkText: "c", SeenAt: t0},
+		{FromU: c, ToU: a, LinkText: "home", SeenAt: t1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.BatchAddFetchResults([]*linkstorage.FetchResult{
+		{U: b, StatusCode: 200, ContentType: "application/pdf", MIMEType: "application/pdf", ContentLength: 10, FetchedAt: t1},
+		{
+			U: c, StatusCode: 200, ContentType: "text/html", MIMEType: "text/html", ContentLength: 20, FetchedAt: t1,
+			Metadata: &linkstorage.PageMetadata{Title: "C", Robots: "noindex", Noindex: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := strings.NewReplacer("{a}", linkutils.Hash(a), "{b}", linkutils.Hash(b), "{c}", linkutils.Hash(c))
+	router := NewRouter(storage)
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		// wantJSON is compared with the response as JSON, with {a}, {b} and {c} standing in for the page hashes.
+		wantJSON string
+		// wantText is looked for in the response when it isn't JSON.
+		wantText string
+	}{
+		{name: "welcome", path: "/", wantStatus: http.StatusOK, wantText: "Welcome to the web-graph!"},
+		{name: "count pages", path: "/countPages", wantStatus: http.StatusOK, wantJSON: `{"countPages": 3}`},
+		{name: "count links", path: "/countLinks", wantStatus: http.StatusOK, wantJSON: `{"countLinks": 3}`},
+		{name: "pages from host", path: "/pages/example.com", wantStatus: http.StatusOK, wantJSON: `["{a}", "{b}"]`},
+		{name: "noindex pages are left out", path: "/pages/other.com", wantStatus: http.StatusOK, wantJSON: `null`},
+		{name: "noindex pages on request", path: "/pages/other.com?noindex=true", wantStatus: http.StatusOK, wantJSON: `["{c}"]`},
+		{name: "links from", path: "/linksFrom/{a}", wantStatus: http.StatusOK, wantJSON: `["{b}"]`},
+		{name: "links from including noindex", path: "/linksFrom/{a}?noindex=true", wantStatus: http.StatusOK, wantJSON: `["{b}", "{c}"]`},
+		{name: "links to", path: "/linksTo/{a}?noindex=true", wantStatus: http.StatusOK, wantJSON: `["{c}"]`},
+		{name: "links to as of a date", path: "/linksTo/{a}?noindex=true&at=2021-01-01", wantStatus: http.StatusOK, wantJSON: `null`},
+		{name: "links to as of a time", path: "/linksTo/{a}?noindex=true&at=2021-01-02T00:00:00Z", wantStatus: http.StatusOK, wantJSON: `["{c}"]`},
+		{name: "bad time", path: "/linksFrom/{a}?at=yesterday", wantStatus: http.StatusBadRequest, wantText: "Could not understand the time yesterday"},
+		{name: "bad noindex", path: "/linksTo/{a}?noindex=maybe", wantStatus: http.StatusBadRequest, wantText: "Could not understand noindex=maybe"},
+		{name: "unknown page", path: "/page/nothing", wantStatus: http.StatusNotFound, wantText: "Nothing found for nothing"},
+		{
+			name:       "seed",
+			path:       "/page/{a}",
+			wantStatus: http.StatusOK,
+			wantJSON: `{
+				"node": {"id": "{a}", "group": "example.com", "url": "https://example.com/", "depth": 0, "seeds": ["{a}"]},
+				"links": ["{b}"]
+			}`,
+		},
+		{
+			name:       "leaf",
+			path:       "/page/{b}",
+			wantStatus: http.StatusOK,
+			wantJSON: `{
+				"node": {"id": "{b}", "group": "example.com", "url": "https://example.com/b.pdf", "depth": 1, "discoveredFrom": "{a}", "seeds": ["{a}"], "leaf": true},
+				"links": null,
+				"fetch": {"status": 200, "contentType": "application/pdf", "mimeType": "application/pdf", "contentLength": 10, "responseTimeMs": 0, "fetchedAt": "2021-01-02T00:00:00Z"}
+			}`,
+		},
+		{
+			name:       "page with metadata",
+			path:       "/page/{c}",
+			wantStatus: http.StatusOK,
+			wantJSON: `{
+				"node": {
+					"id": "{c}", "group": "other.com", "url": "https://other.com/c", "depth": 1, "discoveredFrom": "{a}", "seeds": ["{a}"],
+					"title": "C", "robots": "noindex", "noindex": true
+				},
+				"links": ["{a}"],
+				"fetch": {"status": 200, "contentType": "text/html", "mimeType": "text/html", "contentLength": 20, "responseTimeMs": 0, "fetchedAt": "2021-01-02T00:00:00Z"}
+			}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, hashes.Replace(tt.path), nil))
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", recorder.Code, tt.wantStatus, recorder.Body)
+			}
+			if tt.wantText != "" && !strings.Contains(recorder.Body.String(), tt.wantText) {
+				t.Errorf("response %q doesn't contain %q", recorder.Body, tt.wantText)
+			}
+			if tt.wantJSON == "" {
+				return
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &got); err != nil {
+				t.Fatalf("response %q isn't JSON: %v", recorder.Body, err)
+			}
+			if err := json.Unmarshal([]byte(hashes.Replace(tt.wantJSON)), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("response %s, want %s", recorder.Body, hashes.Replace(tt.wantJSON))
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package linkcanon
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// This is how urls are cleaned up, and how we decide whether two urls are the same page.
+
+// Policy turns urls into their canonical form, and decides which string identifies the page a url points to.
+// The page id is a hash of the identity, so changing the policy of an existing graph means rehashing every page.
+type Policy interface {
+	// Canonicalise returns a cleaned up copy of the url, which still points to the same place.
+	Canonicalise(u *url.URL) *url.URL
+	// Identity returns the string which identifies the page the url points to.
+	Identity(u *url.URL) string
+}
+
+// Legacy is the policy the graph was originally built with.
+// Urls are left alone, and only the host and path identify a page, so every query string of a page is the same page.
+type Legacy struct{}
+
+// Canonicalise returns the url as it is.
+func (Legacy) Canonicalise(u *url.URL) *url.URL {
+	return u
+}
+
+// Identity returns the host and path.
+func (Legacy) Identity(u *url.URL) string {
+	return u.Hostname() + u.EscapedPath()
+}
+
+// TrailingSlash is what to do with a slash on the end of a path.
+type TrailingSlash int
+
+const (
+	// KeepTrailingSlash leaves paths alone, so "/a/" and "/a" are different pages.
+	KeepTrailingSlash TrailingSlash = iota
+	// StripTrailingSlash removes the slash from the end of every path but the root, so "/a/" and "/a" are the same page.
+	StripTrailingSlash
+)
+
+// Options is a policy made up of the normalisations you want.
+// Hosts are always lowercased, default ports, fragments and dot segments are always removed,
+// and percent-encoding is always normalised, as none of those change where a url points.
+type Options struct {
+	TrailingSlash TrailingSlash
+	// SortQuery sorts the query parameters, so the order they were written in doesn't matter.
+	SortQuery bool
+	// StripTrackingParams removes query parameters like utm_source, which are only there to track clicks.
+	StripTrackingParams bool
+	// IgnoreQuery leaves the query out of the identity, so every query string of a page is the same page.
+	IgnoreQuery bool
+	// FoldScheme treats http and https as the same page. The url itself keeps its scheme.
+	FoldScheme bool
+	// FoldWWW treats "www.example.com" and "example.com" as the same page. The url itself keeps its host.
+	FoldWWW bool
+}
+
+// Canonical is a sensible policy for a new graph, where query strings are different pages.
+var Canonical = Options{
+	SortQuery:           true,
+	StripTrackingParams: true,
+}
+
+// CanonicalFolded goes further than Canonical, also folding http into https, www. into the bare host, and trailing slashes.
+var CanonicalFolded = Options{
+	TrailingSlash:       StripTrailingSlash,
+	SortQuery:           true,
+	StripTrackingParams: true,
+	FoldScheme:          true,
+	FoldWWW:             true,
+}
+
+// PolicyByName returns one of the built in policies, "legacy" (the default), "canonical" or "canonical-folded".
+func PolicyByName(name string) (Policy, error) {
+	switch name {
+	case "", "legacy":
+		return Legacy{}, nil
+	case "canonical":
+		return Canonical, nil
+	case "canonical-folded":
+		return CanonicalFolded, nil
+	default:
+		return nil, fmt.Errorf("unknown url identity %q", name)
+	}
+}
+
+var (
+	defaultPorts = map[string]string{
+		"http":  "80",
+		"https": "443",
+	}
+	trackingParams = map[string]struct{}{
+		"fbclid":  {},
+		"gclid":   {},
+		"dclid":   {},
+		"msclkid": {},
+		"yclid":   {},
+		"igshid":  {},
+		"mc_cid":  {},
+		"mc_eid":  {},
+		"_ga":     {},
+		"_hsenc":  {},
+		"_hsmi":   {},
+	}
+)
+
+// Canonicalise returns a cleaned up copy of the url.
+func (o Options) Canonicalise(u *url.URL) *url.URL {
+	c := *u
+	c.Scheme = strings.ToLower(c.Scheme)
+	c.Fragment = ""
+	c.RawFragment = ""
+
+	host := strings.TrimSuffix(strings.ToLower(c.Hostname()), ".")
+	if strings.Contains(host, ":") {
+		// IPv6 addresses need their brackets back.
+		host = "[" + host + "]"
+	}
+	if port := c.Port(); port != "" && port != defaultPorts[c.Scheme] {
+		host += ":" + port
+	}
+	c.Host = host
+
+	path := removeDotSegments(normalisePercentEncoding(c.EscapedPath()))
+	if path == "" {
+		path = "/"
+	}
+	if o.TrailingSlash == StripTrailingSlash && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+	c.RawPath = path
+	c.Path, _ = url.PathUnescape(path)
+
+	c.RawQuery = o.canonicalQuery(c.RawQuery)
+	c.ForceQuery = false
+
+	return &c
+}
+
+// Identity returns the canonical url, folded however the options say.
+func (o Options) Identity(u *url.URL) string {
+	c := o.Canonicalise(u)
+	scheme := c.Scheme
+	if o.FoldScheme && scheme == "http" {
+		scheme = "https"
+	}
+	host := c.Host
+	if o.FoldWWW {
+		host = strings.TrimPrefix(host, "www.")
+	}
+	identity := scheme + "://" + host + c.EscapedPath()
+	if !o.IgnoreQuery && c.RawQuery != "" {
+		identity += "?" + c.RawQuery
+	}
+	return identity
+}
+
+// canonicalQuery normalises the query string, without decoding anything that would change its meaning.
+func (o Options) canonicalQuery(rawQuery string) string {
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		param = normalisePercentEncoding(param)
+		if o.StripTrackingParams && isTrackingParam(param) {
+			continue
+		}
+		params = append(params, param)
+	}
+	if o.SortQuery {
+		// Parameters with the same name keep their order, as that can matter.
+		sort.SliceStable(params, func(i, j int) bool {
+			return paramName(params[i]) < paramName(params[j])
+		})
+	}
+	return strings.Join(params, "&")
+}
+
+func paramName(param string) string {
+	name, _, _ := strings.Cut(param, "=")
+	return name
+}
+
+func isTrackingParam(param string) bool {
+	name, err := url.QueryUnescape(paramName(param))
+	if err != nil {
+		return false
+	}
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, "utm_") {
+		return true
+	}
+	_, ok := trackingParams[name]
+	return ok
+}
+
+// normalisePercentEncoding decodes escaped characters which never need escaping, and uppercases the rest of the escapes.
+func normalisePercentEncoding(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+// removeDotSegments resolves "." and ".." in a path, as in RFC 3986 section 5.2.4.
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			// Never remove the empty segment before the leading slash.
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, segment)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
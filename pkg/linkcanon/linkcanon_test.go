@@ -0,0 +1,125 @@
+package linkcanon
+
+import (
+	"net/url"
+	"testing"
+)
+
+func parse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestCanonicalise(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		rawURL  string
+		want    string
+	}{
+		{name: "host is lowercased", rawURL: "https://Example.COM/Path", want: "https://example.com/Path"},
+		{name: "default port is removed", rawURL: "http://example.com:80/a", want: "http://example.com/a"},
+		{name: "other ports are kept", rawURL: "https://example.com:8443/a", want: "https://example.com:8443/a"},
+		{name: "fragment is removed", rawURL: "https://example.com/a#top", want: "https://example.com/a"},
+		{name: "trailing dot on the host", rawURL: "https://example.com./a", want: "https://example.com/a"},
+		{name: "empty path is root", rawURL: "https://example.com", want: "https://example.com/"},
+		{name: "dot segments", rawURL: "https://example.com/a/./b/../c", want: "https://example.com/a/c"},
+		{name: "dot segments can't escape the root", rawURL: "https://example.com/../../a", want: "https://example.com/a"},
+		{name: "unreserved escapes are decoded", rawURL: "https://example.com/%7Euser/%41", want: "https://example.com/~user/A"},
+		{name: "reserved escapes are uppercased", rawURL: "https://example.com/a%2fb", want: "https://example.com/a%2Fb"},
+		{name: "empty query is dropped", rawURL: "https://example.com/a?", want: "https://example.com/a"},
+		{name: "ipv6 host", rawURL: "http://[::1]:80/a", want: "http://[::1]/a"},
+		{name: "trailing slash kept", rawURL: "https://example.com/a/", want: "https://example.com/a/"},
+		{
+			name:    "trailing slash stripped",
+			options: Options{TrailingSlash: StripTrailingSlash},
+			rawURL:  "https://example.com/a//",
+			want:    "https://example.com/a",
+		},
+		{
+			name:    "root keeps its slash",
+			options: Options{TrailingSlash: StripTrailingSlash},
+			rawURL:  "https://example.com/",
+			want:    "https://example.com/",
+		},
+		{name: "query order is kept", rawURL: "https://example.com/?b=1&a=2", want: "https://example.com/?b=1&a=2"},
+		{
+			name:    "query is sorted, keeping the order of repeated names",
+			options: Options{SortQuery: true},
+			rawURL:  "https://example.com/?b=1&a=2&b=0",
+			want:    "https://example.com/?a=2&b=1&b=0",
+		},
+		{
+			name:    "tracking params are stripped",
+			options: Options{StripTrackingParams: true},
+			rawURL:  "https://example.com/?id=1&utm_source=x&UTM_Medium=y&fbclid=z",
+			want:    "https://example.com/?id=1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.options.Canonicalise(parse(t, tt.rawURL)).String(); got != tt.want {
+				t.Errorf("Canonicalise(%s) = %s, want %s", tt.rawURL, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		a, b   string
+		same   bool
+	}{
+		{name: "legacy ignores the query", policy: Legacy{}, a: "https://example.com/a?x=1", b: "https://example.com/a?x=2", same: true},
+		{name: "legacy ignores the scheme", policy: Legacy{}, a: "http://example.com/a", b: "https://example.com/a", same: true},
+		{name: "legacy keeps the trailing slash", policy: Legacy{}, a: "https://example.com/a", b: "https://example.com/a/", same: false},
+		{name: "canonical keeps the query", policy: Canonical, a: "https://example.com/a?x=1", b: "https://example.com/a?x=2", same: false},
+		{name: "canonical sorts the query", policy: Canonical, a: "https://example.com/a?x=1&y=2", b: "https://example.com/a?y=2&x=1", same: true},
+		{name: "canonical drops tracking", policy: Canonical, a: "https://example.com/a", b: "https://example.com/a?utm_campaign=z", same: true},
+		{name: "canonical keeps the scheme", policy: Canonical, a: "http://example.com/a", b: "https://example.com/a", same: false},
+		{name: "canonical keeps www", policy: Canonical, a: "https://www.example.com/a", b: "https://example.com/a", same: false},
+		{name: "folded folds the scheme", policy: CanonicalFolded, a: "http://example.com/a", b: "https://example.com/a", same: true},
+		{name: "folded folds www", policy: CanonicalFolded, a: "https://www.example.com/a", b: "https://example.com/a", same: true},
+		{name: "folded folds the trailing slash", policy: CanonicalFolded, a: "https://example.com/a/", b: "https://example.com/a", same: true},
+		{name: "ignore query", policy: Options{IgnoreQuery: true}, a: "https://example.com/a?x=1", b: "https://example.com/a", same: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := tt.policy.Identity(parse(t, tt.a)), tt.policy.Identity(parse(t, tt.b))
+			if (a == b) != tt.same {
+				t.Errorf("identities %q and %q, want same = %v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestPolicyByName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Policy
+		wantErr bool
+	}{
+		{name: "", want: Legacy{}},
+		{name: "legacy", want: Legacy{}},
+		{name: "canonical", want: Canonical},
+		{name: "canonical-folded", want: CanonicalFolded},
+		{name: "something-else", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PolicyByName(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error = %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package linkprocessor
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/transform"
+)
+
+// This is how a response body is turned into utf-8 html we can parse:
+// decompressed, cut off at a maximum size so one huge page can't use up all our memory, and transcoded from whatever charset it was written in.
+
+// DefaultMaxBodySize is how much of a page we read, after decompressing it, if MAX_BODY_SIZE isn't set.
+const DefaultMaxBodySize = 10 << 20
+
+// acceptEncoding is the compression we undo ourselves.
+// Asking for it explicitly stops the http client quietly undoing gzip for us, so gzip and brotli are handled the same way.
+const acceptEncoding = "gzip, br"
+
+// charsetPrescan is how much of the page we look through for a <meta> charset, as browsers do.
+const charsetPrescan = 1024
+
+// decompress undoes the response's Content-Encoding.
+func decompress(response *http.Response, r io.Reader) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return r, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(r)
+		if errors.Is(err, io.EOF) {
+			// There is no body at all, such as after a HEAD request.
+			return http.NoBody, nil
+		}
+		return gz, err
+	case "br":
+		return brotli.NewReader(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+}
+
+// limitedReader reads at most n bytes, remembering whether there was more that we didn't read.
+type limitedReader struct {
+	r         io.Reader
+	n         int64
+	truncated bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Read one more byte, just to find out if we have cut anything off.
+		var b [1]byte
+		if n, _ := l.r.Read(b[:]); n > 0 {
+			l.truncated = true
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// decodeCharset transcodes the html to utf-8.
+// The charset comes from a byte order mark, the Content-Type, or a <meta> tag near the start of the page, in that order,
+// and is guessed from the content if none of them say.
+func decodeCharset(body *bufio.Reader, contentType string) io.Reader {
+	start, _ := body.Peek(charsetPrescan)
+	encoding, name, _ := charset.DetermineEncoding(start, contentType)
+	if name == "utf-8" {
+		return body
+	}
+	return transform.NewReader(body, encoding.NewDecoder())
+}
@@ -0,0 +1,238 @@
+package linkprocessor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(w, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func brotlied(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := brotli.NewWriter(&buf)
+	if _, err := io.WriteString(w, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestScrapeContentEncoding(t *testing.T) {
+	page := `<html><body><a href="/a">A</a></body></html>`
+	tests := []struct {
+		name      string
+		encoding  string
+		body      []byte
+		wantErr   string
+		wantClass string
+		wantLinks []string
+	}{
+		{name: "none", body: []byte(page), wantLinks: []string{"link /a"}},
+		{name: "identity", encoding: "identity", body: []byte(page), wantLinks: []string{"link /a"}},
+		{name: "gzip", encoding: "gzip", body: gzipped(t, page), wantLinks: []string{"link /a"}},
+		{name: "x-gzip", encoding: "x-gzip", body: gzipped(t, page), wantLinks: []string{"link /a"}},
+		{name: "brotli", encoding: "br", body: brotlied(t, page), wantLinks: []string{"link /a"}},
+		{name: "encoding in capitals", encoding: "GZIP", body: gzipped(t, page), wantLinks: []string{"link /a"}},
+		{name: "unsupported", encoding: "compress", body: []byte(page), wantErr: `unsupported Content-Encoding "compress"`, wantClass: linkstorage.FetchErrorParse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := scrape(t, Options{}, func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Accept-Encoding"); got != acceptEncoding {
+					t.Errorf("Accept-Encoding %q, want %q", got, acceptEncoding)
+				}
+				w.Header().Set("Content-Type", "text/html")
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Write(tt.body)
+			}, "/page")
+			if tt.wantErr == "" && result.err != nil {
+				t.Fatal(result.err)
+			}
+			if tt.wantErr != "" && (result.err == nil || !strings.Contains(result.err.Error(), tt.wantErr)) {
+				t.Errorf("error %v, want %q", result.err, tt.wantErr)
+			}
+			if result.fetch == nil || result.fetch.ErrorClass != tt.wantClass {
+				t.Errorf("stored fetch %+v, want error class %q", result.fetch, tt.wantClass)
+			}
+			if got := result.targets(); !reflect.DeepEqual(got, tt.wantLinks) {
+				t.Errorf("links %q, want %q", got, tt.wantLinks)
+			}
+		})
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		n             int64
+		want          string
+		wantTruncated bool
+	}{
+		{name: "under the limit", input: "hello", n: 10, want: "hello"},
+		{name: "exactly the limit", input: "hello", n: 5, want: "hello"},
+		{name: "over the limit", input: "hello", n: 3, want: "hel", wantTruncated: true},
+		{name: "no limit left", input: "hello", n: 0, want: "", wantTruncated: true},
+		{name: "nothing to read", input: "", n: 0, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limited := &limitedReader{r: strings.NewReader(tt.input), n: tt.n}
+			got, err := io.ReadAll(limited)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want || limited.truncated != tt.wantTruncated {
+				t.Errorf("read %q and truncated %v, want %q and %v", got, limited.truncated, tt.want, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestScrapeMaxBodySize(t *testing.T) {
+	start := `<html><body><a href="/a">A</a>`
+	end := `<a href="/b">B</a></body></html>`
+	page := start + strings.Repeat(" ", 200) + end
+	tests := []struct {
+		name        string
+		maxBodySize int64
+		encoding    string
+		wantClass   string
+		wantLinks   []string
+		// wantGone is whether a link that was on the page before, but isn't now, is taken to have been removed.
+		wantGone bool
+	}{
+		{name: "whole page", wantLinks: []string{"/a", "/b"}, wantGone: true},
+		{name: "exactly the limit", maxBodySize: int64(len(page)), wantLinks: []string{"/a", "/b"}, wantGone: true},
+		// We can't tell if links we didn't get to are still there.
+		{name: "start of the page", maxBodySize: int64(len(start) + 10), wantClass: linkstorage.FetchErrorTooLarge, wantLinks: []string{"/a"}},
+		// The limit is on the page, not how small the server managed to squash it.
+		{name: "decompressed size", maxBodySize: int64(len(start) + 10), encoding: "gzip", wantClass: linkstorage.FetchErrorTooLarge, wantLinks: []string{"/a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "text/html")
+				if tt.encoding == "gzip" {
+					w.Header().Set("Content-Encoding", "gzip")
+					w.Write(gzipped(t, page))
+					return
+				}
+				io.WriteString(w, page)
+			}))
+			defer server.Close()
+
+			lp, storage, flush := newTestProcessor(t, Options{MaxBodySize: tt.maxBodySize})
+			u := mustParse(t, server.URL+"/page")
+			gone := mustParse(t, server.URL+"/gone")
+			storage.AddLink(&linkstorage.Link{FromU: u, ToU: gone, Type: linkstorage.LinkTypeLink, SeenAt: time.Now().Add(-time.Hour)})
+
+			links, err := lp.ScrapeLinksFromURL(u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flush()
+
+			var got []string
+			for _, link := range links {
+				got = append(got, link.ToU.Path)
+			}
+			if !reflect.DeepEqual(got, tt.wantLinks) {
+				t.Errorf("links %q, want %q", got, tt.wantLinks)
+			}
+			fetch, err := storage.GetFetchResult(linkutils.Hash(u))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fetch == nil || fetch.ErrorClass != tt.wantClass {
+				t.Errorf("stored fetch %+v, want error class %q", fetch, tt.wantClass)
+			}
+			exists, err := storage.GetLinksFrom(linkutils.Hash(u), 10, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			isGone := true
+			for _, hash := range exists {
+				if hash == linkutils.Hash(gone) {
+					isGone = false
+				}
+			}
+			if isGone != tt.wantGone {
+				t.Errorf("old link removed %v, want %v", isGone, tt.wantGone)
+			}
+		})
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{name: "utf-8", contentType: "text/html; charset=utf-8", body: "<p>café</p>", want: "<p>café</p>"},
+		{name: "undeclared utf-8", contentType: "text/html", body: "<p>café</p>", want: "<p>café</p>"},
+		{name: "charset from the content type", contentType: "text/html; charset=iso-8859-1", body: "<p>caf\xe9</p>", want: "<p>café</p>"},
+		{name: "charset from a meta tag", contentType: "text/html", body: `<meta charset="windows-1252"><p>` + "\x93hi\x94</p>", want: `<meta charset="windows-1252"><p>“hi”</p>`},
+		{name: "multibyte charset from a meta tag", contentType: "text/html", body: `<meta http-equiv="Content-Type" content="text/html; charset=shift_jis"><p>` + "\x93\xfa\x96\x7b</p>", want: `<meta http-equiv="Content-Type" content="text/html; charset=shift_jis"><p>日本</p>`},
+		{name: "content type beats a meta tag", contentType: "text/html; charset=iso-8859-1", body: `<meta charset="utf-8"><p>` + "caf\xe9</p>", want: `<meta charset="utf-8"><p>café</p>`},
+		{name: "byte order mark beats the content type", contentType: "text/html; charset=iso-8859-1", body: "\xef\xbb\xbf<p>café</p>", want: "\ufeff<p>café</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(decodeCharset(bufio.NewReader(strings.NewReader(tt.body)), tt.contentType))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("decoded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapeCharset(t *testing.T) {
+	result := scrape(t, Options{}, typed("text/html; charset=iso-8859-1", "<html><body><a href=\"/a\">Caf\xe9 cr\xe8me</a></body></html>"), "/page")
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if len(result.links) != 1 {
+		t.Fatalf("links %q, want just /a", result.targets())
+	}
+	if got, want := result.links[0].LinkText, "Café crème"; got != want {
+		t.Errorf("link text %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package linkprocessor
+
+import (
+	"bufio"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// This is how we decide what a url is, and so whether it is a page to parse or a leaf to just record.
+// The extension is only a hint, the Content-Type and the start of the body have the final say.
+
+// sniffLength is how much of the body http.DetectContentType looks at.
+const sniffLength = 512
+
+// htmlExtensions are the extensions of urls which are almost always html pages, so they are fetched without asking first.
+var htmlExtensions = map[string]struct{}{
+	"":       {},
+	".html":  {},
+	".htm":   {},
+	".xhtml": {},
+	".shtml": {},
+	".php":   {},
+	".asp":   {},
+	".aspx":  {},
+	".jsp":   {},
+	".jspx":  {},
+	".cfm":   {},
+	".cgi":   {},
+	".pl":    {},
+	".do":    {},
+}
+
+// vagueTypes are the Content-Types servers send when they don't really know, so the body is sniffed instead.
+var vagueTypes = map[string]struct{}{
+	"":                         {},
+	"application/octet-stream": {},
+	"application/unknown":      {},
+	"binary/octet-stream":      {},
+	"text/plain":               {},
+}
+
+// likelyHTML returns true if the url's extension says it is almost certainly a page, rather than an image or download or something we can't tell.
+func likelyHTML(u *url.URL) bool {
+	_, ok := htmlExtensions[strings.ToLower(path.Ext(u.EscapedPath()))]
+	return ok
+}
+
+// isHTML returns true if the MIME type is one we parse for links.
+func isHTML(mimeType string) bool {
+	return mimeType == "text/html" || mimeType == "application/xhtml+xml"
+}
+
+// responseType returns the MIME type of the response, from its Content-Type,
+// or by sniffing the start of the body if the Content-Type is missing or too vague to trust.
+// body may be nil, such as for a HEAD request, in which case nothing is sniffed.
+func responseType(response *http.Response, body *bufio.Reader) string {
+	mimeType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		mimeType = ""
+	}
+	mimeType = strings.ToLower(mimeType)
+	if _, vague := vagueTypes[mimeType]; !vague || body == nil {
+		return mimeType
+	}
+	start, _ := body.Peek(sniffLength)
+	if len(start) == 0 {
+		return mimeType
+	}
+	sniffed, _, err := mime.ParseMediaType(http.DetectContentType(start))
+	if err != nil {
+		return mimeType
+	}
+	return sniffed
+}
+
+// preflight asks for just the headers of a url whose extension doesn't say it is html, so we can avoid downloading something we won't parse.
+// It returns the response if it tells us all we need to know, because the url isn't html or hasn't changed,
+// or nil if the url should be fetched properly, including when the server doesn't understand HEAD.
+func (lp *LinkProcessor) preflight(u *url.URL, headers http.Header) *http.Response {
+	request, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		return nil
+	}
+	request.Header = headers.Clone()
+
+	response, err := lp.httpClient.Do(request)
+	if err != nil {
+		return nil
+	}
+	response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return response
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil
+	}
+	// If the server isn't sure what it is, we need to see the start of it to find out.
+	mimeType := responseType(response, nil)
+	if _, vague := vagueTypes[mimeType]; vague || isHTML(mimeType) {
+		return nil
+	}
+	return response
+}
@@ -0,0 +1,185 @@
+package linkprocessor
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// typed returns a handler which serves the body with exactly the given Content-Type, or none at all if it is empty.
+func typed(contentType string, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if contentType == "" {
+			// Otherwise the server sniffs one for us.
+			w.Header()["Content-Type"] = nil
+		} else {
+			w.Header().Set("Content-Type", contentType)
+		}
+		fmt.Fprint(w, body)
+	}
+}
+
+func TestLikelyHTML(t *testing.T) {
+	tests := []struct {
+		rawURL string
+		want   bool
+	}{
+		{rawURL: "https://example.com", want: true},
+		{rawURL: "https://example.com/", want: true},
+		{rawURL: "https://example.com/about", want: true},
+		{rawURL: "https://example.com/index.HTML", want: true},
+		{rawURL: "https://example.com/page.php?id=1", want: true},
+		{rawURL: "https://example.com/default.aspx", want: true},
+		{rawURL: "https://example.com/wiki/Foo.bar", want: false},
+		{rawURL: "https://example.com/file.pdf", want: false},
+		{rawURL: "https://example.com/image.png", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rawURL, func(t *testing.T) {
+			if got := likelyHTML(mustParse(t, tt.rawURL)); got != tt.want {
+				t.Errorf("likelyHTML(%s) = %v, want %v", tt.rawURL, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapeContentType(t *testing.T) {
+	page := `<html><body><a href="/a">A</a></body></html>`
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantMIME    string
+		wantLinks   []string
+	}{
+		{name: "html", contentType: "text/html; charset=utf-8", body: page, wantMIME: "text/html", wantLinks: []string{"link /a"}},
+		{name: "xhtml", contentType: "application/xhtml+xml", body: page, wantMIME: "application/xhtml+xml", wantLinks: []string{"link /a"}},
+		{name: "type in capitals", contentType: "Text/HTML", body: page, wantMIME: "text/html", wantLinks: []string{"link /a"}},
+		{name: "pdf is a leaf", contentType: "application/pdf", body: "%PDF-1.4 <a href=\"/a\">", wantMIME: "application/pdf"},
+		{name: "image is a leaf", contentType: "image/png", body: png, wantMIME: "image/png"},
+		{name: "missing type is sniffed", body: page, wantMIME: "text/html", wantLinks: []string{"link /a"}},
+		{name: "vague type is sniffed", contentType: "application/octet-stream", body: page, wantMIME: "text/html", wantLinks: []string{"link /a"}},
+		{name: "broken type is sniffed", contentType: "text/html; charset", body: page, wantMIME: "text/html", wantLinks: []string{"link /a"}},
+		{name: "sniffed leaf", contentType: "text/plain", body: png, wantMIME: "image/png"},
+		{name: "plain text is a leaf", contentType: "text/plain", body: "just some text", wantMIME: "text/plain"},
+		{name: "nothing to sniff", contentType: "application/octet-stream", wantMIME: "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := scrape(t, Options{}, typed(tt.contentType, tt.body), "/page")
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			if result.fetch == nil {
+				t.Fatalf("the fetch wasn't stored")
+			}
+			if result.fetch.MIMEType != tt.wantMIME || result.fetch.ContentType != tt.contentType {
+				t.Errorf("mime type %q and content type %q, want %q and %q", result.fetch.MIMEType, result.fetch.ContentType, tt.wantMIME, tt.contentType)
+			}
+			if got := result.targets(); !reflect.DeepEqual(got, tt.wantLinks) {
+				t.Errorf("links %q, want %q", got, tt.wantLinks)
+			}
+		})
+	}
+}
+
+func TestScrapeHeadPreflight(t *testing.T) {
+	page := `<html><body><a href="/a">A</a></body></html>`
+	tests := []struct {
+		name      string
+		preflight bool
+		path      string
+		// head is the handler for HEAD requests, and get for everything else.
+		head         http.HandlerFunc
+		get          http.HandlerFunc
+		wantRequests []string
+		wantMIME     string
+		wantLinks    []string
+	}{
+		{
+			name:         "urls are fetched without asking by default",
+			path:         "/file.pdf",
+			get:          typed("application/pdf", "%PDF-1.4"),
+			wantRequests: []string{"GET /file.pdf"},
+			wantMIME:     "application/pdf",
+		},
+		{
+			name:         "pages are fetched without asking",
+			preflight:    true,
+			path:         "/page.php",
+			get:          typed("text/html", page),
+			wantRequests: []string{"GET /page.php"},
+			wantMIME:     "text/html",
+			wantLinks:    []string{"link /a"},
+		},
+		{
+			name:         "leaf is never downloaded",
+			preflight:    true,
+			path:         "/file.pdf",
+			head:         typed("application/pdf", ""),
+			wantRequests: []string{"HEAD /file.pdf"},
+			wantMIME:     "application/pdf",
+		},
+		{
+			name:         "url that turns out to be a page",
+			preflight:    true,
+			path:         "/wiki/Foo.bar",
+			head:         typed("text/html", ""),
+			get:          typed("text/html", page),
+			wantRequests: []string{"HEAD /wiki/Foo.bar", "GET /wiki/Foo.bar"},
+			wantMIME:     "text/html",
+			wantLinks:    []string{"link /a"},
+		},
+		{
+			name:         "server which is vague about it",
+			preflight:    true,
+			path:         "/download.bin",
+			head:         typed("application/octet-stream", ""),
+			get:          typed("application/octet-stream", page),
+			wantRequests: []string{"HEAD /download.bin", "GET /download.bin"},
+			wantMIME:     "text/html",
+			wantLinks:    []string{"link /a"},
+		},
+		{
+			name:      "server that doesn't understand HEAD",
+			preflight: true,
+			path:      "/file.pdf",
+			head: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			},
+			get:          typed("application/pdf", "%PDF-1.4"),
+			wantRequests: []string{"HEAD /file.pdf", "GET /file.pdf"},
+			wantMIME:     "application/pdf",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := scrape(t, Options{HeadPreflight: tt.preflight}, func(w http.ResponseWriter, r *http.Request) {
+				handler := tt.get
+				if r.Method == http.MethodHead {
+					handler = tt.head
+				}
+				if handler == nil {
+					t.Errorf("unexpected %s request", r.Method)
+					http.NotFound(w, r)
+					return
+				}
+				handler(w, r)
+			}, tt.path)
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			if !reflect.DeepEqual(result.requests, tt.wantRequests) {
+				t.Errorf("requests %q, want %q", result.requests, tt.wantRequests)
+			}
+			if result.fetch == nil || result.fetch.MIMEType != tt.wantMIME || result.fetch.StatusCode != http.StatusOK {
+				t.Errorf("stored fetch %+v, want a 200 of %s", result.fetch, tt.wantMIME)
+			}
+			if got := result.targets(); !reflect.DeepEqual(got, tt.wantLinks) {
+				t.Errorf("links %q, want %q", got, tt.wantLinks)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package linkprocessor
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/jamesjarvis/web-graph/pkg/linkrobots"
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// This is how links are found in a page, in <a> and in any other elements we have been asked to look at.
+
+// linkElement is somewhere a link can come from, stored with its own link type.
+type linkElement struct {
+	linkType string
+	tag      string
+	// attr holds the url, and textAttr holds the link text, or the text inside the element is used if it is empty.
+	attr     string
+	textAttr string
+	// rel, if set, must be one of the element's rel values.
+	rel string
+}
+
+var anchorElement = linkElement{linkType: linkstorage.LinkTypeLink, tag: "a", attr: "href"}
+
+var extraElements = []linkElement{
+	{linkType: linkstorage.LinkTypeArea, tag: "area", attr: "href", textAttr: "alt"},
+	{linkType: linkstorage.LinkTypeIframe, tag: "iframe", attr: "src", textAttr: "title"},
+	{linkType: linkstorage.LinkTypeFrame, tag: "frame", attr: "src", textAttr: "title"},
+	{linkType: linkstorage.LinkTypeAlternate, tag: "link", attr: "href", textAttr: "title", rel: "alternate"},
+	{linkType: linkstorage.LinkTypeNext, tag: "link", attr: "href", textAttr: "title", rel: "next"},
+	{linkType: linkstorage.LinkTypePrev, tag: "link", attr: "href", textAttr: "title", rel: "prev"},
+}
+
+// sectionSelector finds the part of the page outside the main content that an element is in.
+const sectionSelector = "nav, header, footer"
+
+// Elements is the set of extra link types to extract, as well as links in <a>.
+type Elements map[string]bool
+
+// ParseElements parses a comma separated list of extra link types to extract, such as "area,iframe,next".
+// "all" extracts every one of them, and an empty string extracts none.
+func ParseElements(s string) (Elements, error) {
+	elements := Elements{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			for _, e := range extraElements {
+				elements[e.linkType] = true
+			}
+			continue
+		}
+		known := false
+		for _, e := range extraElements {
+			if e.linkType == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown element %q", name)
+		}
+		elements[name] = true
+	}
+	return elements, nil
+}
+
+// enabled returns <a> and whichever extra elements were asked for.
+func (elements Elements) enabled() []linkElement {
+	enabled := []linkElement{anchorElement}
+	for _, e := range extraElements {
+		if elements[e.linkType] {
+			enabled = append(enabled, e)
+		}
+	}
+	return enabled
+}
+
+// match returns the first of the elements the html element is, if any.
+func match(enabled []linkElement, element *goquery.Selection) (linkElement, bool) {
+	tag := goquery.NodeName(element)
+	for _, e := range enabled {
+		if e.tag != tag {
+			continue
+		}
+		if e.rel != "" {
+			rel := element.AttrOr("rel", "")
+			// An alternate stylesheet is a stylesheet, not another version of the page.
+			if !hasToken(rel, e.rel) || hasToken(rel, "stylesheet") {
+				continue
+			}
+		}
+		return e, true
+	}
+	return linkElement{}, false
+}
+
+// links returns every link in the page, in the order they first appear.
+// A page linking to the same place more than once gives one link, with the rel, position and section of the first one and every distinct text.
+func (elements Elements) links(document *goquery.Document, from *url.URL, base *url.URL) []*linkstorage.Link {
+	enabled := elements.enabled()
+	selectors := make([]string, 0, len(enabled))
+	for _, e := range enabled {
+		selectors = append(selectors, e.tag+"["+e.attr+"]")
+	}
+
+	var links []*linkstorage.Link
+	byTarget := map[string]*linkstorage.Link{}
+	position := 0
+	// A group selector matches in document order.
+	document.Find(strings.Join(selectors, ", ")).Each(func(index int, element *goquery.Selection) {
+		e, ok := match(enabled, element)
+		if !ok {
+			return
+		}
+		to := resolveLink(base, element.AttrOr(e.attr, ""))
+		if to == nil {
+			return
+		}
+		position++
+
+		text := element.AttrOr(e.textAttr, "")
+		if e.textAttr == "" {
+			text = element.Text()
+		}
+		text = strings.Join(strings.Fields(text), " ")
+
+		hash := linkutils.Hash(to)
+		if link, ok := byTarget[hash]; ok {
+			if text != "" && !contains(link.Texts, text) {
+				link.Texts = append(link.Texts, text)
+				link.LinkText = link.Texts[0]
+			}
+			return
+		}
+
+		link := &linkstorage.Link{
+			FromU:    from,
+			ToU:      to,
+			LinkText: text,
+			Rel:      strings.ToLower(strings.Join(strings.Fields(element.AttrOr("rel", "")), " ")),
+			Position: position,
+			Type:     e.linkType,
+		}
+		if text != "" {
+			link.Texts = []string{text}
+		}
+		if section := element.Closest(sectionSelector); section.Length() > 0 {
+			link.Section = goquery.NodeName(section)
+		}
+		byTarget[hash] = link
+		links = append(links, link)
+	})
+	return links
+}
+
+// contains returns true if the string is in the list.
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// maxMetadataLength is the most characters of each piece of metadata we keep, so a page can't stuff its whole body into the description.
+const maxMetadataLength = 1000
+
+// pageMetadata returns what the page says about itself, including anything it asks of robots in its meta tags or the X-Robots-Tag header.
+func pageMetadata(document *goquery.Document, header http.Header) *linkstorage.PageMetadata {
+	metadata := &linkstorage.PageMetadata{
+		Title: cleanText(document.Find("head title").First().Text()),
+		Lang:  cleanText(document.Find("html").First().AttrOr("lang", "")),
+		H1:    cleanText(document.Find("h1").First().Text()),
+	}
+	if metadata.Title == "" {
+		metadata.Title = cleanText(document.Find("title").First().Text())
+	}
+
+	var robots []string
+	directives := linkrobots.ParseXRobotsTag(header.Values("X-Robots-Tag"), robotsToken)
+	document.Find("meta[name][content]").Each(func(index int, element *goquery.Selection) {
+		switch name := strings.ToLower(strings.TrimSpace(element.AttrOr("name", ""))); name {
+		case "description":
+			if metadata.Description == "" {
+				metadata.Description = cleanText(element.AttrOr("content", ""))
+			}
+		case "robots", strings.ToLower(robotsToken):
+			content := cleanText(element.AttrOr("content", ""))
+			if content == "" {
+				return
+			}
+			// Tags just for us count, but only the ones for everyone are kept as the page's robots.
+			if name == "robots" {
+				robots = append(robots, content)
+			}
+			directives = directives.Merge(linkrobots.ParseMetaRobots(content))
+		}
+	})
+	metadata.Robots = cleanText(strings.Join(robots, ", "))
+	metadata.Noindex = directives.Noindex
+	metadata.Nofollow = directives.Nofollow
+	return metadata
+}
+
+// cleanText collapses the whitespace in the text, and cuts it down to maxMetadataLength characters.
+func cleanText(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > maxMetadataLength {
+		text = string(runes[:maxMetadataLength])
+	}
+	return text
+}
+
+// documentBase returns the url relative links in the document are resolved against,
+// which is the first <base href> if there is one, or else the url the document came from.
+func documentBase(document *goquery.Document, u *url.URL) *url.URL {
+	href, ok := document.Find("base[href]").First().Attr("href")
+	if !ok {
+		return u
+	}
+	base, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return u
+	}
+	base = u.ResolveReference(base)
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return u
+	}
+	return base
+}
+
+// resolveLink resolves the href against the base, returning the canonical url, or nil if it isn't a web url.
+// Whether the link is in the crawl's scope is checked by the caller.
+func resolveLink(base *url.URL, href string) *url.URL {
+	href = strings.TrimSpace(href)
+	if href == "" {
+		return nil
+	}
+	link, err := url.Parse(href)
+	if err != nil {
+		return nil
+	}
+	link = base.ResolveReference(link)
+	if !linkutils.IsWebURL(link) {
+		return nil
+	}
+	return linkutils.Canonicalise(link)
+}
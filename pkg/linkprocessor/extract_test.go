@@ -0,0 +1,308 @@
+package linkprocessor
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+)
+
+func TestParseElements(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Elements
+		wantErr bool
+	}{
+		{name: "none", s: "", want: Elements{}},
+		{name: "some", s: " Area, iframe ,,next", want: Elements{"area": true, "iframe": true, "next": true}},
+		{
+			name: "all",
+			s:    "all",
+			want: Elements{"area": true, "iframe": true, "frame": true, "alternate": true, "next": true, "prev": true},
+		},
+		{name: "unknown", s: "area,img", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseElements(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseElements(%q) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapeLinkElements(t *testing.T) {
+	page := `<html><head>
+<link rel="alternate" href="/alt" title="Alt">
+<link rel="alternate stylesheet" href="/style.css">
+<link rel="next" href="/page2">
+<link rel="prev" href="/page0">
+<meta http-equiv="refresh" content="5; url='/refreshed'">
+</head><body>
+<a href="/a">A</a>
+<a href="https://other.com/x">Other</a>
+<a href="mailto:someone@example.com">Mail</a>
+<a href="javascript:void(0)">Nothing</a>
+<a>No href</a>
+<map><area href="/area" alt="Area"></map>
+<iframe src="/embedded" title="Embedded"></iframe>
+</body></html>`
+
+	tests := []struct {
+		name     string
+		elements string
+		want     []string
+	}{
+		{
+			name: "only <a> by default",
+			want: []string{"meta_refresh /refreshed", "link /a", "link https://other.com/x"},
+		},
+		{
+			name:     "some elements",
+			elements: "iframe,next",
+			want:     []string{"meta_refresh /refreshed", "next /page2", "link /a", "link https://other.com/x", "iframe /embedded"},
+		},
+		{
+			name:     "every element",
+			elements: "all",
+			want: []string{
+				"meta_refresh /refreshed", "alternate /alt", "next /page2", "prev /page0",
+				"link /a", "link https://other.com/x", "area /area", "iframe /embedded",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			elements, err := ParseElements(tt.elements)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := scrape(t, Options{Elements: elements}, html(page), "/page")
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			if got := result.targets(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("links %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapeBaseHref(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want []string
+	}{
+		{name: "no base", want: []string{"link /dir/a", "link /b"}},
+		{name: "relative base", head: `<base href="/other/">`, want: []string{"link /other/a", "link /b"}},
+		{name: "base up a level", head: `<base href="../up/">`, want: []string{"link /up/a", "link /b"}},
+		{name: "base on another host", head: `<base href="https://cdn.example.com/x/">`, want: []string{"link https://cdn.example.com/x/a", "link https://cdn.example.com/b"}},
+		{name: "first base wins", head: `<base href="/first/"><base href="/second/">`, want: []string{"link /first/a", "link /b"}},
+		{name: "base without a url is ignored", head: `<base target="_blank">`, want: []string{"link /dir/a", "link /b"}},
+		{name: "base that isn't a web url is ignored", head: `<base href="javascript:void(0)">`, want: []string{"link /dir/a", "link /b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := fmt.Sprintf(`<html><head>%s</head><body><a href="a">A</a><a href="/b">B</a></body></html>`, tt.head)
+			result := scrape(t, Options{}, html(page), "/dir/page")
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			if got := result.targets(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("links %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapeLinkAttributes(t *testing.T) {
+	page := `<html><body>
+<header><a href="/home" rel="home">Home</a></header>
+<nav><ul><li><a href="/a" rel=" NoFollow  UGC ">A</a></li></ul></nav>
+<main>
+<a href="/a">  Another
+  A </a>
+<a href="/b">B</a>
+<a href="/a">A</a>
+<a href="/c"><img src="/c.png"></a>
+</main>
+<footer><a href="/b">B again</a> <a href="/d" rel="sponsored">D</a></footer>
+</body></html>`
+
+	type attributes struct {
+		to       string
+		linkText string
+		texts    []string
+		rel      string
+		position int
+		section  string
+	}
+	// Each link is counted towards the positions, even the ones to somewhere already linked to.
+	want := []attributes{
+		{to: "/home", linkText: "Home", texts: []string{"Home"}, rel: "home", position: 1, section: "header"},
+		{to: "/a", linkText: "A", texts: []string{"A", "Another A"}, rel: "nofollow ugc", position: 2, section: "nav"},
+		{to: "/b", linkText: "B", texts: []string{"B", "B again"}, position: 4},
+		{to: "/c", position: 6},
+		{to: "/d", linkText: "D", texts: []string{"D"}, rel: "sponsored", position: 8, section: "footer"},
+	}
+
+	result := scrape(t, Options{}, html(page), "/")
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if len(result.links) != len(want) {
+		t.Fatalf("links %q, want %d of them", result.targets(), len(want))
+	}
+	for i, link := range result.links {
+		t.Run(want[i].to, func(t *testing.T) {
+			got := attributes{
+				to:       link.ToU.Path,
+				linkText: link.LinkText,
+				texts:    link.Texts,
+				rel:      link.Rel,
+				position: link.Position,
+				section:  link.Section,
+			}
+			if !reflect.DeepEqual(got, want[i]) {
+				t.Errorf("link %+v, want %+v", got, want[i])
+			}
+		})
+	}
+}
+
+func TestScrapePageMetadata(t *testing.T) {
+	long := strings.Repeat("é", maxMetadataLength+10)
+	tests := []struct {
+		name string
+		page string
+		want linkstorage.PageMetadata
+	}{
+		{
+			name: "everything",
+			page: `<html lang="en-GB"><head><title>The Title</title>
+<meta name="Description" content="What the page is about">
+<meta name="robots" content="noarchive">
+</head><body><h1>Heading</h1><h1>Another heading</h1></body></html>`,
+			want: linkstorage.PageMetadata{Title: "The Title", Description: "What the page is about", Lang: "en-GB", Robots: "noarchive", H1: "Heading"},
+		},
+		{
+			name: "whitespace is collapsed",
+			page: `<html><head><title>
+  The
+  Title </title></head><body><h1> A <em>big</em>   heading </h1></body></html>`,
+			want: linkstorage.PageMetadata{Title: "The Title", H1: "A big heading"},
+		},
+		{
+			name: "the title in the head wins",
+			page: `<html><head><title>Head</title></head><body><svg><title>Picture</title></svg></body></html>`,
+			want: linkstorage.PageMetadata{Title: "Head"},
+		},
+		{
+			name: "a title anywhere will do",
+			page: `<html><body><svg><title>Picture</title></svg></body></html>`,
+			want: linkstorage.PageMetadata{Title: "Picture"},
+		},
+		{
+			name: "the first description wins",
+			page: `<html><head><meta name="description" content=""><meta name="description" content="First"><meta name="description" content="Second"></head></html>`,
+			want: linkstorage.PageMetadata{Description: "First"},
+		},
+		{
+			name: "long text is cut short",
+			page: `<html><head><meta name="description" content="` + long + `"></head></html>`,
+			want: linkstorage.PageMetadata{Description: long[:maxMetadataLength*len("é")]},
+		},
+		{
+			name: "nothing to say",
+			page: `<html><body><a href="/">Home</a></body></html>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := scrape(t, Options{}, html(tt.page), "/")
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			if result.page == nil || result.page.Metadata == nil {
+				t.Fatalf("no metadata was stored for the page")
+			}
+			if *result.page.Metadata != tt.want {
+				t.Errorf("metadata %+v, want %+v", *result.page.Metadata, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapeRobotsDirectives(t *testing.T) {
+	tests := []struct {
+		name         string
+		meta         string
+		xRobotsTag   []string
+		wantRobots   string
+		wantNoindex  bool
+		wantNofollow bool
+	}{
+		{name: "nothing asked"},
+		{name: "meta noindex", meta: `<meta name="robots" content="noindex">`, wantRobots: "noindex", wantNoindex: true},
+		{name: "meta nofollow in capitals", meta: `<meta name="ROBOTS" content="NOFOLLOW">`, wantRobots: "NOFOLLOW", wantNofollow: true},
+		{name: "meta none", meta: `<meta name="robots" content="none">`, wantRobots: "none", wantNoindex: true, wantNofollow: true},
+		{
+			name:       "meta tags are combined",
+			meta:       `<meta name="robots" content="noarchive"><meta name="robots" content="noindex, follow">`,
+			wantRobots: "noarchive, noindex, follow", wantNoindex: true,
+		},
+		{name: "meta tag just for us counts but isn't kept", meta: `<meta name="webgraph" content="nofollow">`, wantNofollow: true},
+		{name: "meta tag for someone else", meta: `<meta name="googlebot" content="noindex, nofollow">`},
+		{name: "header noindex", xRobotsTag: []string{"noindex"}, wantNoindex: true},
+		{name: "header for someone else", xRobotsTag: []string{"googlebot: nofollow"}},
+		{name: "header for us", xRobotsTag: []string{"otherbot: noindex, WebGraph: noindex, nofollow"}, wantNoindex: true, wantNofollow: true},
+		{name: "header with a valued directive", xRobotsTag: []string{"unavailable_after: 25 Jun 2010 15:00:00 PST, nofollow"}, wantNofollow: true},
+		{name: "each header starts with everyone", xRobotsTag: []string{"googlebot: noindex", "nofollow"}, wantNofollow: true},
+		{
+			name:       "header and meta are combined",
+			meta:       `<meta name="robots" content="nofollow">`,
+			xRobotsTag: []string{"noindex"},
+			wantRobots: "nofollow", wantNoindex: true, wantNofollow: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := `<html><head>` + tt.meta + `</head><body><a href="/a">A</a><a href="/b">B</a></body></html>`
+			result := scrape(t, Options{}, func(w http.ResponseWriter, r *http.Request) {
+				for _, value := range tt.xRobotsTag {
+					w.Header().Add("X-Robots-Tag", value)
+				}
+				html(page)(w, r)
+			}, "/")
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			if result.page == nil || result.page.Metadata == nil {
+				t.Fatalf("no metadata was stored for the page")
+			}
+			metadata := result.page.Metadata
+			if metadata.Robots != tt.wantRobots || metadata.Noindex != tt.wantNoindex || metadata.Nofollow != tt.wantNofollow {
+				t.Errorf("robots %q, noindex %v, nofollow %v, want %q, %v, %v",
+					metadata.Robots, metadata.Noindex, metadata.Nofollow, tt.wantRobots, tt.wantNoindex, tt.wantNofollow)
+			}
+			// The links are still returned, they just aren't to be followed.
+			if len(result.links) != 2 {
+				t.Fatalf("links %q, want 2 of them", result.targets())
+			}
+			for _, link := range result.links {
+				if link.PageNofollow != tt.wantNofollow {
+					t.Errorf("link to %s has page nofollow %v, want %v", link.ToU, link.PageNofollow, tt.wantNofollow)
+				}
+			}
+		})
+	}
+}
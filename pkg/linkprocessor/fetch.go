@@ -0,0 +1,177 @@
+package linkprocessor
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/jamesjarvis/massivelyconcurrentsystems/pool"
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// classifyFetchError works out what kind of failure an error from the http client was.
+func classifyFetchError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return linkstorage.FetchErrorDNS
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return linkstorage.FetchErrorTimeout
+	}
+
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalidErr x509.CertificateInvalidError
+	var recordHeaderErr tls.RecordHeaderError
+	if errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &certInvalidErr) ||
+		errors.As(err, &recordHeaderErr) ||
+		strings.Contains(err.Error(), "tls: ") {
+		return linkstorage.FetchErrorTLS
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return linkstorage.FetchErrorConnection
+	}
+
+	return linkstorage.FetchErrorOther
+}
+
+// redirectChain returns an edge for every redirect the http client followed to get this response, in order.
+// Redirects between urls which are the same page, such as http to https when schemes are folded, are left out.
+func redirectChain(response *http.Response) []*linkstorage.Link {
+	var chain []*linkstorage.Link
+	for req := response.Request; req.Response != nil; req = req.Response.Request {
+		from, to := linkutils.Canonicalise(req.Response.Request.URL), linkutils.Canonicalise(req.URL)
+		if linkutils.Hash(from) == linkutils.Hash(to) {
+			continue
+		}
+		chain = append([]*linkstorage.Link{{
+			FromU: from,
+			ToU:   to,
+			Type:  linkstorage.RedirectLinkType(req.Response.StatusCode),
+		}}, chain...)
+	}
+	return chain
+}
+
+// metaRefreshLink returns the target of a <meta http-equiv="refresh"> tag on the page as a link, or nil if there isn't one.
+func metaRefreshLink(document *goquery.Document, page *url.URL, base *url.URL) *linkstorage.Link {
+	var link *linkstorage.Link
+	document.Find("meta[http-equiv]").EachWithBreak(func(index int, element *goquery.Selection) bool {
+		if !strings.EqualFold(strings.TrimSpace(element.AttrOr("http-equiv", "")), "refresh") {
+			return true
+		}
+		// The content looks like "5; url=https://example.com/", where the url may be quoted.
+		_, target, found := strings.Cut(element.AttrOr("content", ""), ";")
+		if !found {
+			return true
+		}
+		target = strings.TrimSpace(target)
+		if len(target) >= 4 && strings.EqualFold(target[:4], "url=") {
+			target = target[4:]
+		}
+		to := resolveLink(base, strings.Trim(strings.TrimSpace(target), `'"`))
+		if to == nil {
+			return true
+		}
+		link = &linkstorage.Link{
+			FromU: page,
+			ToU:   to,
+			Type:  linkstorage.LinkTypeMetaRefresh,
+		}
+		return false
+	})
+	return link
+}
+
+// sameHost returns true if the two urls are on the same host.
+func sameHost(a, b *url.URL) bool {
+	return strings.EqualFold(a.Hostname(), b.Hostname())
+}
+
+// canonicalURL returns the url the page says is its canonical version, or nil if it doesn't name one.
+// A <link rel="canonical"> in the document wins over a Link header, which wins over og:url.
+// Urls in the document are resolved against its base, and urls in the headers against where the response came from.
+func canonicalURL(document *goquery.Document, header http.Header, base *url.URL, responseURL *url.URL) *url.URL {
+	var candidates []*url.URL
+	document.Find("link[rel][href]").Each(func(index int, element *goquery.Selection) {
+		if hasToken(element.AttrOr("rel", ""), "canonical") {
+			candidates = append(candidates, resolveLink(base, element.AttrOr("href", "")))
+		}
+	})
+	for _, target := range linkHeaderTargets(header, "canonical") {
+		candidates = append(candidates, resolveLink(responseURL, target))
+	}
+	document.Find(`meta[property="og:url"]`).Each(func(index int, element *goquery.Selection) {
+		candidates = append(candidates, resolveLink(base, element.AttrOr("content", "")))
+	})
+
+	for _, candidate := range candidates {
+		if candidate != nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// linkHeaderTargets returns the targets of every Link header with the given rel, such as `<https://example.com/>; rel="canonical"`.
+func linkHeaderTargets(header http.Header, rel string) []string {
+	var targets []string
+	for _, value := range header.Values("Link") {
+		for _, part := range strings.Split(value, ",") {
+			target, params, found := strings.Cut(part, ";")
+			target = strings.TrimSpace(target)
+			if !found || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				name, value, _ := strings.Cut(param, "=")
+				if strings.EqualFold(strings.TrimSpace(name), "rel") && hasToken(strings.Trim(strings.TrimSpace(value), `"`), rel) {
+					targets = append(targets, target[1:len(target)-1])
+					break
+				}
+			}
+		}
+	}
+	return targets
+}
+
+// hasToken returns true if the space separated list contains the token, ignoring case.
+func hasToken(list string, token string) bool {
+	for _, t := range strings.Fields(list) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordFetch sends the fetch result off to be saved.
+func (lp *LinkProcessor) recordFetch(result *linkstorage.FetchResult) {
+	lp.fetchBatcher.Put(context.TODO(), pool.NewUnitOfWork[*linkstorage.FetchResult, bool](result, nil))
+}
+
+// countingReader counts the bytes read through it, so we know how big a page was even without a Content-Length.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
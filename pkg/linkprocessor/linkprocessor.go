@@ -1,50 +1,129 @@
 package linkprocessor
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/jamesjarvis/massivelyconcurrentsystems/pool"
 	"github.com/jamesjarvis/web-graph/pkg/linkcache"
 	"github.com/jamesjarvis/web-graph/pkg/linkqueue"
+	"github.com/jamesjarvis/web-graph/pkg/linkrecrawl"
+	"github.com/jamesjarvis/web-graph/pkg/linkrobots"
+	"github.com/jamesjarvis/web-graph/pkg/linkscope"
+	"github.com/jamesjarvis/web-graph/pkg/linkseed"
 	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
 	"github.com/jamesjarvis/web-graph/pkg/linkutils"
 	"github.com/ncruces/go-dns"
+	cache "github.com/patrickmn/go-cache"
 )
 
+const (
+	userAgent = "WebGraph v0.2 https://github.com/jamesjarvis/web-graph - This bot just follows links ¯\\_(ツ)_/¯"
+	// robotsToken is the product token we look for in robots.txt User-agent lines.
+	robotsToken = "WebGraph"
+)
+
+// FetchHistory looks up how the last fetch of a page went.
+type FetchHistory interface {
+	GetFetchResult(pageHash string) (*linkstorage.FetchResult, error)
+}
+
 // LinkProcessor contains all connections necessary for accessing the cache, db and channel for sending urls back to rabbitmq.
 type LinkProcessor struct {
 	httpClient *http.Client
 	cache      *linkcache.LinkCache
-	queue      *linkqueue.LinkQueue
+	queue      linkqueue.Queue
+	robots     *linkrobots.RobotsCache
+	// maxDepth is the furthest from a seed we will crawl, or 0 for no limit, unless the seed says otherwise.
+	maxDepth int
+	// elements is which links we look for as well as the ones in <a>.
+	elements Elements
+	// skipNofollow stops us following links marked rel="nofollow", though they are still stored.
+	skipNofollow bool
+	// scope decides which links we follow from each seed, and how many pages we fetch from each host.
+	scope *linkscope.Scope
+	// headPreflight sends a HEAD request before fetching urls that don't look like pages, to check they are html first.
+	headPreflight bool
+	// maxBodySize is how many bytes of a page we read after decompressing it, anything more is ignored.
+	maxBodySize int64
+	// sitemapHosts remembers how much of each host's sitemaps we have read recently, or is nil if we don't read sitemaps.
+	sitemapHosts *cache.Cache
+	// history is used to make conditional requests and avoid refetching pages that aren't due, and may be nil.
+	history       FetchHistory
+	recrawlPolicy linkrecrawl.Policy
 
-	linkBatcher pool.Dispatcher[pool.UnitOfWork[*linkstorage.Link, bool]]
-	pageBatcher pool.Dispatcher[pool.UnitOfWork[linkstorage.Page, bool]]
+	linkBatcher  pool.Dispatcher[pool.UnitOfWork[*linkstorage.Link, bool]]
+	pageBatcher  pool.Dispatcher[pool.UnitOfWork[linkstorage.Page, bool]]
+	fetchBatcher pool.Dispatcher[pool.UnitOfWork[*linkstorage.FetchResult, bool]]
+}
+
+// Options is how a LinkProcessor is set up.
+type Options struct {
+	PageBatcher  pool.Dispatcher[pool.UnitOfWork[linkstorage.Page, bool]]
+	LinkBatcher  pool.Dispatcher[pool.UnitOfWork[*linkstorage.Link, bool]]
+	FetchBatcher pool.Dispatcher[pool.UnitOfWork[*linkstorage.FetchResult, bool]]
+	Queue        linkqueue.Queue
+	// History is used to make conditional requests and avoid refetching pages that aren't due, and may be nil.
+	History       FetchHistory
+	RecrawlPolicy linkrecrawl.Policy
+	// MaxDepth is the furthest from a seed we will crawl, or 0 for no limit, unless the seed says otherwise.
+	MaxDepth int
+	// Elements is which links we look for as well as the ones in <a>.
+	Elements Elements
+	// SkipNofollow stops us following links marked rel="nofollow", though they are still stored.
+	SkipNofollow bool
+	// Sitemaps reads the sitemaps of each host we crawl, queueing the urls they list.
+	Sitemaps bool
+	// Scope decides which urls we crawl, or nil for linkscope.Default.
+	Scope *linkscope.Scope
+	// HeadPreflight sends a HEAD request before fetching urls that don't look like pages, to check they are html first.
+	HeadPreflight bool
+	// MaxBodySize is how many bytes of a page we read after decompressing it, or 0 for DefaultMaxBodySize.
+	MaxBodySize int64
 }
 
 // NewLinkProcessor is a helper function for creating the LinkProcessor.
-func NewLinkProcessor(
-	pageBatcher pool.Dispatcher[pool.UnitOfWork[linkstorage.Page, bool]],
-	linkBatcher pool.Dispatcher[pool.UnitOfWork[*linkstorage.Link, bool]],
-	queue *linkqueue.LinkQueue,
-) (*LinkProcessor, error) {
+func NewLinkProcessor(opts Options) (*LinkProcessor, error) {
 	client, err := createHTTPClient()
 	if err != nil {
 		return nil, err
 	}
+	var sitemapHosts *cache.Cache
+	if opts.Sitemaps {
+		sitemapHosts = cache.New(sitemapRediscovery, time.Hour)
+	}
+	scope := opts.Scope
+	if scope == nil {
+		scope = linkscope.Default()
+	}
+	maxBodySize := opts.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
 	return &LinkProcessor{
-		cache:       linkcache.NewLinkCache(2 * 24 * time.Hour),
-		queue:       queue,
-		httpClient:  client,
-		linkBatcher: linkBatcher,
-		pageBatcher: pageBatcher,
+		cache:         linkcache.NewLinkCache(2 * 24 * time.Hour),
+		queue:         opts.Queue,
+		httpClient:    client,
+		robots:        linkrobots.NewRobotsCache(client, userAgent, robotsToken, 24*time.Hour),
+		maxDepth:      opts.MaxDepth,
+		elements:      opts.Elements,
+		skipNofollow:  opts.SkipNofollow,
+		scope:         scope,
+		headPreflight: opts.HeadPreflight,
+		maxBodySize:   maxBodySize,
+		sitemapHosts:  sitemapHosts,
+		history:       opts.History,
+		recrawlPolicy: opts.RecrawlPolicy,
+		linkBatcher:   opts.LinkBatcher,
+		pageBatcher:   opts.PageBatcher,
+		fetchBatcher:  opts.FetchBatcher,
 	}, nil
 }
 
@@ -96,121 +175,401 @@ func (lp *LinkProcessor) MarkURLVisited(u *url.URL) {
 	lp.cache.Set(u)
 }
 
-func (lp *LinkProcessor) queueURL(u *url.URL) error {
-	return lp.queue.EnQueue(u)
+// CheckURLAllowed returns true if the host's robots.txt allows us to crawl the url.
+func (lp *LinkProcessor) CheckURLAllowed(u *url.URL) bool {
+	return lp.robots.Allowed(u)
+}
+
+// knownDisallowed returns true if we already have the robots.txt of the url's host, and it asks us not to fetch the url.
+// It never fetches a robots.txt, so finding a link stays cheap, and urls on hosts we haven't checked yet are checked when they are fetched.
+func (lp *LinkProcessor) knownDisallowed(u *url.URL) bool {
+	verdict, cached := lp.robots.Cached(u)
+	return cached && verdict == linkrobots.Disallowed
+}
+
+// putBack returns an item we can't fetch yet to the queue, because we couldn't get its host's robots.txt,
+// which is usually a blip, so the url waits rather than being given up on.
+// Revisits aren't put back, they come round again once their lease on the db runs out.
+func (lp *LinkProcessor) putBack(item *linkqueue.Item) {
+	if item.Recrawl {
+		return
+	}
+	if err := lp.queue.ReQueue(item); err != nil {
+		log.Printf("Could not put %s back into the queue: %v", item.U, err)
+	}
+}
+
+// CrawlDelay returns the delay the host's robots.txt asks us to leave between requests.
+func (lp *LinkProcessor) CrawlDelay(u *url.URL) time.Duration {
+	return lp.robots.CrawlDelay(u)
+}
+
+// queueLink queues the url the link points to, letting the queue know where it was found if it cares.
+func (lp *LinkProcessor) queueLink(link *linkstorage.Link, depth int, seed *linkseed.Seed) error {
+	return lp.queueCandidate(&linkqueue.Candidate{
+		From:     link.FromU,
+		To:       link.ToU,
+		LinkText: link.LinkText,
+		Depth:    depth,
+		Seed:     seed,
+	})
+}
+
+// queueCandidate queues the url, letting the queue know how it was found if it cares.
+func (lp *LinkProcessor) queueCandidate(c *linkqueue.Candidate) error {
+	if q, ok := lp.queue.(linkqueue.CandidateQueue); ok {
+		return q.EnQueueCandidate(c)
+	}
+	return lp.queue.EnQueue(&linkqueue.Item{
+		U:       c.To,
+		From:    c.From,
+		Depth:   c.Depth,
+		Seed:    c.Seed,
+		LastMod: c.LastMod,
+	})
+}
+
+// follow returns false if we have been asked not to follow the link, by the page it is on or by its rel.
+func (lp *LinkProcessor) follow(link *linkstorage.Link) bool {
+	return !link.PageNofollow && !(lp.skipNofollow && link.HasRel("nofollow"))
+}
+
+// withinMaxDepth returns true if we are allowed to crawl pages at this depth from the seed, which may be nil if we don't know it.
+func (lp *LinkProcessor) withinMaxDepth(seed *linkseed.Seed, depth int) bool {
+	maxDepth := lp.maxDepth
+	if seed != nil && seed.MaxDepth > 0 {
+		maxDepth = seed.MaxDepth
+	}
+	return maxDepth <= 0 || depth <= maxDepth
+}
+
+// inScope returns true if the link from one page to another should be followed when crawling from the seed, which may be nil if we don't know it.
+func (lp *LinkProcessor) inScope(seed *linkseed.Seed, from, to *url.URL) bool {
+	if seed == nil {
+		return lp.scope.Follow("", nil, from, to)
+	}
+	return lp.scope.Follow(seed.Scope, seed.U, from, to)
+}
+
+// seedURLs returns the url of the seed, for recording against the pages reached from it.
+func seedURLs(seed *linkseed.Seed) []*url.URL {
+	if seed == nil {
+		return nil
+	}
+	return []*url.URL{seed.U}
+}
+
+// previousFetch returns how the last fetch of the url went, or nil if we don't know.
+func (lp *LinkProcessor) previousFetch(u *url.URL) *linkstorage.FetchResult {
+	if lp.history == nil {
+		return nil
+	}
+	previous, err := lp.history.GetFetchResult(linkutils.Hash(u))
+	if err != nil {
+		log.Printf("Could not look up previous fetch of %s: %v", u, err)
+		return nil
+	}
+	return previous
+}
+
+// scheduleRevisit works out when the page should next be fetched, based on whether its links changed since last time.
+func (lp *LinkProcessor) scheduleRevisit(result, previous *linkstorage.FetchResult) {
+	var previousInterval time.Duration
+	var changed bool
+	if previous != nil {
+		previousInterval = previous.RevisitInterval
+		changed = result.LinksHash != "" && result.LinksHash != previous.LinksHash
+		if result.LinksHash == "" {
+			// We didn't get any links this time, so stick with what we saw last time.
+			result.LinksHash = previous.LinksHash
+		}
+	}
+	result.RevisitInterval = lp.recrawlPolicy.NextInterval(previousInterval, changed)
+	result.NextFetchAt = result.FetchedAt.Add(result.RevisitInterval)
 }
 
 // ScrapeLinksFromURL takes a url to scrape, retrieves the page and returns all links found.
-func (lp *LinkProcessor) ScrapeLinksFromURL(u *url.URL) ([]*linkstorage.Link, error) {
-	if !linkutils.ScrapeDaTing(u) {
+// Any redirects followed on the way are returned as links too, even if the page itself then fails.
+// If previous is given, the server is asked whether the page has changed, and no links are returned if it hasn't.
+func (lp *LinkProcessor) ScrapeLinksFromURL(u *url.URL, previous *linkstorage.FetchResult) ([]*linkstorage.Link, error) {
+	if !lp.scope.Allowed(u) {
 		return nil, fmt.Errorf("We do not care about %s", u)
 	}
+	if !lp.CheckURLAllowed(u) {
+		return nil, fmt.Errorf("robots.txt disallows %s", u)
+	}
 
-	// Create and modify HTTP request before sending
-	request, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
+	// Whatever happens from here on, we want to remember how the fetch went.
+	result := &linkstorage.FetchResult{
+		U:         u,
+		FetchedAt: time.Now(),
 	}
-	request.Header.Set("User-Agent", "WebGraph v0.2 https://github.com/jamesjarvis/web-graph - This bot just follows links ¯\\_(ツ)_/¯")
+	defer func() {
+		lp.scheduleRevisit(result, previous)
+		lp.recordFetch(result)
+	}()
 
-	// Make HTTP request
-	response, err := lp.httpClient.Do(request)
-	if err != nil {
-		return nil, err
+	headers := http.Header{}
+	headers.Set("User-Agent", userAgent)
+	headers.Set("Accept-Encoding", acceptEncoding)
+	if previous != nil {
+		if previous.ETag != "" {
+			headers.Set("If-None-Match", previous.ETag)
+		}
+		if previous.LastModified != "" {
+			headers.Set("If-Modified-Since", previous.LastModified)
+		}
+	}
+
+	// Urls that don't look like pages are asked about first, so we don't download something we won't parse.
+	var response *http.Response
+	if lp.headPreflight && !likelyHTML(u) {
+		response = lp.preflight(u, headers)
+	}
+
+	if response == nil {
+		request, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			result.ErrorClass = linkstorage.FetchErrorOther
+			return nil, err
+		}
+		request.Header = headers
+
+		response, err = lp.httpClient.Do(request)
+		if err != nil {
+			result.ResponseTime = time.Since(result.FetchedAt)
+			result.ErrorClass = classifyFetchError(err)
+			return nil, err
+		}
 	}
+	result.ResponseTime = time.Since(result.FetchedAt)
 	defer response.Body.Close()
 
-	if !linkutils.HappyResponse(response) {
-		return nil, fmt.Errorf("Bad content type from %s", u)
+	// The http client follows redirects for us, so links on the page belong to wherever we ended up.
+	// Relative links are resolved against the url as it is, but stored against its canonical form.
+	finalURL := response.Request.URL
+	pageURL := linkutils.Canonicalise(finalURL)
+	result.FinalURL = pageURL
+	foundLinks := redirectChain(response)
+
+	result.StatusCode = response.StatusCode
+	result.ContentType = response.Header.Get("Content-Type")
+	result.ContentLength = response.ContentLength
+	result.ETag = response.Header.Get("ETag")
+	result.LastModified = response.Header.Get("Last-Modified")
+
+	if result.Unchanged() && previous != nil {
+		// Nothing has changed, so the links we already have are still right.
+		if result.ETag == "" {
+			result.ETag = previous.ETag
+		}
+		if result.LastModified == "" {
+			result.LastModified = previous.LastModified
+		}
+		result.LinksHash = previous.LinksHash
+		// There is no body to tell us what the page is or how big it is, so they are as they were last time, and a leaf stays a leaf.
+		if result.ContentType == "" {
+			result.ContentType = previous.ContentType
+		}
+		result.MIMEType = previous.MIMEType
+		result.ContentLength = previous.ContentLength
+		return foundLinks, nil
+	}
+
+	if response.StatusCode >= 400 {
+		result.ErrorClass = linkstorage.FetchErrorHTTPStatus
+	}
+
+	body := &countingReader{r: response.Body}
+	decompressed, err := decompress(response, body)
+	if err != nil {
+		result.ErrorClass = linkstorage.FetchErrorParse
+		return foundLinks, err
+	}
+	limited := &limitedReader{r: decompressed, n: lp.maxBodySize}
+	buffered := bufio.NewReader(limited)
+
+	// Anything that isn't html is a leaf, we record what it is but don't read the rest of it.
+	result.MIMEType = responseType(response, buffered)
+	if !isHTML(result.MIMEType) {
+		return foundLinks, nil
 	}
 
 	// Create a goquery document from the HTTP response
-	document, err := goquery.NewDocumentFromReader(response.Body)
+	document, err := goquery.NewDocumentFromReader(decodeCharset(buffered, result.ContentType))
+	result.ContentLength = body.n
 	if err != nil {
-		return nil, err
+		result.ErrorClass = linkstorage.FetchErrorParse
+		return foundLinks, err
+	}
+	// We still use what we did read of a page that was too big, it just might not have all of its links.
+	if limited.truncated {
+		log.Printf("%s is bigger than %d bytes, only the start of it was read", u, lp.maxBodySize)
+		result.ErrorClass = linkstorage.FetchErrorTooLarge
 	}
 
-	foundLinks := []*linkstorage.Link{}
+	// Redirects aren't links on the page, so they don't count towards whether the page has changed.
+	redirects := len(foundLinks)
 
-	// Find all links and process them
-	document.Find("a").Each(
-		func(index int, element *goquery.Selection) {
-			// See if the href attribute exists on the element
-			href, exists := element.Attr("href")
-			if !exists {
-				return
-			}
-			href = strings.TrimSpace(href)
+	result.Metadata = pageMetadata(document, response.Header)
 
-			link, err := url.Parse(href)
-			if err != nil {
-				// log.Printf("Failed to parse URL: %v", href)
-				return
-			}
+	// Relative links are resolved against the <base href> if the page has one.
+	base := documentBase(document, finalURL)
 
-			if !link.IsAbs() {
-				link = u.ResolveReference(link)
-			}
+	if refresh := metaRefreshLink(document, pageURL, base); refresh != nil && lp.scope.Allowed(refresh.ToU) {
+		foundLinks = append(foundLinks, refresh)
+	}
 
-			if !linkutils.ScrapeDaTing(link) {
-				return
-			}
+	// If the page says it is a copy of another page on its own host, its links belong to that page instead.
+	// A page can't speak for another host, so a canonical page elsewhere is just recorded, and crawled like any other link.
+	linksFrom := pageURL
+	canonical := canonicalURL(document, response.Header, base, finalURL)
+	if canonical != nil && lp.scope.Allowed(canonical) && linkutils.Hash(canonical) != linkutils.Hash(pageURL) {
+		if sameHost(canonical, pageURL) {
+			result.CanonicalURL = canonical
+			linksFrom = canonical
+		}
+		foundLinks = append(foundLinks, &linkstorage.Link{
+			FromU: pageURL,
+			ToU:   canonical,
+			Type:  linkstorage.LinkTypeCanonical,
+		})
+	}
 
-			tempURL := &linkstorage.Link{
-				FromU:    u,
-				ToU:      link,
-				LinkText: element.Text(),
-			}
-			foundLinks = append(foundLinks, tempURL)
-		},
-	)
+	// Find all links and process them, leaving out anywhere we don't crawl
+	for _, link := range lp.elements.links(document, linksFrom, base) {
+		if lp.scope.Allowed(link.ToU) {
+			foundLinks = append(foundLinks, link)
+		}
+	}
+
+	result.LinksHash = linkrecrawl.LinksHash(foundLinks[redirects:])
+	// Links we didn't get to on a page that was cut short haven't been removed.
+	result.LinksScraped = !limited.truncated
+	for _, link := range foundLinks {
+		link.SeenAt = result.FetchedAt
+	}
+	// The links are still stored if the page asks robots not to follow them, we just don't follow them.
+	for _, link := range foundLinks[redirects:] {
+		link.PageNofollow = result.Metadata.Nofollow
+	}
 
 	return foundLinks, nil
 }
 
-// ProcessURL takes a url and processes it.
-func (lp *LinkProcessor) ProcessURL(u *url.URL) error {
-	// Check if the URL has been visited already.
-	exists, err := lp.CheckURLExists(u)
-	if err != nil {
-		log.Printf("Could not check if URL has been visited: %v\n", err)
-		return err
+// ProcessURL takes a url from the queue and processes it.
+func (lp *LinkProcessor) ProcessURL(item *linkqueue.Item) error {
+	u := item.U
+	if !lp.withinMaxDepth(item.Seed, item.Depth) {
+		return nil
+	}
+
+	// Sitemaps are read for the urls they list, rather than crawled as pages.
+	if item.Sitemap {
+		lp.processSitemap(item)
+		return nil
+	}
+
+	// The queue can outlive the scope file, so urls queued under different rules are dropped here.
+	if !lp.scope.Allowed(u) {
+		return nil
+	}
+
+	lp.discoverSitemaps(item)
+
+	// Check if the URL has been visited already, unless we are deliberately revisiting it or a sitemap says it has changed.
+	if !item.Recrawl && item.LastMod.IsZero() {
+		exists, err := lp.CheckURLExists(u)
+		if err != nil {
+			log.Printf("Could not check if URL has been visited: %v\n", err)
+			return err
+		}
+		if exists {
+			return nil
+		}
 	}
-	if exists {
+
+	// If we have fetched this before, the recrawler will bring it back round once it is due.
+	previous := lp.previousFetch(u)
+	if previous != nil && !item.Recrawl && time.Now().Before(previous.NextFetchAt) && !item.LastMod.After(previous.FetchedAt) {
+		lp.MarkURLVisited(u)
+		return nil
+	}
+
+	// Robots.txt is checked when we are about to fetch the url rather than when it is found,
+	// so we only fetch the robots.txt of hosts we actually crawl, and at the host's own pace.
+	switch lp.robots.Check(u) {
+	case linkrobots.Disallowed:
+		lp.MarkURLVisited(u)
+		return nil
+	case linkrobots.Unreachable:
+		lp.putBack(item)
+		return nil
+	}
+
+	// Revisits are of pages we already have, so they don't count towards the host's limit.
+	if !item.Recrawl && !lp.scope.ClaimPage(u) {
 		return nil
 	}
 
 	// Mark as visited and save page to DB
 	lp.MarkURLVisited(u)
-	lp.pageBatcher.Put(context.TODO(), pool.NewUnitOfWork[linkstorage.Page, bool](linkstorage.Page{U: u}, nil))
+	lp.pageBatcher.Put(context.TODO(), pool.NewUnitOfWork[linkstorage.Page, bool](linkstorage.Page{
+		U:              u,
+		Depth:          item.Depth,
+		DiscoveredFrom: item.From,
+		Seeds:          seedURLs(item.Seed),
+	}, nil))
 
 	// Retrieve html, parse links
-	var links []*linkstorage.Link
-	links, err = lp.ScrapeLinksFromURL(u)
-	if err != nil {
-		return err
-	}
+	links, scrapeErr := lp.ScrapeLinksFromURL(u, previous)
 
+	linkDepth := item.Depth + 1
 	for _, link := range links {
+		if link.IsHTTPRedirect() || (link.IsCanonical() && sameHost(link.FromU, link.ToU)) {
+			// We have already fetched wherever this redirects to, or a copy of the canonical page, so it just needs recording.
+			if !lp.cache.Get(link.ToU) {
+				lp.MarkURLVisited(link.ToU)
+				lp.pageBatcher.Put(context.TODO(), pool.NewUnitOfWork[linkstorage.Page, bool](linkstorage.Page{
+					U:              link.ToU,
+					Depth:          item.Depth,
+					DiscoveredFrom: link.FromU,
+					Seeds:          seedURLs(item.Seed),
+				}, nil))
+			}
+			lp.linkBatcher.Put(context.TODO(), pool.NewUnitOfWork[*linkstorage.Link, bool](link, nil))
+			continue
+		}
+
 		exists, err := lp.CheckURLExists(link.ToU)
 		if err != nil {
 			log.Printf("Could not check if URL has been visited: %v\n", err)
 			return err
 		}
 		if !exists {
-			// this appends the link URL's to be scraped
-			err = lp.queueURL(link.ToU)
-			if err != nil {
-				log.Printf("Could not queue url: %v", err)
+			// this appends the link URL's to be scraped, unless it is too deep, outside the seed's scope,
+			// its host has had all the pages it is allowed, we've been asked not to follow it or robots.txt tells us to keep out
+			if lp.withinMaxDepth(item.Seed, linkDepth) && lp.inScope(item.Seed, link.FromU, link.ToU) && !lp.scope.HostFull(link.ToU) &&
+				lp.follow(link) && !lp.knownDisallowed(link.ToU) {
+				err = lp.queueLink(link, linkDepth, item.Seed)
+				if err != nil {
+					log.Printf("Could not queue url: %v", err)
+				}
 			}
-
-			// This saves each link page to db and the link
-			lp.pageBatcher.Put(context.TODO(), pool.NewUnitOfWork[linkstorage.Page, bool](linkstorage.Page{U: link.ToU}, nil))
+		}
+		// This saves each link page to db and the link, even if we are not allowed to crawl it.
+		// Pages we have already seen are saved again if we know the seed, so they remember every seed that reaches them.
+		if !exists || item.Seed != nil {
+			lp.pageBatcher.Put(context.TODO(), pool.NewUnitOfWork[linkstorage.Page, bool](linkstorage.Page{
+				U:              link.ToU,
+				Depth:          linkDepth,
+				DiscoveredFrom: link.FromU,
+				Seeds:          seedURLs(item.Seed),
+			}, nil))
 		}
 
 		lp.linkBatcher.Put(context.TODO(), pool.NewUnitOfWork[*linkstorage.Link, bool](link, nil))
 	}
 
-	links = nil
-	return nil
+	return scrapeErr
 }
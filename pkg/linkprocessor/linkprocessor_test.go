@@ -0,0 +1,442 @@
+package linkprocessor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamesjarvis/massivelyconcurrentsystems/pool"
+	"github.com/jamesjarvis/web-graph/pkg/linkqueue"
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// newTestProcessor returns a processor which stores everything in memory, and queues into a fresh frontier unless opts has a queue.
+// Calling flush writes out everything still being batched, after which nothing else can be processed.
+func newTestProcessor(t *testing.T, opts Options) (lp *LinkProcessor, storage *linkstorage.MemoryStorage, flush func()) {
+	t.Helper()
+	storage = linkstorage.NewMemoryStorage()
+	config := pool.NewConfig(
+		pool.SetBufferSize(100),
+		pool.SetBatchSize(100),
+		pool.SetNumConsumers(1),
+		pool.SetBatchInterval(10*time.Millisecond),
+	)
+	pageBatcher, err := linkstorage.NewPageBatcher(storage, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkBatcher, err := linkstorage.NewLinkBatcher(storage, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchBatcher, err := linkstorage.NewFetchBatcher(storage, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batcher := range []interface{ Start() error }{pageBatcher, linkBatcher, fetchBatcher} {
+		if err = batcher.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var once sync.Once
+	flush = func() {
+		once.Do(func() {
+			pageBatcher.Close()
+			linkBatcher.Close()
+			fetchBatcher.Close()
+		})
+	}
+	t.Cleanup(flush)
+
+	if opts.Queue == nil {
+		queue, err := linkqueue.NewHostFrontier(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { queue.Close() })
+		opts.Queue = queue
+	}
+	opts.PageBatcher = pageBatcher
+	opts.LinkBatcher = linkBatcher
+	opts.FetchBatcher = fetchBatcher
+	opts.History = storage
+	lp, err = NewLinkProcessor(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lp, storage, flush
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// scraped is what came of scraping a page from a test server.
+type scraped struct {
+	links []*linkstorage.Link
+	err   error
+	// fetch is how the fetch was stored, and page is the page it was stored against.
+	fetch *linkstorage.FetchResult
+	page  *linkstorage.Page
+	// requests are the method and path of every request the server got, other than for robots.txt.
+	requests []string
+	server   string
+}
+
+// scrape serves the handler, with no robots.txt, and scrapes the path from it with a processor set up with opts.
+func scrape(t *testing.T, opts Options, handler http.HandlerFunc, path string) *scraped {
+	t.Helper()
+	result := &scraped{}
+	lock := &sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		lock.Lock()
+		result.requests = append(result.requests, r.Method+" "+r.URL.Path)
+		lock.Unlock()
+		handler(w, r)
+	}))
+	defer server.Close()
+	result.server = server.URL
+
+	lp, storage, flush := newTestProcessor(t, opts)
+	u := mustParse(t, server.URL+path)
+	result.links, result.err = lp.ScrapeLinksFromURL(u, nil)
+	flush()
+
+	var err error
+	result.fetch, err = storage.GetFetchResult(linkutils.Hash(u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.fetch != nil {
+		result.page, err = storage.GetPage(linkutils.Hash(result.fetch.FetchedPage()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return result
+}
+
+// targets returns the type and url of each link, with the server left off urls on the test server, such as "link /a".
+func (s *scraped) targets() []string {
+	var targets []string
+	for _, link := range s.links {
+		targets = append(targets, link.Type+" "+strings.TrimPrefix(link.ToU.String(), s.server))
+	}
+	return targets
+}
+
+// html returns a handler which serves the page as html.
+func html(page string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	}
+}
+
+func TestScrapeLinksFromURLNotModified(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		previous linkstorage.FetchResult
+		want     linkstorage.FetchResult
+	}{
+		{
+			name: "leaf stays a leaf",
+			previous: linkstorage.FetchResult{
+				ContentType: "application/pdf", MIMEType: "application/pdf", ContentLength: 1234,
+				ETag: `"v1"`, LinksHash: "none",
+			},
+			want: linkstorage.FetchResult{
+				StatusCode: http.StatusNotModified, ContentType: "application/pdf", MIMEType: "application/pdf", ContentLength: 1234,
+				ETag: `"v1"`, LinksHash: "none",
+			},
+		},
+		{
+			name:    "new validators are kept",
+			headers: map[string]string{"ETag": `"v2"`, "Last-Modified": "Wed, 21 Oct 2015 07:28:00 GMT"},
+			previous: linkstorage.FetchResult{
+				ContentType: "text/html; charset=utf-8", MIMEType: "text/html", ContentLength: 5000,
+				ETag: `"v1"`, LastModified: "Tue, 20 Oct 2015 07:28:00 GMT", LinksHash: "links",
+			},
+			want: linkstorage.FetchResult{
+				StatusCode: http.StatusNotModified, ContentType: "text/html; charset=utf-8", MIMEType: "text/html", ContentLength: 5000,
+				ETag: `"v2"`, LastModified: "Wed, 21 Oct 2015 07:28:00 GMT", LinksHash: "links",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					http.NotFound(w, r)
+					return
+				}
+				if r.Header.Get("If-None-Match") != tt.previous.ETag {
+					t.Errorf("If-None-Match %q, want %q", r.Header.Get("If-None-Match"), tt.previous.ETag)
+				}
+				for key, value := range tt.headers {
+					w.Header().Set(key, value)
+				}
+				w.WriteHeader(http.StatusNotModified)
+			}))
+			defer server.Close()
+
+			lp, storage, flush := newTestProcessor(t, Options{})
+			u := mustParse(t, server.URL+"/page")
+			links, err := lp.ScrapeLinksFromURL(u, &tt.previous)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(links) != 0 {
+				t.Errorf("found %d links on an unchanged page", len(links))
+			}
+			flush()
+
+			got, err := storage.GetFetchResult(linkutils.Hash(u))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.StatusCode != tt.want.StatusCode || got.ContentType != tt.want.ContentType || got.MIMEType != tt.want.MIMEType ||
+				got.ContentLength != tt.want.ContentLength || got.ETag != tt.want.ETag || got.LastModified != tt.want.LastModified ||
+				got.LinksHash != tt.want.LinksHash {
+				t.Errorf("stored %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// queued takes everything off the queue, returning the paths of the urls in the order they came out.
+func queued(t *testing.T, q linkqueue.Queue) []string {
+	t.Helper()
+	var paths []string
+	for q.ContainsItems() {
+		found, failed := q.DeQueue()
+		select {
+		case item := <-found:
+			paths = append(paths, item.U.Path)
+		case err := <-failed:
+			t.Fatalf("dequeue failed: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("nothing was dequeued from a queue of %d", q.Length())
+		}
+	}
+	return paths
+}
+
+// storedPaths returns the paths of every page stored for the host, in order.
+func storedPaths(t *testing.T, storage *linkstorage.MemoryStorage, host string) []string {
+	t.Helper()
+	hashes, err := storage.GetPageHashesFromHost(host, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, hash := range hashes {
+		page, err := storage.GetPage(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, page.U.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestProcessURL(t *testing.T) {
+	pages := map[string]string{
+		"/":          `<html><body><a href="/a">A</a> <a href="/private/b">B</a></body></html>`,
+		"/a":         `<html><body>Nothing to see here</body></html>`,
+		"/private/b": `<html><body>Secret</body></html>`,
+	}
+	tests := []struct {
+		name         string
+		robotsStatus int
+		robotsTxt    string
+		process      string
+		wantFetched  []string
+		wantStored   []string
+		wantLinks    int
+		wantQueued   []string
+		wantVisited  bool
+	}{
+		{
+			name:         "page is stored and its links queued",
+			robotsStatus: http.StatusNotFound,
+			process:      "/",
+			wantFetched:  []string{"/"},
+			wantStored:   []string{"/", "/a", "/private/b"},
+			wantLinks:    2,
+			wantQueued:   []string{"/a", "/private/b"},
+			wantVisited:  true,
+		},
+		{
+			name:         "links robots.txt disallows are stored but not queued",
+			robotsStatus: http.StatusOK,
+			robotsTxt:    "User-agent: *\nDisallow: /private",
+			process:      "/",
+			wantFetched:  []string{"/"},
+			wantStored:   []string{"/", "/a", "/private/b"},
+			wantLinks:    2,
+			wantQueued:   []string{"/a"},
+			wantVisited:  true,
+		},
+		{
+			name:         "disallowed url is skipped for good",
+			robotsStatus: http.StatusOK,
+			robotsTxt:    "User-agent: *\nDisallow: /private",
+			process:      "/private/b",
+			wantVisited:  true,
+		},
+		{
+			name:         "url goes back in the queue when robots.txt is unreachable",
+			robotsStatus: http.StatusServiceUnavailable,
+			process:      "/",
+			wantQueued:   []string{"/"},
+			wantVisited:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetched []string
+			lock := &sync.Mutex{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					w.WriteHeader(tt.robotsStatus)
+					fmt.Fprint(w, tt.robotsTxt)
+					return
+				}
+				lock.Lock()
+				fetched = append(fetched, r.URL.Path)
+				lock.Unlock()
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				fmt.Fprint(w, pages[r.URL.Path])
+			}))
+			defer server.Close()
+
+			lp, storage, flush := newTestProcessor(t, Options{})
+			u := mustParse(t, server.URL+tt.process)
+			if err := lp.ProcessURL(&linkqueue.Item{U: u}); err != nil {
+				t.Fatal(err)
+			}
+			flush()
+
+			lock.Lock()
+			defer lock.Unlock()
+			if !reflect.DeepEqual(fetched, tt.wantFetched) {
+				t.Errorf("fetched %v, want %v", fetched, tt.wantFetched)
+			}
+			if got := storedPaths(t, storage, u.Hostname()); !reflect.DeepEqual(got, tt.wantStored) {
+				t.Errorf("stored pages %v, want %v", got, tt.wantStored)
+			}
+			if got, err := storage.CountLinks(); err != nil || got != tt.wantLinks {
+				t.Errorf("stored %d links, want %d: %v", got, tt.wantLinks, err)
+			}
+			if got := queued(t, lp.queue); !reflect.DeepEqual(got, tt.wantQueued) {
+				t.Errorf("queued %v, want %v", got, tt.wantQueued)
+			}
+			if got, _ := lp.CheckURLExists(u); got != tt.wantVisited {
+				t.Errorf("visited %v, want %v", got, tt.wantVisited)
+			}
+		})
+	}
+}
+
+func TestProcessURLSkipNofollow(t *testing.T) {
+	page := `<html><body><a href="/a" rel="nofollow">A</a> <a href="/b" rel="ugc">B</a></body></html>`
+	tests := []struct {
+		name         string
+		skipNofollow bool
+		wantQueued   []string
+	}{
+		{name: "nofollow links are followed by default", wantQueued: []string{"/a", "/b"}},
+		{name: "nofollow links are skipped when asked", skipNofollow: true, wantQueued: []string{"/b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					http.NotFound(w, r)
+					return
+				}
+				html(page)(w, r)
+			}))
+			defer server.Close()
+
+			lp, storage, flush := newTestProcessor(t, Options{SkipNofollow: tt.skipNofollow})
+			u := mustParse(t, server.URL+"/")
+			if err := lp.ProcessURL(&linkqueue.Item{U: u}); err != nil {
+				t.Fatal(err)
+			}
+			flush()
+
+			// Links we don't follow are still stored.
+			if got, err := storage.CountLinks(); err != nil || got != 2 {
+				t.Errorf("stored %d links, want 2: %v", got, err)
+			}
+			if got := queued(t, lp.queue); !reflect.DeepEqual(got, tt.wantQueued) {
+				t.Errorf("queued %v, want %v", got, tt.wantQueued)
+			}
+		})
+	}
+}
+
+func TestProcessURLPageNofollow(t *testing.T) {
+	tests := []struct {
+		name       string
+		meta       string
+		xRobotsTag string
+		wantQueued []string
+	}{
+		{name: "links are followed", wantQueued: []string{"/a", "/b"}},
+		{name: "meta nofollow", meta: `<meta name="robots" content="nofollow">`},
+		{name: "header nofollow", xRobotsTag: "nofollow"},
+		{name: "noindex pages are still followed", meta: `<meta name="robots" content="noindex">`, wantQueued: []string{"/a", "/b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := `<html><head>` + tt.meta + `</head><body><a href="/a">A</a> <a href="/b">B</a></body></html>`
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					http.NotFound(w, r)
+					return
+				}
+				if tt.xRobotsTag != "" {
+					w.Header().Set("X-Robots-Tag", tt.xRobotsTag)
+				}
+				html(page)(w, r)
+			}))
+			defer server.Close()
+
+			lp, storage, flush := newTestProcessor(t, Options{})
+			if err := lp.ProcessURL(&linkqueue.Item{U: mustParse(t, server.URL+"/")}); err != nil {
+				t.Fatal(err)
+			}
+			flush()
+
+			// Links we don't follow are still stored.
+			if got, err := storage.CountLinks(); err != nil || got != 2 {
+				t.Errorf("stored %d links, want 2: %v", got, err)
+			}
+			if got := queued(t, lp.queue); !reflect.DeepEqual(got, tt.wantQueued) {
+				t.Errorf("queued %v, want %v", got, tt.wantQueued)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package linkprocessor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/jamesjarvis/massivelyconcurrentsystems/pool"
+	"github.com/jamesjarvis/web-graph/pkg/linkqueue"
+	"github.com/jamesjarvis/web-graph/pkg/linkseed"
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+)
+
+// This is how a crawl is started, from seeds read at startup or sent to the running processor.
+
+// maxSeedsSize is the most bytes of seeds we accept in one request.
+const maxSeedsSize = 10 * 1024 * 1024
+
+// AddSeed queues the seed and records it as a page, so the crawl starts from it.
+// A seed we have visited recently is only recorded, the same as any other url.
+func (lp *LinkProcessor) AddSeed(seed *linkseed.Seed) error {
+	if !lp.scope.Allowed(seed.U) {
+		return fmt.Errorf("seed %s is outside the crawl's scope", seed.U)
+	}
+	lp.pageBatcher.Put(context.TODO(), pool.NewUnitOfWork[linkstorage.Page, bool](linkstorage.Page{
+		U:     seed.U,
+		Seeds: []*url.URL{seed.U},
+	}, nil))
+	return lp.queueCandidate(&linkqueue.Candidate{
+		To:   seed.U,
+		Seed: seed,
+	})
+}
+
+// AddSeeds queues every seed in the crawl's scope, returning how many were queued before anything went wrong.
+// Seeds outside the scope are logged and skipped.
+func (lp *LinkProcessor) AddSeeds(seeds []*linkseed.Seed) (int, error) {
+	queued := 0
+	for _, seed := range seeds {
+		if !lp.scope.Allowed(seed.U) {
+			log.Printf("Skipping seed %s, it is outside the crawl's scope", seed.U)
+			continue
+		}
+		err := lp.AddSeed(seed)
+		if err != nil {
+			return queued, err
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+// SeedsHandler returns a handler which queues the seeds POSTed to it, in any format linkseed.Parse understands.
+// It responds with how many seeds were queued, like {"queued": 3}.
+func (lp *LinkProcessor) SeedsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "POST some seeds", http.StatusMethodNotAllowed)
+			return
+		}
+		seeds, err := linkseed.Parse(http.MaxBytesReader(w, r.Body, maxSeedsSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		queued, err := lp.AddSeeds(seeds)
+		if err != nil {
+			log.Printf("Could not queue seeds: %v", err)
+			http.Error(w, "Could not queue seeds", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Queued %d seeds", queued)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"queued": queued})
+	})
+}
@@ -0,0 +1,250 @@
+package linkprocessor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jamesjarvis/massivelyconcurrentsystems/pool"
+	"github.com/jamesjarvis/web-graph/pkg/linkqueue"
+	"github.com/jamesjarvis/web-graph/pkg/linkrobots"
+	"github.com/jamesjarvis/web-graph/pkg/linkseed"
+	"github.com/jamesjarvis/web-graph/pkg/linksitemap"
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// This is how the urls listed in a host's sitemaps are found and queued, the first time we crawl the host each day.
+// Each sitemap is queued like a page, so the scheduler spaces out fetching them along with the rest of the host.
+
+const (
+	// maxSitemapsPerHost is how many sitemaps we read for each host, including those listed by sitemap indexes.
+	maxSitemapsPerHost = 50
+	// maxSitemapURLsPerHost is how many urls we take from the sitemaps of each host.
+	maxSitemapURLsPerHost = 50000
+	// sitemapRediscovery is how long before we read a host's sitemaps again.
+	sitemapRediscovery = 24 * time.Hour
+)
+
+// sitemapBudget is how much of a host's sitemaps we have queued and read, since we started reading them.
+type sitemapBudget struct {
+	// queued is every sitemap of the host we have queued, so each is only read once.
+	queued map[string]struct{}
+	urls   int
+	lock   *sync.Mutex
+}
+
+func newSitemapBudget() *sitemapBudget {
+	return &sitemapBudget{
+		queued: make(map[string]struct{}),
+		lock:   &sync.Mutex{},
+	}
+}
+
+// claimSitemap returns true if the sitemap hasn't been queued yet, and the host has room for another.
+func (b *sitemapBudget) claimSitemap(u *url.URL) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.queued[u.String()]; ok || len(b.queued) >= maxSitemapsPerHost {
+		return false
+	}
+	b.queued[u.String()] = struct{}{}
+	return true
+}
+
+// remainingURLs returns how many more urls we will take from the host's sitemaps.
+func (b *sitemapBudget) remainingURLs() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return maxSitemapURLsPerHost - b.urls
+}
+
+// addURLs counts urls taken from one of the host's sitemaps.
+func (b *sitemapBudget) addURLs(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.urls += n
+}
+
+// sitemapRoot is the key the budget of the url's host is kept under.
+func sitemapRoot(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}).String()
+}
+
+// budgetFor returns the budget of the url's host, starting a new one if it doesn't have one,
+// such as when a sitemap queued before a restart comes round.
+func (lp *LinkProcessor) budgetFor(u *url.URL) *sitemapBudget {
+	key := sitemapRoot(u)
+	for {
+		if budget, ok := lp.sitemapHosts.Get(key); ok {
+			return budget.(*sitemapBudget)
+		}
+		budget := newSitemapBudget()
+		if lp.sitemapHosts.Add(key, budget, sitemapRediscovery) == nil {
+			return budget
+		}
+	}
+}
+
+// discoverSitemaps queues the sitemaps of the item's host, if we haven't already today.
+// Sitemaps come from the Sitemap lines of robots.txt, and /sitemap.xml.
+func (lp *LinkProcessor) discoverSitemaps(item *linkqueue.Item) {
+	if lp.sitemapHosts == nil || !lp.withinMaxDepth(item.Seed, item.Depth+1) {
+		return
+	}
+	root := &url.URL{Scheme: item.U.Scheme, Host: item.U.Host, Path: "/"}
+	// Add fails if the host is already there, so each host's sitemaps are only queued once.
+	budget := newSitemapBudget()
+	if err := lp.sitemapHosts.Add(sitemapRoot(root), budget, sitemapRediscovery); err != nil {
+		return
+	}
+
+	var sitemaps []*url.URL
+	for _, listed := range lp.robots.Sitemaps(root) {
+		if u, err := url.Parse(listed); err == nil {
+			sitemaps = append(sitemaps, root.ResolveReference(u))
+		}
+	}
+	sitemaps = append(sitemaps, root.ResolveReference(&url.URL{Path: "/sitemap.xml"}))
+
+	for _, sitemap := range sitemaps {
+		err := lp.queueSitemap(budget, sitemap, item.U, item.Depth+1, item.Seed)
+		if err != nil {
+			log.Printf("Could not queue sitemap: %v", err)
+		}
+	}
+}
+
+// queueSitemap queues the sitemap to be read, unless it has already been or the host has no room for more.
+func (lp *LinkProcessor) queueSitemap(budget *sitemapBudget, u *url.URL, from *url.URL, depth int, seed *linkseed.Seed) error {
+	if !budget.claimSitemap(u) {
+		return nil
+	}
+	return lp.queue.ReQueue(&linkqueue.Item{
+		U:       u,
+		From:    from,
+		Depth:   depth,
+		Seed:    seed,
+		Sitemap: true,
+	})
+}
+
+// processSitemap reads a sitemap taken from the queue, queueing the sitemaps and urls it lists and recording each one as a sitemap edge.
+func (lp *LinkProcessor) processSitemap(item *linkqueue.Item) {
+	if lp.sitemapHosts == nil {
+		return
+	}
+	budget := lp.budgetFor(item.U)
+	limit := budget.remainingURLs()
+	if limit <= 0 {
+		return
+	}
+	if lp.robots.Check(item.U) == linkrobots.Unreachable {
+		lp.putBack(item)
+		return
+	}
+	sitemap, err := lp.fetchSitemap(item.U, limit)
+	if err != nil {
+		return
+	}
+
+	// The sitemap itself is a page in the graph, so its edges have somewhere to come from.
+	from := linkutils.Canonicalise(item.U)
+	lp.pageBatcher.Put(context.TODO(), pool.NewUnitOfWork[linkstorage.Page, bool](linkstorage.Page{
+		U:              from,
+		Depth:          item.Depth,
+		DiscoveredFrom: item.From,
+		Seeds:          seedURLs(item.Seed),
+	}, nil))
+
+	for _, child := range sitemap.Sitemaps {
+		lp.linkBatcher.Put(context.TODO(), pool.NewUnitOfWork[*linkstorage.Link, bool](&linkstorage.Link{
+			FromU: from,
+			ToU:   linkutils.Canonicalise(child.U),
+			Type:  linkstorage.LinkTypeSitemap,
+		}, nil))
+		err = lp.queueSitemap(budget, child.U, from, item.Depth, item.Seed)
+		if err != nil {
+			log.Printf("Could not queue sitemap: %v", err)
+		}
+	}
+
+	urls := 0
+	for _, entry := range sitemap.URLs {
+		if !lp.scope.Allowed(entry.U) {
+			continue
+		}
+		urls++
+		err = lp.addSitemapEntry(from, entry, item.Depth, item.Seed)
+		if err != nil {
+			log.Printf("Could not queue sitemap url: %v", err)
+		}
+	}
+	budget.addURLs(urls)
+}
+
+// fetchSitemap retrieves and parses a sitemap, reading at most limit urls.
+func (lp *LinkProcessor) fetchSitemap(u *url.URL, limit int) (*linksitemap.Sitemap, error) {
+	if !lp.CheckURLAllowed(u) {
+		return nil, fmt.Errorf("robots.txt disallows %s", u)
+	}
+	request, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", userAgent)
+
+	response, err := lp.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", u, response.StatusCode)
+	}
+	return linksitemap.Parse(response.Body, response.Request.URL, limit)
+}
+
+// addSitemapEntry records the url as listed in the sitemap, and queues it if it is new or has changed since we last fetched it.
+func (lp *LinkProcessor) addSitemapEntry(sitemap *url.URL, entry linksitemap.Entry, depth int, seed *linkseed.Seed) error {
+	link := &linkstorage.Link{
+		FromU:  sitemap,
+		ToU:    linkutils.Canonicalise(entry.U),
+		Type:   linkstorage.LinkTypeSitemap,
+		SeenAt: time.Now(),
+	}
+
+	exists, err := lp.CheckURLExists(link.ToU)
+	if err != nil {
+		return err
+	}
+	// ProcessURL works out whether a page we already have has really changed.
+	if (!exists || !entry.LastMod.IsZero()) && lp.inScope(seed, sitemap, link.ToU) && !lp.scope.HostFull(link.ToU) && !lp.knownDisallowed(link.ToU) {
+		err = lp.queueCandidate(&linkqueue.Candidate{
+			From:        link.FromU,
+			To:          link.ToU,
+			Depth:       depth,
+			Seed:        seed,
+			FromSitemap: true,
+			LastMod:     entry.LastMod,
+			Priority:    entry.Priority,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !exists || seed != nil {
+		lp.pageBatcher.Put(context.TODO(), pool.NewUnitOfWork[linkstorage.Page, bool](linkstorage.Page{
+			U:              link.ToU,
+			Depth:          depth,
+			DiscoveredFrom: link.FromU,
+			Seeds:          seedURLs(seed),
+		}, nil))
+	}
+	lp.linkBatcher.Put(context.TODO(), pool.NewUnitOfWork[*linkstorage.Link, bool](link, nil))
+	return nil
+}
@@ -0,0 +1,177 @@
+package linkqueue
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/beeker1121/goque"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// This is a crawl frontier split into one persistent sub-queue per host bucket,
+// so that a single enormous host cannot crowd everybody else out of the queue.
+
+const (
+	// frontierBuckets is the number of sub-queues hosts are hashed into.
+	// Changing this strands anything already queued in the higher buckets, so don't.
+	frontierBuckets = 1024
+	// frontierDir is where the frontier lives within the queue data dir.
+	frontierDir = "frontier"
+	// emptyBackoff is how long DeQueue waits before looking again when every bucket is empty.
+	emptyBackoff = 100 * time.Millisecond
+)
+
+// HostFrontier is a persistent queue which hands out urls round-robin across host buckets.
+type HostFrontier struct {
+	queue *goque.PrefixQueue
+	cache *lru.Cache
+	// next is the bucket we will try to dequeue from first.
+	next int
+	// closed is set once the frontier is closed, as goque reports a closed prefix queue as empty.
+	closed bool
+	lock   *sync.Mutex
+}
+
+// NewHostFrontier opens the frontier within the queue data dir.
+// If the data dir still contains an old single FIFO LinkQueue, its contents are moved over to the frontier.
+func NewHostFrontier(dataDir string) (*HostFrontier, error) {
+	cache, err := lru.New(10000)
+	if err != nil {
+		return nil, err
+	}
+	queue, err := goque.OpenPrefixQueue(filepath.Join(dataDir, frontierDir))
+	if err != nil {
+		return nil, err
+	}
+	f := &HostFrontier{
+		queue: queue,
+		cache: cache,
+		lock:  &sync.Mutex{},
+	}
+
+	err = f.migrateLinkQueue(dataDir)
+	if err != nil {
+		queue.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// migrateLinkQueue drains a LinkQueue left in the data dir into the frontier.
+func (f *HostFrontier) migrateLinkQueue(dataDir string) error {
+	if _, err := os.Stat(filepath.Join(dataDir, "GOQUE")); os.IsNotExist(err) {
+		return nil
+	}
+	old, err := goque.OpenQueue(dataDir)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	if old.Length() > 0 {
+		log.Printf("Moving %d urls from the old link queue into the frontier...", old.Length())
+	}
+	for old.Length() > 0 {
+		item, err := old.Dequeue()
+		if err != nil {
+			return err
+		}
+		link, err := decodeItem(item.ToString())
+		if err != nil {
+			continue
+		}
+		err = f.EnQueue(link)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bucketPrefix returns the sub-queue the host of the url belongs to.
+func bucketPrefix(u *url.URL) []byte {
+	h := fnv.New32a()
+	h.Write([]byte(u.Hostname()))
+	return bucketKey(int(h.Sum32() % frontierBuckets))
+}
+
+func bucketKey(bucket int) []byte {
+	return []byte(fmt.Sprintf("%04x", bucket))
+}
+
+// Close closes connection to the frontier.
+func (f *HostFrontier) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	return f.queue.Close()
+}
+
+// dequeue takes the next url from the first non-empty bucket after the last one we took from.
+// Empty buckets are skipped, but any other error is returned, as something is wrong with the frontier itself.
+func (f *HostFrontier) dequeue() (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return "", goque.ErrDBClosed
+	}
+	if f.queue.Length() == 0 {
+		return "", goque.ErrEmpty
+	}
+	for i := 0; i < frontierBuckets; i++ {
+		bucket := (f.next + i) % frontierBuckets
+		item, err := f.queue.Dequeue(bucketKey(bucket))
+		// A bucket which has been emptied is out of bounds rather than empty.
+		if err == goque.ErrEmpty || err == goque.ErrOutOfBounds {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		f.next = bucket + 1
+		return item.ToString(), nil
+	}
+	return "", goque.ErrEmpty
+}
+
+// DeQueue is a blocking operation and returns a channel that receives an item from the frontier.
+func (f *HostFrontier) DeQueue() (<-chan *Item, <-chan error) {
+	return dequeueLoop(f.dequeue)
+}
+
+// EnQueue appends an item to its host's bucket.
+func (f *HostFrontier) EnQueue(item *Item) error {
+	ok, _ := f.cache.ContainsOrAdd(linkutils.Hash(item.U), struct{}{})
+	if !ok {
+		return f.ReQueue(item)
+	}
+	return nil
+}
+
+// ReQueue appends an item to the back of its host's bucket, without checking whether it has been queued already.
+func (f *HostFrontier) ReQueue(item *Item) error {
+	encoded, err := encodeItem(item)
+	if err != nil {
+		return err
+	}
+	_, err = f.queue.EnqueueString(string(bucketPrefix(item.U)), encoded)
+	return err
+}
+
+// Length returns length of the frontier.
+func (f *HostFrontier) Length() uint64 {
+	return f.queue.Length()
+}
+
+// ContainsItems returns true if length > 0.
+func (f *HostFrontier) ContainsItems() bool {
+	return f.queue.Length() > 0
+}
@@ -0,0 +1,156 @@
+package linkqueue
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/beeker1121/goque"
+)
+
+// next takes the next item off the queue, failing the test if there isn't one soon.
+func next(t *testing.T, q Queue) *Item {
+	t.Helper()
+	found, failed := q.DeQueue()
+	select {
+	case item := <-found:
+		return item
+	case err := <-failed:
+		t.Fatalf("dequeue failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nothing was dequeued")
+	}
+	return nil
+}
+
+func TestHostFrontierFairness(t *testing.T) {
+	f, err := NewHostFrontier(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	hosts := []string{"a.example.com", "b.example.com", "c.example.com"}
+	for i, host := range hosts {
+		for j := i + 1; j < len(hosts); j++ {
+			if bytes.Equal(bucketPrefix(parse(t, "https://"+host)), bucketPrefix(parse(t, "https://"+hosts[j]))) {
+				t.Fatalf("%s and %s share a bucket, pick other hosts", host, hosts[j])
+			}
+		}
+	}
+
+	// One host has far more urls than the others, queued before them.
+	for _, rawURL := range []string{
+		"https://a.example.com/1", "https://a.example.com/2", "https://a.example.com/3", "https://a.example.com/4",
+		"https://b.example.com/1", "https://c.example.com/1",
+	} {
+		if err = f.EnQueue(&Item{U: parse(t, rawURL)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Queueing the same url again does nothing.
+	if err = f.EnQueue(&Item{U: parse(t, "https://a.example.com/1")}); err != nil {
+		t.Fatal(err)
+	}
+	if f.Length() != 6 {
+		t.Fatalf("length %d, want 6", f.Length())
+	}
+
+	// Every host gets a turn before any host gets a second one.
+	seen := make(map[string]bool)
+	for i := 0; i < len(hosts); i++ {
+		item := next(t, f)
+		if seen[item.U.Host] {
+			t.Errorf("%s dequeued twice before every host had a turn", item.U.Host)
+		}
+		seen[item.U.Host] = true
+	}
+
+	// A host's own urls keep their order.
+	for _, want := range []string{"/2", "/3", "/4"} {
+		if item := next(t, f); item.U.Host != "a.example.com" || item.U.Path != want {
+			t.Errorf("dequeued %s, want https://a.example.com%s", item.U, want)
+		}
+	}
+	if f.ContainsItems() {
+		t.Errorf("%d items left over", f.Length())
+	}
+}
+
+func TestHostFrontierMigratesLinkQueue(t *testing.T) {
+	dataDir := t.TempDir()
+	old, err := NewLinkQueue(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = old.EnQueue(&Item{U: parse(t, "https://example.com/a"), Depth: 2, From: parse(t, "https://example.com/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Queues written before items carried a depth just contain the url, and anything unreadable is dropped.
+	for _, stored := range []string{"https://other.com/b", "not a url we can crawl"} {
+		if _, err = old.queue.EnqueueString(stored); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = old.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewHostFrontier(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Length() != 2 {
+		t.Fatalf("frontier has %d items, want 2", f.Length())
+	}
+	got := map[string]*Item{}
+	for i := 0; i < 2; i++ {
+		item := next(t, f)
+		got[item.U.String()] = item
+	}
+	if a := got["https://example.com/a"]; a == nil || a.Depth != 2 || a.From.String() != "https://example.com/" {
+		t.Errorf("https://example.com/a came out as %+v", a)
+	}
+	if b := got["https://other.com/b"]; b == nil || b.Depth != 0 || b.From != nil {
+		t.Errorf("https://other.com/b came out as %+v", b)
+	}
+
+	// The old queue was drained, so opening the frontier again doesn't bring anything back.
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = NewHostFrontier(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Length() != 0 {
+		t.Errorf("frontier has %d items after reopening, want 0", f.Length())
+	}
+}
+
+func TestHostFrontierDeQueueError(t *testing.T) {
+	f, err := NewHostFrontier(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.EnQueue(&Item{U: parse(t, "https://example.com/")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	found, failed := f.DeQueue()
+	select {
+	case item := <-found:
+		t.Fatalf("dequeued %s from a closed frontier", item.U)
+	case err = <-failed:
+		if err != goque.ErrDBClosed {
+			t.Errorf("error %v, want %v", err, goque.ErrDBClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("dequeueing from a closed frontier didn't fail")
+	}
+}
@@ -0,0 +1,122 @@
+package linkqueue
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkseed"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// Item is a url waiting in the queue, along with how we got to it.
+type Item struct {
+	U *url.URL
+	// From is the page the url was discovered on, or nil for seeds.
+	From *url.URL
+	// Depth is the number of links followed from a seed to get here.
+	Depth int
+	// Seed is the seed the url was reached from, or nil if we don't know, such as for revisits.
+	Seed *linkseed.Seed
+	// Recrawl is set when the page is being revisited on purpose, so it shouldn't be skipped for having been seen before.
+	// Revisits come straight from the db, so this is never written to disk.
+	Recrawl bool
+	// LastMod is when a sitemap said the page last changed, or zero if we don't know.
+	// A page which has changed since we last fetched it is fetched again, even if it isn't due yet.
+	LastMod time.Time
+	// Sitemap is set when the url is a sitemap to read for more urls, rather than a page.
+	Sitemap bool
+}
+
+// storedItem is how an Item is written to disk.
+type storedItem struct {
+	U     string `json:"u"`
+	From  string `json:"from,omitempty"`
+	Depth int    `json:"depth"`
+	// LastMod is left out for the many items which don't have one.
+	LastMod *time.Time  `json:"last_mod,omitempty"`
+	Seed    *storedSeed `json:"seed,omitempty"`
+	Sitemap bool        `json:"sitemap,omitempty"`
+}
+
+// storedSeed is how the seed of an Item is written to disk.
+type storedSeed struct {
+	U        string `json:"u"`
+	MaxDepth int    `json:"max_depth,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+func encodeItem(item *Item) (string, error) {
+	stored := storedItem{
+		U:       item.U.String(),
+		Depth:   item.Depth,
+		Sitemap: item.Sitemap,
+	}
+	if item.From != nil {
+		stored.From = item.From.String()
+	}
+	if !item.LastMod.IsZero() {
+		stored.LastMod = &item.LastMod
+	}
+	if item.Seed != nil {
+		stored.Seed = &storedSeed{
+			U:        item.Seed.U.String(),
+			MaxDepth: item.Seed.MaxDepth,
+			Scope:    item.Seed.Scope,
+		}
+	}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeItem reads an item back from disk.
+// Queues written before items carried a depth just contain the url, and those are treated as seeds.
+func decodeItem(s string) (*Item, error) {
+	if !strings.HasPrefix(s, "{") {
+		u, err := linkutils.ParseURL(s)
+		if err != nil {
+			return nil, err
+		}
+		return &Item{U: u}, nil
+	}
+
+	var stored storedItem
+	err := json.Unmarshal([]byte(s), &stored)
+	if err != nil {
+		return nil, err
+	}
+	u, err := linkutils.ParseURL(stored.U)
+	if err != nil {
+		return nil, err
+	}
+	item := &Item{
+		U:       u,
+		Depth:   stored.Depth,
+		Sitemap: stored.Sitemap,
+	}
+	if stored.LastMod != nil {
+		item.LastMod = *stored.LastMod
+	}
+	if stored.From != "" {
+		item.From, err = url.Parse(stored.From)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if stored.Seed != nil {
+		seed, err := url.Parse(stored.Seed.U)
+		if err != nil {
+			return nil, err
+		}
+		item.Seed = &linkseed.Seed{
+			U:        seed,
+			MaxDepth: stored.Seed.MaxDepth,
+			Scope:    stored.Seed.Scope,
+		}
+	}
+	return item, nil
+}
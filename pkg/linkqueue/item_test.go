@@ -0,0 +1,105 @@
+package linkqueue
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkseed"
+)
+
+func parse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestEncodeItem(t *testing.T) {
+	lastMod := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		name string
+		item *Item
+	}{
+		{name: "seed", item: &Item{U: parse(t, "https://example.com/")}},
+		{
+			name: "everything",
+			item: &Item{
+				U:       parse(t, "https://example.com/a?b=c"),
+				From:    parse(t, "https://example.com/"),
+				Depth:   3,
+				Seed:    &linkseed.Seed{U: parse(t, "https://example.com/"), MaxDepth: 5, Scope: "host"},
+				LastMod: lastMod,
+			},
+		},
+		{name: "sitemap", item: &Item{U: parse(t, "https://example.com/sitemap.xml"), Depth: 1, Sitemap: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := encodeItem(tt.item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeItem(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.item) {
+				t.Errorf("decoded %+v from %s, want %+v", got, encoded, tt.item)
+			}
+		})
+	}
+}
+
+func TestEncodeItemLeavesOutRecrawl(t *testing.T) {
+	encoded, err := encodeItem(&Item{U: parse(t, "https://example.com/"), Recrawl: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeItem(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Recrawl {
+		t.Errorf("revisits shouldn't be written to disk, got %s", encoded)
+	}
+}
+
+func TestDecodeItem(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  string
+		want    *Item
+		wantErr bool
+	}{
+		{
+			// Queues written before items carried a depth just contain the url.
+			name:   "legacy url",
+			stored: "https://example.com/a",
+			want:   &Item{U: parse(t, "https://example.com/a")},
+		},
+		{name: "legacy url with spaces", stored: "  https://example.com/a\n", want: &Item{U: parse(t, "https://example.com/a")}},
+		{name: "legacy url we can't crawl", stored: "mailto:someone@example.com", wantErr: true},
+		{name: "item we can't crawl", stored: `{"u": "ftp://example.com/", "depth": 1}`, wantErr: true},
+		{name: "broken json", stored: `{"u": "https://example.com/"`, wantErr: true},
+		{
+			name:   "no seed or sitemap",
+			stored: `{"u": "https://example.com/a", "from": "https://example.com/", "depth": 2}`,
+			want:   &Item{U: parse(t, "https://example.com/a"), From: parse(t, "https://example.com/"), Depth: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeItem(tt.stored)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error = %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,7 @@ package linkqueue
 
 import (
 	"log"
-	"net/url"
+	"time"
 
 	"github.com/beeker1121/goque"
 	lru "github.com/hashicorp/golang-lru"
@@ -11,6 +11,20 @@ import (
 
 // This is a simple thread safe queue for appending and retrieving messages from a persistent, local queue.
 
+// Queue is a persistent queue of urls waiting to be crawled.
+type Queue interface {
+	EnQueue(item *Item) error
+	// ReQueue puts back an item that was taken off the queue but never crawled, even though it has been queued before.
+	// Sitemaps are queued this way too, as the same url may already have been queued as a page.
+	ReQueue(item *Item) error
+	// DeQueue waits for the next item, which is sent on the first channel,
+	// unless the queue fails for any reason other than being empty, in which case the error is sent on the second.
+	DeQueue() (<-chan *Item, <-chan error)
+	Length() uint64
+	ContainsItems() bool
+	Close() error
+}
+
 // LinkQueue is the in memory link cache object.
 type LinkQueue struct {
 	queue *goque.Queue
@@ -38,43 +52,73 @@ func (q *LinkQueue) Close() error {
 	return q.queue.Close()
 }
 
-// DeQueue is a blocking operation and returns a channel that receives a URL from the queue.
-func (q *LinkQueue) DeQueue() <-chan *url.URL {
-	foundURL := make(chan *url.URL)
+// DeQueue is a blocking operation and returns a channel that receives an item from the queue.
+func (q *LinkQueue) DeQueue() (<-chan *Item, <-chan error) {
+	return dequeueLoop(func() (string, error) {
+		item, err := q.queue.Dequeue()
+		if err != nil {
+			return "", err
+		}
+		return item.ToString(), nil
+	})
+}
+
+// dequeueLoop calls next until it returns an item, waiting emptyBackoff whenever the queue is empty.
+// The item is sent on the first channel returned, or the first error which isn't the queue being empty on the second,
+// both of which have room for it, so nothing is left waiting if the caller has stopped listening.
+func dequeueLoop(next func() (string, error)) (<-chan *Item, <-chan error) {
+	found := make(chan *Item, 1)
+	failed := make(chan error, 1)
 
 	go func() {
-		var link *url.URL
-		var item *goque.Item
-		var err error
 		for {
-			item, err = q.queue.Dequeue()
-			if err != nil {
+			s, err := next()
+			if err == goque.ErrEmpty {
+				time.Sleep(emptyBackoff)
 				continue
 			}
+			if err != nil {
+				failed <- err
+				return
+			}
 
-			link, err = linkutils.ParseURL(item.ToString())
+			item, err := decodeItem(s)
 			if err != nil {
 				log.Printf("Error whilst converting message %v", err)
 				continue
 			}
-			break
+			found <- item
+			return
 		}
-		foundURL <- link
 	}()
 
-	return foundURL
+	return found, failed
 }
 
-// EnQueue appends a url to the queue.
-func (q *LinkQueue) EnQueue(link *url.URL) error {
-	ok, _ := q.cache.ContainsOrAdd(linkutils.Hash(link), struct{}{})
+// EnQueue appends an item to the queue.
+func (q *LinkQueue) EnQueue(item *Item) error {
+	ok, _ := q.cache.ContainsOrAdd(linkutils.Hash(item.U), struct{}{})
 	if !ok {
-		_, err := q.queue.EnqueueString(link.String())
+		encoded, err := encodeItem(item)
+		if err != nil {
+			return err
+		}
+		_, err = q.queue.EnqueueString(encoded)
 		return err
 	}
 	return nil
 }
 
+// ReQueue appends an item to the queue, without checking whether it has been queued already.
+func (q *LinkQueue) ReQueue(item *Item) error {
+	encoded, err := encodeItem(item)
+	if err != nil {
+		return err
+	}
+	_, err = q.queue.EnqueueString(encoded)
+	return err
+}
+
 // Length returns length of queue.
 func (q *LinkQueue) Length() uint64 {
 	return q.queue.Length()
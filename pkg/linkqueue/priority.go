@@ -0,0 +1,182 @@
+package linkqueue
+
+import (
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/beeker1121/goque"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// This is a best-first crawl frontier, which hands out the most important urls first
+// according to a pluggable Scorer.
+
+// priorityDir is where the priority frontier lives within the queue data dir.
+const priorityDir = "priority"
+
+// CandidateQueue is a queue which wants to know how a url was found when it is queued.
+type CandidateQueue interface {
+	Queue
+	EnQueueCandidate(c *Candidate) error
+}
+
+// PriorityFrontier is a persistent queue ordered by the score of each url.
+type PriorityFrontier struct {
+	queue  *goque.PriorityQueue
+	scorer Scorer
+	// levels remembers the priority level each url was last queued at,
+	// so a url can be queued again if it turns out to be more important than we first thought.
+	levels *lru.Cache
+}
+
+// NewPriorityFrontier opens the priority frontier within the queue data dir.
+// If the data dir still contains a HostFrontier or an old LinkQueue, their contents are moved over to the priority frontier.
+func NewPriorityFrontier(dataDir string, scorer Scorer) (*PriorityFrontier, error) {
+	levels, err := lru.New(100000)
+	if err != nil {
+		return nil, err
+	}
+	queue, err := goque.OpenPriorityQueue(filepath.Join(dataDir, priorityDir), goque.ASC)
+	if err != nil {
+		return nil, err
+	}
+	f := &PriorityFrontier{
+		queue:  queue,
+		scorer: scorer,
+		levels: levels,
+	}
+
+	err = f.migrateHostFrontier(dataDir)
+	if err != nil {
+		queue.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// migrateHostFrontier drains a HostFrontier left in the data dir into the priority frontier,
+// along with any LinkQueue the HostFrontier moves over when it is opened.
+func (f *PriorityFrontier) migrateHostFrontier(dataDir string) error {
+	_, frontierErr := os.Stat(filepath.Join(dataDir, frontierDir))
+	_, linkQueueErr := os.Stat(filepath.Join(dataDir, "GOQUE"))
+	if os.IsNotExist(frontierErr) && os.IsNotExist(linkQueueErr) {
+		return nil
+	}
+	old, err := NewHostFrontier(dataDir)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	if old.Length() > 0 {
+		log.Printf("Moving %d urls from the host frontier into the priority frontier...", old.Length())
+	}
+	for old.Length() > 0 {
+		encoded, err := old.dequeue()
+		if err != nil {
+			return err
+		}
+		item, err := decodeItem(encoded)
+		if err != nil {
+			continue
+		}
+		// Sitemaps keep their place at the front, everything else is scored as if it had just been found.
+		if item.Sitemap {
+			err = f.ReQueue(item)
+		} else {
+			err = f.EnQueue(item)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// priorityLevel converts a score into a goque priority level, where 0 is dequeued first.
+func priorityLevel(score float64) uint8 {
+	score = math.Max(0, math.Min(1, score))
+	return uint8(math.Round((1 - score) * math.MaxUint8))
+}
+
+// Close closes connection to the frontier.
+func (f *PriorityFrontier) Close() error {
+	return f.queue.Close()
+}
+
+// DeQueue is a blocking operation and returns a channel that receives the most important item from the frontier.
+func (f *PriorityFrontier) DeQueue() (<-chan *Item, <-chan error) {
+	return dequeueLoop(func() (string, error) {
+		item, err := f.queue.Dequeue()
+		if err != nil {
+			return "", err
+		}
+		return item.ToString(), nil
+	})
+}
+
+// EnQueue scores and appends an item with no link text, such as a seed.
+func (f *PriorityFrontier) EnQueue(item *Item) error {
+	return f.EnQueueCandidate(&Candidate{
+		From:    item.From,
+		To:      item.U,
+		Depth:   item.Depth,
+		Seed:    item.Seed,
+		LastMod: item.LastMod,
+	})
+}
+
+// EnQueueCandidate scores and appends a url.
+// If the url is already queued it is only queued again if it now scores higher,
+// and the processor skips whichever copy turns up second.
+func (f *PriorityFrontier) EnQueueCandidate(c *Candidate) error {
+	level := priorityLevel(f.scorer.Score(c))
+	key := linkutils.Hash(c.To)
+	if existing, ok := f.levels.Get(key); ok && existing.(uint8) <= level {
+		return nil
+	}
+	f.levels.Add(key, level)
+	encoded, err := encodeItem(&Item{
+		U:       c.To,
+		From:    c.From,
+		Depth:   c.Depth,
+		Seed:    c.Seed,
+		LastMod: c.LastMod,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = f.queue.EnqueueString(level, encoded)
+	return err
+}
+
+// ReQueue appends an item at the lowest priority, without checking whether it has been queued already.
+// Items are put back because their host is too busy to take them, so they shouldn't be handed straight out again.
+// Sitemaps are the exception, they go to the front as they tell us about the rest of their host, and each host only has a few.
+func (f *PriorityFrontier) ReQueue(item *Item) error {
+	encoded, err := encodeItem(item)
+	if err != nil {
+		return err
+	}
+	if item.Sitemap {
+		_, err = f.queue.EnqueueString(0, encoded)
+		return err
+	}
+	f.levels.Add(linkutils.Hash(item.U), uint8(math.MaxUint8))
+	_, err = f.queue.EnqueueString(math.MaxUint8, encoded)
+	return err
+}
+
+// Length returns length of the frontier.
+func (f *PriorityFrontier) Length() uint64 {
+	return f.queue.Length()
+}
+
+// ContainsItems returns true if length > 0.
+func (f *PriorityFrontier) ContainsItems() bool {
+	return f.queue.Length() > 0
+}
@@ -0,0 +1,176 @@
+package linkqueue
+
+import (
+	"math"
+	"testing"
+)
+
+// pathScorer scores urls by their path, and anything it doesn't know about as 0.
+func pathScorer(scores map[string]float64) Scorer {
+	return ScorerFunc(func(c *Candidate) float64 {
+		return scores[c.To.Path]
+	})
+}
+
+func TestPriorityLevel(t *testing.T) {
+	tests := []struct {
+		score float64
+		want  uint8
+	}{
+		{score: 1, want: 0},
+		{score: 0.5, want: 128},
+		{score: 0, want: math.MaxUint8},
+		{score: 2, want: 0},
+		{score: -1, want: math.MaxUint8},
+	}
+	for _, tt := range tests {
+		if got := priorityLevel(tt.score); got != tt.want {
+			t.Errorf("priorityLevel(%v) = %d, want %d", tt.score, got, tt.want)
+		}
+	}
+	for score := 0.0; score < 1; score += 0.01 {
+		if priorityLevel(score) < priorityLevel(score+0.01) {
+			t.Fatalf("a score of %v is dequeued after %v", score+0.01, score)
+		}
+	}
+}
+
+func TestPriorityFrontierOrdering(t *testing.T) {
+	tests := []struct {
+		name    string
+		enqueue []string
+		// promote is queued again after everything else with a score of 1.
+		promote string
+		requeue *Item
+		want    []string
+	}{
+		{
+			name:    "highest score first",
+			enqueue: []string{"/low", "/high", "/middle"},
+			want:    []string{"/high", "/middle", "/low"},
+		},
+		{
+			name:    "equal scores keep their order",
+			enqueue: []string{"/middle", "/other", "/low"},
+			want:    []string{"/middle", "/other", "/low"},
+		},
+		{
+			name:    "queued again when it scores higher",
+			enqueue: []string{"/high", "/low"},
+			promote: "/low",
+			want:    []string{"/low", "/high", "/low"},
+		},
+		{
+			name:    "put back items go last",
+			enqueue: []string{"/low", "/high"},
+			requeue: &Item{U: parse(t, "https://example.com/middle")},
+			want:    []string{"/high", "/low", "/middle"},
+		},
+		{
+			name:    "put back sitemaps go first",
+			enqueue: []string{"/low", "/high"},
+			requeue: &Item{U: parse(t, "https://example.com/sitemap.xml"), Sitemap: true},
+			want:    []string{"/sitemap.xml", "/high", "/low"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scores := map[string]float64{"/high": 0.9, "/middle": 0.5, "/other": 0.5, "/low": 0.1}
+			f, err := NewPriorityFrontier(t.TempDir(), pathScorer(scores))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			for _, path := range tt.enqueue {
+				if err = f.EnQueue(&Item{U: parse(t, "https://example.com"+path)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Queueing a url again at the same score does nothing.
+			if err = f.EnQueue(&Item{U: parse(t, "https://example.com"+tt.enqueue[0])}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.promote != "" {
+				scores[tt.promote] = 1
+				if err = f.EnQueue(&Item{U: parse(t, "https://example.com"+tt.promote)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.requeue != nil {
+				if err = f.ReQueue(tt.requeue); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if f.Length() != uint64(len(tt.want)) {
+				t.Fatalf("length %d, want %d", f.Length(), len(tt.want))
+			}
+			for _, want := range tt.want {
+				if item := next(t, f); item.U.Path != want {
+					t.Errorf("dequeued %s, want %s", item.U.Path, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPriorityFrontierMigratesHostFrontier(t *testing.T) {
+	dataDir := t.TempDir()
+	old, err := NewLinkQueue(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = old.EnQueue(&Item{U: parse(t, "https://example.com/low"), Depth: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err = old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := NewHostFrontier(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []*Item{
+		{U: parse(t, "https://other.com/high"), From: parse(t, "https://example.com/")},
+		{U: parse(t, "https://other.com/sitemap.xml"), Sitemap: true},
+	} {
+		if err = hosts.EnQueue(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = hosts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewPriorityFrontier(dataDir, pathScorer(map[string]float64{"/high": 0.9, "/low": 0.1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Length() != 3 {
+		t.Fatalf("priority frontier has %d items, want 3", f.Length())
+	}
+	if item := next(t, f); item.U.String() != "https://other.com/sitemap.xml" || !item.Sitemap {
+		t.Errorf("dequeued %+v, want the sitemap", item)
+	}
+	if item := next(t, f); item.U.String() != "https://other.com/high" || item.From.String() != "https://example.com/" {
+		t.Errorf("dequeued %+v, want https://other.com/high", item)
+	}
+	if item := next(t, f); item.U.String() != "https://example.com/low" || item.Depth != 2 {
+		t.Errorf("dequeued %+v, want https://example.com/low", item)
+	}
+
+	// Both old stores were drained, so opening the priority frontier again doesn't bring anything back.
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = NewPriorityFrontier(dataDir, pathScorer(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Length() != 0 {
+		t.Errorf("priority frontier has %d items after reopening, want 0", f.Length())
+	}
+}
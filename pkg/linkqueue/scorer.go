@@ -0,0 +1,159 @@
+package linkqueue
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jamesjarvis/web-graph/pkg/linkseed"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// Candidate is a url waiting to be queued, along with what we know about how we found it.
+type Candidate struct {
+	// From is the page the link was found on, or nil for seeds.
+	From     *url.URL
+	To       *url.URL
+	LinkText string
+	// Depth is the depth the url will be at if it is queued.
+	Depth int
+	// Seed is the seed the url was reached from, or nil if we don't know.
+	Seed *linkseed.Seed
+	// FromSitemap is set when the url was listed in a sitemap, which can say when it last changed and how important it is.
+	FromSitemap bool
+	LastMod     time.Time
+	// Priority is how important the sitemap said the page is compared to the rest of the site, from 0 to 1.
+	Priority float64
+}
+
+// Scorer decides how important a candidate is, from 0 (crawl whenever) to 1 (crawl right now).
+type Scorer interface {
+	Score(c *Candidate) float64
+}
+
+// ScorerFunc allows a plain function to be used as a Scorer.
+type ScorerFunc func(c *Candidate) float64
+
+// Score calls the function.
+func (f ScorerFunc) Score(c *Candidate) float64 {
+	return f(c)
+}
+
+// WeightedScorer is a scorer along with how much it counts towards a combined score.
+type WeightedScorer struct {
+	Scorer Scorer
+	Weight float64
+}
+
+// CombineScorers returns a scorer which is the weighted average of all the given scorers.
+// Every scorer sees every candidate, so stateful scorers keep counting even when outweighed.
+func CombineScorers(scorers ...WeightedScorer) Scorer {
+	return ScorerFunc(func(c *Candidate) float64 {
+		var total, weights float64
+		for _, ws := range scorers {
+			total += ws.Weight * ws.Scorer.Score(c)
+			weights += ws.Weight
+		}
+		if weights == 0 {
+			return 0
+		}
+		return total / weights
+	})
+}
+
+// DepthScorer prefers pages closer to the seeds.
+var DepthScorer = ScorerFunc(func(c *Candidate) float64 {
+	return 1 / float64(1+c.Depth)
+})
+
+// PathLengthScorer prefers short urls, as pages nearer the root of a site tend to be more interesting.
+var PathLengthScorer = ScorerFunc(func(c *Candidate) float64 {
+	var segments int
+	for _, segment := range strings.Split(c.To.EscapedPath(), "/") {
+		if segment != "" {
+			segments++
+		}
+	}
+	if c.To.RawQuery != "" {
+		segments++
+	}
+	return 1 / float64(1+segments)
+})
+
+// SitemapScorer prefers pages their site says are important, with urls that didn't come from a sitemap scoring in the middle.
+var SitemapScorer = ScorerFunc(func(c *Candidate) float64 {
+	if !c.FromSitemap {
+		return 0.5
+	}
+	return c.Priority
+})
+
+// InLinkScorer prefers pages which have been linked to more often so far.
+type InLinkScorer struct {
+	counts *lru.Cache
+	lock   *sync.Mutex
+}
+
+// NewInLinkScorer remembers in-link counts for up to size pages.
+func NewInLinkScorer(size int) (*InLinkScorer, error) {
+	counts, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &InLinkScorer{
+		counts: counts,
+		lock:   &sync.Mutex{},
+	}, nil
+}
+
+// Score counts the link, and returns a score which approaches 1 as the in-link count grows.
+func (s *InLinkScorer) Score(c *Candidate) float64 {
+	if c.From == nil {
+		return 1
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := linkutils.Hash(c.To)
+	count := 1
+	if existing, ok := s.counts.Get(key); ok {
+		count = existing.(int) + 1
+	}
+	s.counts.Add(key, count)
+	return 1 - 1/float64(1+count)
+}
+
+// HostDiversityScorer prefers hosts we haven't queued much from yet.
+type HostDiversityScorer struct {
+	counts  *lru.Cache
+	lock    *sync.Mutex
+	perHost float64
+}
+
+// NewHostDiversityScorer remembers how many urls have been queued for up to size hosts.
+// The score halves once perHost urls have been seen for a host.
+func NewHostDiversityScorer(size int, perHost int) (*HostDiversityScorer, error) {
+	counts, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &HostDiversityScorer{
+		counts:  counts,
+		lock:    &sync.Mutex{},
+		perHost: float64(perHost),
+	}, nil
+}
+
+// Score counts the host, and returns a score which drops towards 0 the more we have seen of it.
+func (s *HostDiversityScorer) Score(c *Candidate) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := c.To.Hostname()
+	count := 0
+	if existing, ok := s.counts.Get(key); ok {
+		count = existing.(int)
+	}
+	s.counts.Add(key, count+1)
+	return 1 / (1 + float64(count)/s.perHost)
+}
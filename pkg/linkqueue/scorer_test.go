@@ -0,0 +1,145 @@
+package linkqueue
+
+import (
+	"math"
+	"testing"
+)
+
+// scores scores each candidate in turn, so stateful scorers see them in order.
+func scores(s Scorer, candidates []*Candidate) []float64 {
+	var got []float64
+	for _, c := range candidates {
+		got = append(got, s.Score(c))
+	}
+	return got
+}
+
+func sameScores(got, want []float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func constant(score float64) Scorer {
+	return ScorerFunc(func(c *Candidate) float64 {
+		return score
+	})
+}
+
+func TestScorers(t *testing.T) {
+	inLinks, err := NewInLinkScorer(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := NewHostDiversityScorer(100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted, err := NewInLinkScorer(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := parse(t, "https://example.com/")
+
+	tests := []struct {
+		name       string
+		scorer     Scorer
+		candidates []*Candidate
+		want       []float64
+	}{
+		{
+			name:   "depth",
+			scorer: DepthScorer,
+			candidates: []*Candidate{
+				{To: parse(t, "https://example.com/"), Depth: 0},
+				{To: parse(t, "https://example.com/"), Depth: 1},
+				{To: parse(t, "https://example.com/"), Depth: 3},
+			},
+			want: []float64{1, 0.5, 0.25},
+		},
+		{
+			name:   "path length",
+			scorer: PathLengthScorer,
+			candidates: []*Candidate{
+				{To: parse(t, "https://example.com")},
+				{To: parse(t, "https://example.com/")},
+				{To: parse(t, "https://example.com/a/b")},
+				{To: parse(t, "https://example.com/a//b/")},
+				{To: parse(t, "https://example.com/a?page=2")},
+			},
+			want: []float64{1, 1, 1.0 / 3, 1.0 / 3, 1.0 / 3},
+		},
+		{
+			name:   "sitemap",
+			scorer: SitemapScorer,
+			candidates: []*Candidate{
+				{To: parse(t, "https://example.com/"), Priority: 0.9},
+				{To: parse(t, "https://example.com/"), FromSitemap: true, Priority: 0.9},
+				{To: parse(t, "https://example.com/"), FromSitemap: true},
+			},
+			want: []float64{0.5, 0.9, 0},
+		},
+		{
+			name:   "in links",
+			scorer: inLinks,
+			candidates: []*Candidate{
+				{To: parse(t, "https://example.com/a")},
+				{To: parse(t, "https://example.com/a"), From: from},
+				{To: parse(t, "https://example.com/a"), From: from},
+				{To: parse(t, "https://example.com/b"), From: from},
+			},
+			// Seeds score top marks without counting as a link.
+			want: []float64{1, 0.5, 2.0 / 3, 0.5},
+		},
+		{
+			name:   "host diversity",
+			scorer: hosts,
+			candidates: []*Candidate{
+				{To: parse(t, "https://example.com/a")},
+				{To: parse(t, "https://example.com/b")},
+				{To: parse(t, "https://example.com/c")},
+				{To: parse(t, "https://other.com/a")},
+			},
+			want: []float64{1, 2.0 / 3, 0.5, 1},
+		},
+		{
+			name:       "combined is a weighted average",
+			scorer:     CombineScorers(WeightedScorer{Scorer: constant(1), Weight: 3}, WeightedScorer{Scorer: constant(0), Weight: 1}),
+			candidates: []*Candidate{{To: parse(t, "https://example.com/")}},
+			want:       []float64{0.75},
+		},
+		{
+			name:       "combined without weights",
+			scorer:     CombineScorers(WeightedScorer{Scorer: constant(1)}),
+			candidates: []*Candidate{{To: parse(t, "https://example.com/")}},
+			want:       []float64{0},
+		},
+		{
+			name:   "combined still counts when outweighed",
+			scorer: CombineScorers(WeightedScorer{Scorer: counted, Weight: 0}, WeightedScorer{Scorer: DepthScorer, Weight: 1}),
+			candidates: []*Candidate{
+				{To: parse(t, "https://example.com/a"), From: from},
+				{To: parse(t, "https://example.com/a"), From: from},
+			},
+			want: []float64{1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scores(tt.scorer, tt.candidates); !sameScores(got, tt.want) {
+				t.Errorf("scores %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The outweighed in-link scorer saw both links.
+	if got := counted.Score(&Candidate{To: parse(t, "https://example.com/a"), From: from}); !sameScores([]float64{got}, []float64{0.75}) {
+		t.Errorf("in-link score %v after two links, want 0.75", got)
+	}
+}
@@ -0,0 +1,150 @@
+package linkrecrawl
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkqueue"
+	"github.com/jamesjarvis/web-graph/pkg/linkstorage"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// This decides when pages should be fetched again, and puts them back in front of the crawler once they are due.
+
+// Policy adapts how often a page is revisited to how often its links actually change.
+type Policy struct {
+	// Initial is how long we wait before revisiting a page for the first time.
+	Initial time.Duration
+	Min     time.Duration
+	Max     time.Duration
+}
+
+// NextInterval halves the revisit interval if the page's links changed since last time, or doubles it if they didn't.
+// A previous interval of 0 means we have never revisited the page.
+func (p Policy) NextInterval(previous time.Duration, changed bool) time.Duration {
+	if previous <= 0 {
+		return p.Initial
+	}
+	next := previous * 2
+	if changed {
+		next = previous / 2
+	}
+	if next < p.Min {
+		return p.Min
+	}
+	if next > p.Max {
+		return p.Max
+	}
+	return next
+}
+
+// LinksHash returns a hash of the set of pages linked to, so we can tell whether a page's links have changed.
+func LinksHash(links []*linkstorage.Link) string {
+	hashes := make([]string, 0, len(links))
+	seen := make(map[string]struct{}, len(links))
+	for _, link := range links {
+		hash := linkutils.Hash(link.ToU)
+		if _, ok := seen[hash]; ok {
+			continue
+		}
+		seen[hash] = struct{}{}
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	h := sha1.New()
+	for _, hash := range hashes {
+		h.Write([]byte(hash))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// DueStore finds pages which are due a revisit.
+type DueStore interface {
+	// ClaimPagesDueForRecrawl returns up to limit pages which are due,
+	// pushing their next visit back by lease so they aren't handed out twice.
+	ClaimPagesDueForRecrawl(limit int, lease time.Duration) ([]linkstorage.Page, error)
+}
+
+// Recrawler periodically hands pages that are due a revisit to the crawler.
+type Recrawler struct {
+	store     DueStore
+	add       func(item *linkqueue.Item) bool
+	full      func() bool
+	interval  time.Duration
+	batchSize int
+	lease     time.Duration
+	done      chan struct{}
+}
+
+// NewRecrawler is a helper function for creating the Recrawler.
+// Every interval, up to batchSize due pages are passed to add, unless full says the crawler is busy enough already.
+// add returns false if it has no room for the page.
+func NewRecrawler(
+	store DueStore,
+	add func(item *linkqueue.Item) bool,
+	full func() bool,
+	interval time.Duration,
+	batchSize int,
+) *Recrawler {
+	return &Recrawler{
+		store:     store,
+		add:       add,
+		full:      full,
+		interval:  interval,
+		batchSize: batchSize,
+		lease:     time.Hour,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start begins checking for pages that are due.
+func (r *Recrawler) Start() {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				if r.full() {
+					continue
+				}
+				pages, err := r.store.ClaimPagesDueForRecrawl(r.batchSize, r.lease)
+				if err != nil {
+					log.Printf("Could not find pages due a recrawl: %v", err)
+					continue
+				}
+				for _, page := range pages {
+					if !r.add(recrawlItem(page)) {
+						// The rest come round again once their lease runs out.
+						break
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Close stops checking for pages that are due.
+func (r *Recrawler) Close() error {
+	close(r.done)
+	return nil
+}
+
+func recrawlItem(page linkstorage.Page) *linkqueue.Item {
+	depth := page.Depth
+	if depth == linkstorage.UnknownDepth {
+		depth = 0
+	}
+	return &linkqueue.Item{
+		U:       page.U,
+		From:    page.DiscoveredFrom,
+		Depth:   depth,
+		Recrawl: true,
+	}
+}
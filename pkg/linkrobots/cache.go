@@ -0,0 +1,144 @@
+package linkrobots
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// maxRobotsSize is the maximum number of bytes of a robots.txt file we bother reading, as recommended by RFC 9309.
+const maxRobotsSize = 500 * 1024
+
+// failureExpiration is how long we keep out of a host after failing to fetch its robots.txt,
+// which is short, as the failure is usually a blip rather than the host asking us to go away.
+const failureExpiration = 10 * time.Minute
+
+// RobotsCache fetches and caches the robots.txt of each host.
+type RobotsCache struct {
+	httpClient *http.Client
+	cache      *cache.Cache
+	userAgent  string
+	token      string
+	// fetching holds a channel for each robots.txt being fetched, which is closed once it is cached,
+	// so the same robots.txt is only fetched once however many workers want it at the same time.
+	fetching map[string]chan struct{}
+	lock     *sync.Mutex
+}
+
+// NewRobotsCache initialises the cache with a default expiration duration, so changes to robots.txt are eventually noticed.
+// userAgent is sent when fetching robots.txt, and token is the product token matched against User-agent lines.
+func NewRobotsCache(httpClient *http.Client, userAgent, token string, defaultExpiration time.Duration) *RobotsCache {
+	return &RobotsCache{
+		httpClient: httpClient,
+		cache:      cache.New(defaultExpiration, time.Hour),
+		userAgent:  userAgent,
+		token:      token,
+		fetching:   make(map[string]chan struct{}),
+		lock:       &sync.Mutex{},
+	}
+}
+
+// robotsKey is the scheme and authority of the url, as robots.txt applies per scheme, host and port.
+func robotsKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// Get returns the robots.txt for the host of the url, fetching it if it is not already cached.
+func (rc *RobotsCache) Get(u *url.URL) *Robots {
+	key := robotsKey(u)
+	for {
+		if robots, found := rc.cache.Get(key); found {
+			return robots.(*Robots)
+		}
+
+		rc.lock.Lock()
+		wait, fetching := rc.fetching[key]
+		if !fetching {
+			rc.fetching[key] = make(chan struct{})
+		}
+		rc.lock.Unlock()
+		if !fetching {
+			break
+		}
+		// Someone else is already fetching it, so wait for them and look again.
+		<-wait
+	}
+
+	robots, expiration := rc.fetch(key)
+	rc.cache.Set(key, robots, expiration)
+
+	rc.lock.Lock()
+	close(rc.fetching[key])
+	delete(rc.fetching, key)
+	rc.lock.Unlock()
+	return robots
+}
+
+// Allowed returns true if robots.txt allows us to fetch the url.
+func (rc *RobotsCache) Allowed(u *url.URL) bool {
+	return rc.Get(u).Allowed(rc.token, u)
+}
+
+// Check returns whether robots.txt allows us to fetch the url, or whether we couldn't get the robots.txt to find out.
+func (rc *RobotsCache) Check(u *url.URL) Verdict {
+	return rc.Get(u).Verdict(rc.token, u)
+}
+
+// Cached returns whether robots.txt allows us to fetch the url, but only if we already have the host's robots.txt,
+// returning false if we don't rather than fetching it.
+func (rc *RobotsCache) Cached(u *url.URL) (Verdict, bool) {
+	robots, found := rc.cache.Get(robotsKey(u))
+	if !found {
+		return Allowed, false
+	}
+	return robots.(*Robots).Verdict(rc.token, u), true
+}
+
+// CrawlDelay returns the Crawl-delay robots.txt asks us to leave between requests to the host of the url.
+func (rc *RobotsCache) CrawlDelay(u *url.URL) time.Duration {
+	return rc.Get(u).CrawlDelay(rc.token)
+}
+
+// Sitemaps returns the urls of the sitemaps robots.txt lists for the host of the url.
+func (rc *RobotsCache) Sitemaps(u *url.URL) []string {
+	return rc.Get(u).Sitemaps()
+}
+
+// fetch retrieves and parses robots.txt, returning how long to cache it for.
+// A missing robots.txt allows everything, whereas a server error or unreachable host makes it Unavailable,
+// but only for failureExpiration, so we try again soon rather than keeping out of the host all day.
+func (rc *RobotsCache) fetch(key string) (*Robots, time.Duration) {
+	request, err := http.NewRequest("GET", key+"/robots.txt", nil)
+	if err != nil {
+		return Unavailable, failureExpiration
+	}
+	request.Header.Set("User-Agent", rc.userAgent)
+
+	response, err := rc.httpClient.Do(request)
+	if err != nil {
+		return Unavailable, failureExpiration
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode >= 500:
+		return Unavailable, failureExpiration
+	case response.StatusCode >= 400:
+		return AllowAll, cache.DefaultExpiration
+	case response.StatusCode >= 300:
+		// The http client follows redirects for us, so anything left over is odd enough to ignore.
+		return AllowAll, cache.DefaultExpiration
+	}
+
+	robots, err := Parse(io.LimitReader(response.Body, maxRobotsSize))
+	if err != nil {
+		log.Printf("Failed to parse robots.txt from %s: %v", key, err)
+		return AllowAll, cache.DefaultExpiration
+	}
+	return robots, cache.DefaultExpiration
+}
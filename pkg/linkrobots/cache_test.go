@@ -0,0 +1,90 @@
+package linkrobots
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRobotsCacheCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		path    string
+		want    Verdict
+	}{
+		{
+			name: "allowed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("User-agent: *\nDisallow: /private"))
+			},
+			path: "/public",
+			want: Allowed,
+		},
+		{
+			name: "disallowed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("User-agent: *\nDisallow: /private"))
+			},
+			path: "/private/1",
+			want: Disallowed,
+		},
+		{
+			name:    "missing robots.txt allows everything",
+			handler: http.NotFound,
+			path:    "/private/1",
+			want:    Allowed,
+		},
+		{
+			name: "server error is unreachable",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			path: "/public",
+			want: Unreachable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+			rc := NewRobotsCache(server.Client(), "test", "webgraph", time.Hour)
+			u, err := url.Parse(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Nothing is fetched just to look in the cache.
+			if _, cached := rc.Cached(u); cached {
+				t.Errorf("robots.txt cached before it was fetched")
+			}
+			if got := rc.Check(u); got != tt.want {
+				t.Errorf("Check(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+			if got, cached := rc.Cached(u); !cached || got != tt.want {
+				t.Errorf("Cached(%s) = %v, %v, want %v, true", tt.path, got, cached, tt.want)
+			}
+			if rc.Allowed(u) != (tt.want == Allowed) {
+				t.Errorf("Allowed(%s) = %v with a verdict of %v", tt.path, rc.Allowed(u), tt.want)
+			}
+		})
+	}
+}
+
+func TestRobotsCacheUnreachableHost(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	client := server.Client()
+	u, err := url.Parse(server.URL + "/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is listening once the server is closed, so the robots.txt can't be fetched.
+	server.Close()
+
+	rc := NewRobotsCache(client, "test", "webgraph", time.Hour)
+	if got := rc.Check(u); got != Unreachable {
+		t.Errorf("Check = %v, want %v", got, Unreachable)
+	}
+}
@@ -0,0 +1,78 @@
+package linkrobots
+
+import (
+	"strings"
+)
+
+// This is how a page tells robots what to do with it, with <meta name="robots"> or the X-Robots-Tag header.
+
+// Directives is what a page has asked robots to do with it.
+type Directives struct {
+	// Noindex means the page shouldn't be shown to anyone, though we still keep it in the graph.
+	Noindex bool
+	// Nofollow means none of the links on the page should be followed.
+	Nofollow bool
+}
+
+// Merge returns the directives asked for by either.
+func (d Directives) Merge(other Directives) Directives {
+	return Directives{
+		Noindex:  d.Noindex || other.Noindex,
+		Nofollow: d.Nofollow || other.Nofollow,
+	}
+}
+
+// add applies a single directive such as "noindex".
+func (d *Directives) add(directive string) {
+	switch strings.ToLower(strings.TrimSpace(directive)) {
+	case "noindex":
+		d.Noindex = true
+	case "nofollow":
+		d.Nofollow = true
+	case "none":
+		d.Noindex = true
+		d.Nofollow = true
+	}
+}
+
+// ParseMetaRobots parses the content of a <meta name="robots"> tag, such as "noindex, nofollow".
+func ParseMetaRobots(content string) Directives {
+	var d Directives
+	for _, directive := range strings.Split(content, ",") {
+		d.add(directive)
+	}
+	return d
+}
+
+// valuedDirectives are the directives which take a value after a colon, so aren't a user agent.
+var valuedDirectives = map[string]struct{}{
+	"unavailable_after": {},
+	"max-snippet":       {},
+	"max-image-preview": {},
+	"max-video-preview": {},
+}
+
+// ParseXRobotsTag parses the values of the X-Robots-Tag header.
+// Directives can be for a particular user agent, such as "googlebot: noindex", in which case they only apply if it is the token.
+func ParseXRobotsTag(values []string, token string) Directives {
+	var d Directives
+	for _, value := range values {
+		// Directives apply to everyone until a user agent is named.
+		agent := ""
+		for _, part := range strings.Split(value, ",") {
+			name, rest, found := strings.Cut(part, ":")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if found {
+				if _, ok := valuedDirectives[name]; ok {
+					continue
+				}
+				agent = name
+				part = rest
+			}
+			if agent == "" || strings.EqualFold(agent, token) {
+				d.add(part)
+			}
+		}
+	}
+	return d
+}
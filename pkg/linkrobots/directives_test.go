@@ -0,0 +1,27 @@
+package linkrobots
+
+import (
+	"testing"
+)
+
+func TestDirectives(t *testing.T) {
+	tests := []struct {
+		name string
+		got  Directives
+		want Directives
+	}{
+		{name: "meta", got: ParseMetaRobots("NoIndex, nofollow"), want: Directives{Noindex: true, Nofollow: true}},
+		{name: "meta none", got: ParseMetaRobots("none"), want: Directives{Noindex: true, Nofollow: true}},
+		{name: "meta all", got: ParseMetaRobots("all"), want: Directives{}},
+		{name: "header for us", got: ParseXRobotsTag([]string{"webgraph: noindex"}, "webgraph"), want: Directives{Noindex: true}},
+		{name: "header for someone else", got: ParseXRobotsTag([]string{"otherbot: noindex"}, "webgraph"), want: Directives{}},
+		{name: "header for everyone", got: ParseXRobotsTag([]string{"nofollow", "noarchive"}, "webgraph"), want: Directives{Nofollow: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %+v, want %+v", tt.got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package linkrobots
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This is a small robots.txt parser, following the rules laid out in RFC 9309.
+
+// rule is a single Allow/Disallow line within a group.
+type rule struct {
+	allow   bool
+	pattern string
+}
+
+// group is a set of rules which apply to one or more user agents.
+type group struct {
+	agents     []string
+	rules      []rule
+	crawlDelay time.Duration
+}
+
+// Robots is a parsed robots.txt file.
+type Robots struct {
+	groups []*group
+	// sitemaps are the urls of any Sitemap lines, which apply to everyone whichever group they are in.
+	sitemaps []string
+	// unavailable is set when we couldn't get the robots.txt at all, so nothing is allowed until we try again.
+	unavailable bool
+}
+
+var (
+	// AllowAll is used when a host has no robots.txt.
+	AllowAll = &Robots{}
+	// Unavailable is used when a host's robots.txt is unreachable, which disallows everything for now, but isn't the host saying no.
+	Unavailable = &Robots{unavailable: true}
+)
+
+// Verdict is what robots.txt says about fetching a url.
+type Verdict int
+
+const (
+	// Allowed means we may fetch the url.
+	Allowed Verdict = iota
+	// Disallowed means robots.txt asks us not to fetch the url.
+	Disallowed
+	// Unreachable means we couldn't get the robots.txt, so the url shouldn't be fetched yet, but can be tried again later.
+	Unreachable
+)
+
+// Parse reads a robots.txt file into a Robots object. Unknown or malformed lines are ignored.
+func Parse(r io.Reader) (*Robots, error) {
+	robots := &Robots{}
+	var current *group
+	// lastWasAgent tracks whether consecutive user-agent lines should be merged into the same group.
+	var lastWasAgent bool
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if current == nil || !lastWasAgent {
+				current = &group{}
+				robots.groups = append(robots.groups, current)
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+			lastWasAgent = true
+		case "allow", "disallow":
+			lastWasAgent = false
+			if current == nil {
+				continue
+			}
+			// An empty disallow means allow everything, which is the default anyway.
+			if value == "" {
+				continue
+			}
+			current.rules = append(current.rules, rule{
+				allow:   key == "allow",
+				pattern: value,
+			})
+		case "crawl-delay":
+			lastWasAgent = false
+			if current == nil {
+				continue
+			}
+			// Crawl-delay is non-standard, but is almost always given in (possibly fractional) seconds.
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil || seconds < 0 {
+				continue
+			}
+			current.crawlDelay = time.Duration(seconds * float64(time.Second))
+		case "sitemap":
+			// Sitemap lines aren't part of any group, so they don't end one either.
+			if value != "" {
+				robots.sitemaps = append(robots.sitemaps, value)
+			}
+		default:
+			lastWasAgent = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return robots, nil
+}
+
+// Sitemaps returns the urls of the sitemaps listed in robots.txt.
+func (r *Robots) Sitemaps() []string {
+	return r.sitemaps
+}
+
+// groupsFor returns every group matching the user agent's product token, falling back to the "*" groups.
+func (r *Robots) groupsFor(userAgent string) []*group {
+	userAgent = strings.ToLower(userAgent)
+	var matched, wildcard []*group
+	for _, g := range r.groups {
+		var isWildcard bool
+		for _, agent := range g.agents {
+			if agent == userAgent {
+				matched = append(matched, g)
+				isWildcard = false
+				break
+			}
+			if agent == "*" {
+				isWildcard = true
+			}
+		}
+		if isWildcard {
+			wildcard = append(wildcard, g)
+		}
+	}
+	if matched != nil {
+		return matched
+	}
+	return wildcard
+}
+
+// CrawlDelay returns the delay the user agent should leave between requests, or 0 if there is none.
+func (r *Robots) CrawlDelay(userAgent string) time.Duration {
+	var delay time.Duration
+	for _, g := range r.groupsFor(userAgent) {
+		if g.crawlDelay > delay {
+			delay = g.crawlDelay
+		}
+	}
+	return delay
+}
+
+// Verdict returns whether the user agent may fetch the url, telling a robots.txt we couldn't get apart from one that says no.
+func (r *Robots) Verdict(userAgent string, u *url.URL) Verdict {
+	switch {
+	case r.unavailable:
+		return Unreachable
+	case r.Allowed(userAgent, u):
+		return Allowed
+	default:
+		return Disallowed
+	}
+}
+
+// Allowed returns true if the user agent may fetch the url.
+// The longest matching rule wins, and allow wins a tie.
+func (r *Robots) Allowed(userAgent string, u *url.URL) bool {
+	if r.unavailable {
+		return false
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	allowed := true
+	longest := -1
+	for _, g := range r.groupsFor(userAgent) {
+		for _, rl := range g.rules {
+			if !match(rl.pattern, path) {
+				continue
+			}
+			if len(rl.pattern) > longest || (len(rl.pattern) == longest && rl.allow) {
+				longest = len(rl.pattern)
+				allowed = rl.allow
+			}
+		}
+	}
+	return allowed
+}
+
+// match checks whether the path matches a robots.txt pattern,
+// where "*" matches any sequence of characters and a trailing "$" anchors the end of the path.
+func match(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = strings.TrimSuffix(pattern, "$")
+	}
+
+	parts := strings.Split(pattern, "*")
+	// The first part must be a prefix, as robots.txt patterns always match from the start of the path.
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+
+	for i, part := range parts[1:] {
+		if i == len(parts)-2 && anchored {
+			return strings.HasSuffix(path, part)
+		}
+		idx := strings.Index(path, part)
+		if idx < 0 {
+			return false
+		}
+		path = path[idx+len(part):]
+	}
+
+	if anchored && len(parts) == 1 {
+		return path == ""
+	}
+	return true
+}
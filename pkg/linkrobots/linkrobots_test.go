@@ -0,0 +1,164 @@
+package linkrobots
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parse(t *testing.T, robotsTxt string) *Robots {
+	t.Helper()
+	robots, err := Parse(strings.NewReader(robotsTxt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return robots
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{pattern: "/", path: "/anything", want: true},
+		{pattern: "/fish", path: "/fish.html", want: true},
+		{pattern: "/fish", path: "/Fish", want: false},
+		{pattern: "/fish/", path: "/fish", want: false},
+		{pattern: "/*.php", path: "/folder/index.php?a=b", want: true},
+		{pattern: "/*.php", path: "/index.html", want: false},
+		{pattern: "/*.php$", path: "/index.php", want: true},
+		{pattern: "/*.php$", path: "/index.php?a=b", want: false},
+		{pattern: "/fish$", path: "/fish", want: true},
+		{pattern: "/fish$", path: "/fishes", want: false},
+		{pattern: "/a*b*c", path: "/axxbyyc", want: true},
+		{pattern: "/a*b*c", path: "/axxcyyb", want: false},
+		{pattern: "*/private", path: "/shop/private/1", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			if got := match(tt.pattern, tt.path); got != tt.want {
+				t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	robotsTxt := `
+# Everyone else
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+
+User-agent: webgraph
+User-agent: otherbot
+Disallow: /secret # trailing comment
+Allow: /secret/page
+Disallow: /page
+Allow: /page
+`
+	robots := parse(t, robotsTxt)
+
+	tests := []struct {
+		name      string
+		userAgent string
+		rawURL    string
+		want      bool
+	}{
+		{name: "no matching rule", userAgent: "somebot", rawURL: "https://a.com/index.html", want: true},
+		{name: "wildcard disallow", userAgent: "somebot", rawURL: "https://a.com/private/1", want: false},
+		{name: "longest match wins", userAgent: "somebot", rawURL: "https://a.com/private/public/1", want: true},
+		{name: "anchored pattern", userAgent: "somebot", rawURL: "https://a.com/file.pdf", want: false},
+		{name: "query is part of the path", userAgent: "somebot", rawURL: "https://a.com/file.pdf?download=1", want: true},
+		{name: "named group replaces wildcard", userAgent: "webgraph", rawURL: "https://a.com/private/1", want: true},
+		{name: "agent is case insensitive", userAgent: "WebGraph", rawURL: "https://a.com/secret/1", want: false},
+		{name: "consecutive agents share a group", userAgent: "otherbot", rawURL: "https://a.com/secret/1", want: false},
+		{name: "named group longest match", userAgent: "webgraph", rawURL: "https://a.com/secret/page", want: true},
+		{name: "allow wins a tie", userAgent: "webgraph", rawURL: "https://a.com/page", want: true},
+		{name: "empty path is root", userAgent: "somebot", rawURL: "https://a.com", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.rawURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := robots.Allowed(tt.userAgent, u); got != tt.want {
+				t.Errorf("Allowed(%q, %s) = %v, want %v", tt.userAgent, tt.rawURL, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name         string
+		robotsTxt    string
+		userAgent    string
+		wantDelay    time.Duration
+		wantSitemaps []string
+		wantDisallow string
+	}{
+		{
+			name:         "crawl delay in fractional seconds",
+			robotsTxt:    "User-agent: *\nCrawl-delay: 1.5\nDisallow: /x",
+			userAgent:    "webgraph",
+			wantDelay:    1500 * time.Millisecond,
+			wantDisallow: "/x",
+		},
+		{
+			name:      "invalid crawl delay is ignored",
+			robotsTxt: "User-agent: *\nCrawl-delay: soon\nCrawl-delay: -1",
+			userAgent: "webgraph",
+		},
+		{
+			name:         "sitemaps apply to everyone and don't end a group",
+			robotsTxt:    "User-agent: webgraph\nSitemap: https://a.com/sitemap.xml\nUser-agent: otherbot\nDisallow: /x\nSitemap: https://a.com/news.xml",
+			userAgent:    "otherbot",
+			wantSitemaps: []string{"https://a.com/sitemap.xml", "https://a.com/news.xml"},
+			wantDisallow: "/x",
+		},
+		{
+			name:         "rules before any user agent are ignored",
+			robotsTxt:    "Disallow: /x\nUser-agent: *\nDisallow: /y",
+			userAgent:    "webgraph",
+			wantDisallow: "/y",
+		},
+		{
+			name:      "empty disallow allows everything",
+			robotsTxt: "User-agent: *\nDisallow:",
+			userAgent: "webgraph",
+		},
+		{
+			name:         "malformed lines are skipped",
+			robotsTxt:    "User-agent: *\nthis is not a rule\nDisallow: /x",
+			userAgent:    "webgraph",
+			wantDisallow: "/x",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			robots := parse(t, tt.robotsTxt)
+			if got := robots.CrawlDelay(tt.userAgent); got != tt.wantDelay {
+				t.Errorf("crawl delay %v, want %v", got, tt.wantDelay)
+			}
+			if got := robots.Sitemaps(); !reflect.DeepEqual(got, tt.wantSitemaps) {
+				t.Errorf("sitemaps %v, want %v", got, tt.wantSitemaps)
+			}
+			root := &url.URL{Scheme: "https", Host: "a.com", Path: "/"}
+			if !robots.Allowed(tt.userAgent, root) {
+				t.Errorf("/ should be allowed")
+			}
+			if tt.wantDisallow != "" {
+				u := &url.URL{Scheme: "https", Host: "a.com", Path: tt.wantDisallow}
+				if robots.Allowed(tt.userAgent, u) {
+					t.Errorf("%s should be disallowed", tt.wantDisallow)
+				}
+			}
+		})
+	}
+}
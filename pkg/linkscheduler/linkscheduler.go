@@ -0,0 +1,247 @@
+package linkscheduler
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkqueue"
+)
+
+// This is a politeness layer that sits between the queue and the worker pool,
+// making sure we don't hammer any one host with requests.
+
+// CrawlDelayFunc returns any extra delay a host has asked for between requests, such as the robots.txt Crawl-delay.
+type CrawlDelayFunc func(u *url.URL) time.Duration
+
+// RequeueFunc puts an item the scheduler can't hold back into the persistent queue, so it isn't lost.
+type RequeueFunc func(item *linkqueue.Item) error
+
+// hostState tracks the urls waiting on a host, and when we are next allowed to hit it.
+type hostState struct {
+	pending     []*linkqueue.Item
+	inFlight    int
+	nextAllowed time.Time
+}
+
+// HostScheduler defers urls for busy hosts, and releases them once the host is ready for another request.
+type HostScheduler struct {
+	minDelay       time.Duration
+	maxDelay       time.Duration
+	maxInFlight    int
+	maxPending     int
+	maxPerHost     int
+	crawlDelay     CrawlDelayFunc
+	requeue        RequeueFunc
+	hosts          map[string]*hostState
+	numPending     int
+	ready          chan *linkqueue.Item
+	done           chan struct{}
+	wg             sync.WaitGroup
+	lock           *sync.Mutex
+	tickerInterval time.Duration
+}
+
+// NewHostScheduler is a helper function for creating the HostScheduler.
+// minDelay is the minimum time between requests to the same host, which is raised by crawlDelay (capped at maxDelay).
+// maxInFlight caps concurrent requests per host, maxPending caps the total number of deferred urls,
+// and maxPerHost caps the deferred urls of any one host, so a single busy host can't fill the scheduler up.
+// Urls over either cap, and any still deferred when the scheduler is closed, are handed to requeue.
+func NewHostScheduler(
+	minDelay time.Duration,
+	maxDelay time.Duration,
+	maxInFlight int,
+	maxPending int,
+	maxPerHost int,
+	crawlDelay CrawlDelayFunc,
+	requeue RequeueFunc,
+) *HostScheduler {
+	return &HostScheduler{
+		minDelay:       minDelay,
+		maxDelay:       maxDelay,
+		maxInFlight:    maxInFlight,
+		maxPending:     maxPending,
+		maxPerHost:     maxPerHost,
+		crawlDelay:     crawlDelay,
+		requeue:        requeue,
+		hosts:          make(map[string]*hostState),
+		ready:          make(chan *linkqueue.Item),
+		done:           make(chan struct{}),
+		lock:           &sync.Mutex{},
+		tickerInterval: 50 * time.Millisecond,
+	}
+}
+
+// Start begins releasing urls onto the Ready channel.
+func (s *HostScheduler) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.tickerInterval)
+		defer ticker.Stop()
+		for {
+			for _, item := range s.collectReady() {
+				select {
+				case s.ready <- item:
+				case <-s.done:
+					return
+				}
+			}
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops releasing urls, and puts any urls still pending back into the queue.
+// The queue must still be open.
+func (s *HostScheduler) Close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	s.lock.Lock()
+	var pending []*linkqueue.Item
+	for _, host := range s.hosts {
+		pending = append(pending, host.pending...)
+	}
+	s.hosts = make(map[string]*hostState)
+	s.numPending = 0
+	s.lock.Unlock()
+
+	requeued := 0
+	for _, item := range pending {
+		if s.putBack(item) {
+			requeued++
+		}
+	}
+	if requeued > 0 {
+		log.Printf("Put %d urls waiting on their host back into the queue", requeued)
+	}
+	return nil
+}
+
+// putBack hands an item we can't hold back to the queue, returning true if it was.
+// Revisits aren't put back, they come round again once their lease on the db runs out.
+func (s *HostScheduler) putBack(item *linkqueue.Item) bool {
+	if item.Recrawl || s.requeue == nil {
+		return false
+	}
+	if err := s.requeue(item); err != nil {
+		log.Printf("Could not put %s back into the queue: %v", item.U, err)
+		return false
+	}
+	return true
+}
+
+// Ready returns the channel of items which may be fetched right now.
+func (s *HostScheduler) Ready() <-chan *linkqueue.Item {
+	return s.ready
+}
+
+// Full returns true if we should stop adding urls until some have been released.
+func (s *HostScheduler) Full() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.numPending >= s.maxPending
+}
+
+// Length returns the number of urls waiting on their host.
+func (s *HostScheduler) Length() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.numPending
+}
+
+// Add defers an item until its host is ready, returning false if there was no room for it,
+// either overall or for its host, in which case it has been put back into the queue.
+func (s *HostScheduler) Add(item *linkqueue.Item) bool {
+	if !s.hold(item) {
+		s.putBack(item)
+		return false
+	}
+	return true
+}
+
+// hold defers the item if there is room for it.
+func (s *HostScheduler) hold(item *linkqueue.Item) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.numPending >= s.maxPending {
+		return false
+	}
+	host, ok := s.hosts[item.U.Host]
+	if !ok {
+		host = &hostState{}
+		s.hosts[item.U.Host] = host
+	}
+	if len(host.pending) >= s.maxPerHost {
+		return false
+	}
+	host.pending = append(host.pending, item)
+	s.numPending++
+	return true
+}
+
+// Done must be called once an item released by the scheduler has been fetched, freeing up the host for the next request.
+func (s *HostScheduler) Done(item *linkqueue.Item) {
+	// Work out the delay outside the lock, as it may need to fetch robots.txt.
+	delay := s.delayFor(item.U)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	host, ok := s.hosts[item.U.Host]
+	if !ok {
+		return
+	}
+	host.inFlight--
+	if next := time.Now().Add(delay); next.After(host.nextAllowed) {
+		host.nextAllowed = next
+	}
+}
+
+// delayFor returns the delay to leave between requests to the host of this url.
+func (s *HostScheduler) delayFor(u *url.URL) time.Duration {
+	delay := s.minDelay
+	if s.crawlDelay != nil {
+		if d := s.crawlDelay(u); d > delay {
+			delay = d
+		}
+	}
+	if s.maxDelay > 0 && delay > s.maxDelay {
+		delay = s.maxDelay
+	}
+	return delay
+}
+
+// collectReady takes the next item from every host that is ready for another request.
+func (s *HostScheduler) collectReady() []*linkqueue.Item {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	var ready []*linkqueue.Item
+	for name, host := range s.hosts {
+		if len(host.pending) == 0 {
+			// Forget about idle hosts once their delay has passed, so the map doesn't grow forever.
+			if host.inFlight == 0 && now.After(host.nextAllowed) {
+				delete(s.hosts, name)
+			}
+			continue
+		}
+		if host.inFlight >= s.maxInFlight || now.Before(host.nextAllowed) {
+			continue
+		}
+		item := host.pending[0]
+		host.pending[0] = nil
+		host.pending = host.pending[1:]
+		s.numPending--
+		host.inFlight++
+		// Requests are spaced out by at least the minimum delay, even when several may be in flight.
+		host.nextAllowed = now.Add(s.minDelay)
+		ready = append(ready, item)
+	}
+	return ready
+}
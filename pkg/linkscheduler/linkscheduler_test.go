@@ -0,0 +1,112 @@
+package linkscheduler
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkqueue"
+)
+
+func item(t *testing.T, rawURL string) *linkqueue.Item {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &linkqueue.Item{U: u}
+}
+
+func TestAddCaps(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxPending  int
+		maxPerHost  int
+		urls        []string
+		recrawl     bool
+		wantHeld    int
+		wantPutBack int
+	}{
+		{
+			name:        "one busy host can't fill the scheduler",
+			maxPending:  10,
+			maxPerHost:  2,
+			urls:        []string{"https://a.com/1", "https://a.com/2", "https://a.com/3", "https://b.com/1"},
+			wantHeld:    3,
+			wantPutBack: 1,
+		},
+		{
+			name:        "overall cap",
+			maxPending:  2,
+			maxPerHost:  2,
+			urls:        []string{"https://a.com/1", "https://b.com/1", "https://c.com/1"},
+			wantHeld:    2,
+			wantPutBack: 1,
+		},
+		{
+			name:        "revisits aren't put back",
+			maxPending:  10,
+			maxPerHost:  1,
+			urls:        []string{"https://a.com/1", "https://a.com/2"},
+			recrawl:     true,
+			wantHeld:    1,
+			wantPutBack: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var putBack []*linkqueue.Item
+			s := NewHostScheduler(time.Second, time.Minute, 1, tt.maxPending, tt.maxPerHost, nil, func(item *linkqueue.Item) error {
+				putBack = append(putBack, item)
+				return nil
+			})
+			for _, u := range tt.urls {
+				i := item(t, u)
+				i.Recrawl = tt.recrawl
+				s.Add(i)
+			}
+			if got := s.Length(); got != tt.wantHeld {
+				t.Errorf("held %d urls, want %d", got, tt.wantHeld)
+			}
+			if len(putBack) != tt.wantPutBack {
+				t.Errorf("put back %d urls, want %d", len(putBack), tt.wantPutBack)
+			}
+		})
+	}
+}
+
+func TestClosePutsPendingBack(t *testing.T) {
+	var putBack []*linkqueue.Item
+	s := NewHostScheduler(time.Hour, time.Hour, 1, 10, 10, nil, func(item *linkqueue.Item) error {
+		putBack = append(putBack, item)
+		return nil
+	})
+	s.Add(item(t, "https://a.com/1"))
+	s.Add(item(t, "https://a.com/2"))
+	s.Add(item(t, "https://b.com/1"))
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(putBack) != 3 {
+		t.Errorf("put back %d urls, want 3", len(putBack))
+	}
+	if s.Length() != 0 {
+		t.Errorf("%d urls still pending after close", s.Length())
+	}
+}
+
+func TestReleasesOnePerHost(t *testing.T) {
+	s := NewHostScheduler(time.Hour, time.Hour, 1, 10, 10, nil, nil)
+	s.Add(item(t, "https://a.com/1"))
+	s.Add(item(t, "https://a.com/2"))
+	s.Add(item(t, "https://b.com/1"))
+
+	ready := s.collectReady()
+	if len(ready) != 2 {
+		t.Fatalf("released %d urls, want one from each host", len(ready))
+	}
+	if again := s.collectReady(); len(again) != 0 {
+		t.Errorf("released %d more urls before the hosts were ready", len(again))
+	}
+}
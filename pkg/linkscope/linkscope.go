@@ -0,0 +1,299 @@
+package linkscope
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// This is which urls we crawl, described by a scope file rather than being baked in.
+
+const (
+	// Any follows links anywhere.
+	Any = "any"
+	// Host only follows links to the seed's own host.
+	Host = "host"
+	// Domain only follows links to the seed's host and its subdomains, treating "www.example.com" as "example.com".
+	Domain = "domain"
+	// OneHop follows links anywhere from pages on the seed's domain, but only links back onto the seed's domain from anywhere else,
+	// so we find out where a site links to without wandering off across the web.
+	OneHop = "one-hop"
+)
+
+// maxCountedHosts is how many hosts we keep page counts for, the least recently crawled are forgotten first.
+const maxCountedHosts = 100000
+
+// ValidScope returns true if the scope is one we know, or empty for the default.
+func ValidScope(scope string) bool {
+	switch scope {
+	case "", Any, Host, Domain, OneHop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Rules is a scope file, every part of which is optional.
+type Rules struct {
+	// Schemes are the url schemes we crawl, http and https if not given.
+	Schemes []string `json:"schemes"`
+	// AllowHosts, if given, are the only hosts we crawl, along with their subdomains.
+	AllowHosts []string `json:"allowHosts"`
+	// DenyHosts are hosts we never crawl, along with their subdomains, even if they are allowed.
+	// If not given, link shorteners and image hosts that never have links are left out.
+	DenyHosts []string `json:"denyHosts"`
+	// AllowPaths, if given, are the only paths we crawl, and DenyPaths are paths we never crawl.
+	// Each is a glob where * matches anything, including slashes, or a regular expression if it starts with "re:".
+	AllowPaths []string `json:"allowPaths"`
+	DenyPaths  []string `json:"denyPaths"`
+	// Extensions, if given, are the only file extensions we crawl, where "" is a path without one.
+	// Otherwise every url is fetched, and anything that turns out not to be html is kept as a leaf.
+	Extensions []string `json:"extensions"`
+	// Scope is how far we go from seeds that don't say, one of Any (the default), Host, Domain or OneHop.
+	Scope string `json:"scope"`
+	// MaxPagesPerHost is how many pages we fetch from each host, or 0 for no limit.
+	// The counts are only kept in memory, so they start again from zero every time the processor restarts.
+	MaxPagesPerHost int `json:"maxPagesPerHost"`
+}
+
+// DefaultRules are what we crawl without a scope file.
+var DefaultRules = Rules{
+	Schemes:   []string{"http", "https"},
+	DenyHosts: []string{"t.co", "pbs.twimg.com"},
+}
+
+// Scope decides which urls we crawl, and which links we follow.
+type Scope struct {
+	schemes    map[string]struct{}
+	allowHosts []string
+	denyHosts  []string
+	allowPaths []*regexp.Regexp
+	denyPaths  []*regexp.Regexp
+	// extensions is nil if every extension is allowed.
+	extensions map[string]struct{}
+	scope      string
+
+	maxPagesPerHost int
+	// hostPages counts the pages fetched from each host, and is nil if there is no limit.
+	hostPages *lru.Cache
+	lock      *sync.Mutex
+}
+
+// NewScope checks the rules, filling in the defaults for anything not given.
+func NewScope(rules Rules) (*Scope, error) {
+	if rules.Schemes == nil {
+		rules.Schemes = DefaultRules.Schemes
+	}
+	if rules.DenyHosts == nil {
+		rules.DenyHosts = DefaultRules.DenyHosts
+	}
+	scope := strings.ToLower(strings.TrimSpace(rules.Scope))
+	if !ValidScope(scope) {
+		return nil, fmt.Errorf("unknown scope %q", rules.Scope)
+	}
+	if rules.MaxPagesPerHost < 0 {
+		return nil, fmt.Errorf("maxPagesPerHost can't be negative")
+	}
+
+	s := &Scope{
+		schemes:         toSet(rules.Schemes),
+		allowHosts:      normaliseHosts(rules.AllowHosts),
+		denyHosts:       normaliseHosts(rules.DenyHosts),
+		scope:           scope,
+		maxPagesPerHost: rules.MaxPagesPerHost,
+		lock:            &sync.Mutex{},
+	}
+	var err error
+	s.allowPaths, err = compilePaths(rules.AllowPaths)
+	if err != nil {
+		return nil, err
+	}
+	s.denyPaths, err = compilePaths(rules.DenyPaths)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules.Extensions) > 0 {
+		s.extensions = toSet(rules.Extensions)
+	}
+	if s.maxPagesPerHost > 0 {
+		s.hostPages, err = lru.New(maxCountedHosts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Default returns the scope we crawl without a scope file.
+func Default() *Scope {
+	s, err := NewScope(DefaultRules)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Load reads the rules in the JSON scope file.
+func Load(path string) (*Scope, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules Rules
+	decoder := json.NewDecoder(f)
+	// A misspelt rule would otherwise quietly crawl more than we meant to.
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewScope(rules)
+}
+
+func toSet(list []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(list))
+	for _, s := range list {
+		set[strings.ToLower(strings.TrimSpace(s))] = struct{}{}
+	}
+	return set
+}
+
+// normaliseHosts lowercases the hosts, and removes any leading dot, as every host matches its subdomains anyway.
+func normaliseHosts(hosts []string) []string {
+	normalised := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		host = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), ".")
+		if host != "" {
+			normalised = append(normalised, host)
+		}
+	}
+	return normalised
+}
+
+// compilePaths turns each glob or "re:" regular expression into a regular expression.
+func compilePaths(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		expr := ""
+		if strings.HasPrefix(pattern, "re:") {
+			expr = strings.TrimPrefix(pattern, "re:")
+		} else {
+			expr = "^" + strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(pattern)) + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("path pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// matchesHost returns true if the host is one of the hosts, or a subdomain of one.
+func matchesHost(host string, hosts []string) bool {
+	for _, h := range hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPath returns true if the path matches any of the patterns.
+func matchesPath(path string, patterns []*regexp.Regexp) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns true if the url is somewhere we crawl at all.
+// Urls that aren't allowed are left out of the graph entirely, rather than just not being followed.
+func (s *Scope) Allowed(u *url.URL) bool {
+	if _, ok := s.schemes[strings.ToLower(u.Scheme)]; !ok {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if matchesHost(host, s.denyHosts) {
+		return false
+	}
+	if len(s.allowHosts) > 0 && !matchesHost(host, s.allowHosts) {
+		return false
+	}
+	path := u.EscapedPath()
+	if s.extensions != nil {
+		if _, ok := s.extensions[strings.ToLower(filepath.Ext(path))]; !ok {
+			return false
+		}
+	}
+	if path == "" {
+		path = "/"
+	}
+	if matchesPath(path, s.denyPaths) {
+		return false
+	}
+	return len(s.allowPaths) == 0 || matchesPath(path, s.allowPaths)
+}
+
+// Follow returns true if a link from one page to another should be followed when crawling from the seed.
+// seedScope is the seed's own scope, or empty to use the default, and seed is nil if we don't know where the crawl started.
+func (s *Scope) Follow(seedScope string, seed, from, to *url.URL) bool {
+	if seed == nil {
+		return true
+	}
+	if seedScope == "" {
+		seedScope = s.scope
+	}
+	seedHost := strings.ToLower(seed.Hostname())
+	domain := []string{strings.TrimPrefix(seedHost, "www.")}
+	switch seedScope {
+	case Host:
+		return strings.ToLower(to.Hostname()) == seedHost
+	case Domain:
+		return matchesHost(strings.ToLower(to.Hostname()), domain)
+	case OneHop:
+		return matchesHost(strings.ToLower(to.Hostname()), domain) || from == nil || matchesHost(strings.ToLower(from.Hostname()), domain)
+	default:
+		return true
+	}
+}
+
+// HostFull returns true if we have already fetched as many pages from the url's host as we are allowed.
+func (s *Scope) HostFull(u *url.URL) bool {
+	if s.hostPages == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	count, ok := s.hostPages.Get(strings.ToLower(u.Hostname()))
+	return ok && count.(int) >= s.maxPagesPerHost
+}
+
+// ClaimPage counts a page we are about to fetch against its host, returning false if the host is already full.
+func (s *Scope) ClaimPage(u *url.URL) bool {
+	if s.hostPages == nil {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	host := strings.ToLower(u.Hostname())
+	count := 0
+	if c, ok := s.hostPages.Get(host); ok {
+		count = c.(int)
+	}
+	if count >= s.maxPagesPerHost {
+		return false
+	}
+	s.hostPages.Add(host, count+1)
+	return true
+}
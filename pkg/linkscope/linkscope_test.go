@@ -0,0 +1,175 @@
+package linkscope
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func parse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  Rules
+		rawURL string
+		want   bool
+	}{
+		{name: "default allows https", rawURL: "https://example.com/a", want: true},
+		{name: "default denies other schemes", rawURL: "ftp://example.com/a", want: false},
+		{name: "default denies link shorteners", rawURL: "https://t.co/abc", want: false},
+		{name: "scheme is case insensitive", rawURL: "HTTPS://example.com/a", want: true},
+		{name: "allowed host", rules: Rules{AllowHosts: []string{"example.com"}}, rawURL: "https://example.com/a", want: true},
+		{name: "allowed subdomain", rules: Rules{AllowHosts: []string{".Example.com"}}, rawURL: "https://blog.example.com/a", want: true},
+		{name: "not an allowed host", rules: Rules{AllowHosts: []string{"example.com"}}, rawURL: "https://notexample.com/a", want: false},
+		{
+			name:   "deny beats allow",
+			rules:  Rules{AllowHosts: []string{"example.com"}, DenyHosts: []string{"private.example.com"}},
+			rawURL: "https://private.example.com/a",
+			want:   false,
+		},
+		{name: "denied path glob", rules: Rules{DenyPaths: []string{"/admin/*"}}, rawURL: "https://example.com/admin/users/1", want: false},
+		{name: "glob is anchored", rules: Rules{DenyPaths: []string{"/admin/*"}}, rawURL: "https://example.com/x/admin/1", want: true},
+		{name: "glob single character", rules: Rules{DenyPaths: []string{"/page?"}}, rawURL: "https://example.com/page2", want: false},
+		{name: "glob dots are literal", rules: Rules{DenyPaths: []string{"/a.b"}}, rawURL: "https://example.com/axb", want: true},
+		{name: "denied path regexp", rules: Rules{DenyPaths: []string{"re:/[0-9]+$"}}, rawURL: "https://example.com/posts/123", want: false},
+		{name: "allowed path", rules: Rules{AllowPaths: []string{"/blog/*"}}, rawURL: "https://example.com/blog/post", want: true},
+		{name: "not an allowed path", rules: Rules{AllowPaths: []string{"/blog/*"}}, rawURL: "https://example.com/shop", want: false},
+		{name: "empty path is root", rules: Rules{AllowPaths: []string{"/"}}, rawURL: "https://example.com", want: true},
+		{name: "allowed extension", rules: Rules{Extensions: []string{".html", ""}}, rawURL: "https://example.com/a.HTML", want: true},
+		{name: "no extension", rules: Rules{Extensions: []string{".html", ""}}, rawURL: "https://example.com/a/b", want: true},
+		{name: "not an allowed extension", rules: Rules{Extensions: []string{".html", ""}}, rawURL: "https://example.com/a.pdf", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewScope(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Allowed(parse(t, tt.rawURL)); got != tt.want {
+				t.Errorf("Allowed(%s) = %v, want %v", tt.rawURL, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFollow(t *testing.T) {
+	tests := []struct {
+		name      string
+		defaultTo string
+		seedScope string
+		seed      string
+		from      string
+		to        string
+		want      bool
+	}{
+		{name: "any", seedScope: Any, seed: "https://example.com/", from: "https://example.com/", to: "https://other.com/", want: true},
+		{name: "default is any", seed: "https://example.com/", from: "https://example.com/", to: "https://other.com/", want: true},
+		{name: "scope file default", defaultTo: Host, seed: "https://example.com/", from: "https://example.com/", to: "https://other.com/", want: false},
+		{name: "seed overrides the default", defaultTo: Host, seedScope: Any, seed: "https://example.com/", from: "https://example.com/", to: "https://other.com/", want: true},
+		{name: "no seed", seedScope: Host, from: "https://example.com/", to: "https://other.com/", want: true},
+		{name: "host same host", seedScope: Host, seed: "https://example.com/", from: "https://example.com/", to: "https://EXAMPLE.com/a", want: true},
+		{name: "host subdomain", seedScope: Host, seed: "https://example.com/", from: "https://example.com/", to: "https://blog.example.com/", want: false},
+		{name: "domain subdomain", seedScope: Domain, seed: "https://www.example.com/", from: "https://example.com/", to: "https://blog.example.com/", want: true},
+		{name: "domain elsewhere", seedScope: Domain, seed: "https://www.example.com/", from: "https://example.com/", to: "https://other.com/", want: false},
+		{name: "one hop off the domain", seedScope: OneHop, seed: "https://example.com/", from: "https://blog.example.com/", to: "https://other.com/", want: true},
+		{name: "one hop back", seedScope: OneHop, seed: "https://example.com/", from: "https://other.com/", to: "https://example.com/a", want: true},
+		{name: "one hop no further", seedScope: OneHop, seed: "https://example.com/", from: "https://other.com/", to: "https://another.com/", want: false},
+		{name: "one hop from the seed itself", seedScope: OneHop, seed: "https://example.com/", to: "https://other.com/", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewScope(Rules{Scope: tt.defaultTo})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var seed, from *url.URL
+			if tt.seed != "" {
+				seed = parse(t, tt.seed)
+			}
+			if tt.from != "" {
+				from = parse(t, tt.from)
+			}
+			if got := s.Follow(tt.seedScope, seed, from, parse(t, tt.to)); got != tt.want {
+				t.Errorf("Follow(%q, %s, %s, %s) = %v, want %v", tt.seedScope, tt.seed, tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimPage(t *testing.T) {
+	s, err := NewScope(Rules{MaxPagesPerHost: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := parse(t, "https://a.com/1"), parse(t, "https://b.com/1")
+
+	for i, want := range []bool{true, true, false} {
+		if got := s.ClaimPage(a); got != want {
+			t.Errorf("claim %d of a.com = %v, want %v", i+1, got, want)
+		}
+	}
+	if !s.HostFull(parse(t, "https://A.com/2")) {
+		t.Errorf("a.com should be full")
+	}
+	if s.HostFull(b) || !s.ClaimPage(b) {
+		t.Errorf("b.com should have room")
+	}
+
+	unlimited := Default()
+	for i := 0; i < 10; i++ {
+		if !unlimited.ClaimPage(a) {
+			t.Fatalf("claim %d refused without a limit", i+1)
+		}
+	}
+}
+
+func TestNewScopeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules Rules
+	}{
+		{name: "unknown scope", rules: Rules{Scope: "everywhere"}},
+		{name: "negative limit", rules: Rules{MaxPagesPerHost: -1}},
+		{name: "bad regexp", rules: Rules{DenyPaths: []string{"re:("}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewScope(tt.rules); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{name: "valid", file: `{"allowHosts": ["example.com"], "scope": "domain", "maxPagesPerHost": 10}`},
+		{name: "misspelt rule", file: `{"alowHosts": ["example.com"]}`, wantErr: true},
+		{name: "not json", file: `allowHosts: example.com`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "scope.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Load(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error = %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package linkseed
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkscope"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// This is where a crawl starts from, read from a seeds file which is either a list of urls,
+// or JSON which can also say how far to crawl from each seed.
+
+// Seed is a url the crawl starts from, along with how far the crawl is allowed to go from it.
+type Seed struct {
+	U *url.URL
+	// MaxDepth is how many links from the seed we are willing to go, or 0 to use the processor's MAX_DEPTH.
+	MaxDepth int
+	// Scope limits which links are followed from the seed, one of the linkscope scopes, or empty for the crawl's default.
+	Scope string
+}
+
+// NewSeed checks and canonicalises the seed.
+func NewSeed(rawURL string, maxDepth int, scope string) (*Seed, error) {
+	u, err := linkutils.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", strings.TrimSpace(rawURL), err)
+	}
+	if maxDepth < 0 {
+		return nil, fmt.Errorf("max depth of %s can't be negative", u)
+	}
+	scope = strings.ToLower(strings.TrimSpace(scope))
+	if !linkscope.ValidScope(scope) {
+		return nil, fmt.Errorf("unknown scope %q for %s", scope, u)
+	}
+	return &Seed{
+		U:        u,
+		MaxDepth: maxDepth,
+		Scope:    scope,
+	}, nil
+}
+
+// jsonSeed is a seed as it is written in a JSON seeds file.
+type jsonSeed struct {
+	URL      string `json:"url"`
+	MaxDepth int    `json:"maxDepth"`
+	Scope    string `json:"scope"`
+}
+
+// Parse reads seeds, which are either one url per line, with blank lines and lines starting with # ignored,
+// or a JSON array of urls and objects like {"url": "https://example.com/", "maxDepth": 2, "scope": "host"}.
+// Any seed that can't be understood is an error, so a typo doesn't quietly leave a seed out.
+func Parse(r io.Reader) ([]*Seed, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		return parseJSON(bytes.NewReader(b))
+	}
+	return parseList(bytes.NewReader(b))
+}
+
+// parseList reads one url per line.
+func parseList(r io.Reader) ([]*Seed, error) {
+	var seeds []*Seed
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		seed, err := NewSeed(text, 0, "")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds, scanner.Err()
+}
+
+// parseJSON reads an array of urls and seed objects.
+func parseJSON(r io.Reader) ([]*Seed, error) {
+	var entries []json.RawMessage
+	err := json.NewDecoder(r).Decode(&entries)
+	if err != nil {
+		return nil, err
+	}
+	seeds := make([]*Seed, 0, len(entries))
+	for i, entry := range entries {
+		var s jsonSeed
+		if err = json.Unmarshal(entry, &s.URL); err != nil {
+			err = json.Unmarshal(entry, &s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("seed %d: %w", i+1, err)
+		}
+		seed, err := NewSeed(s.URL, s.MaxDepth, s.Scope)
+		if err != nil {
+			return nil, fmt.Errorf("seed %d: %w", i+1, err)
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds, nil
+}
+
+// Load reads the seeds in the file, or from stdin if the path is "-".
+func Load(path string) ([]*Seed, error) {
+	if path == "-" {
+		return Parse(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
@@ -0,0 +1,55 @@
+package linkseed
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	// want is each seed's url, max depth and scope.
+	type want struct {
+		url      string
+		maxDepth int
+		scope    string
+	}
+	tests := []struct {
+		name    string
+		seeds   string
+		want    []want
+		wantErr bool
+	}{
+		{
+			name:  "list",
+			seeds: "# Seeds\nhttps://example.com/\n\n  http://other.com/a  \n",
+			want:  []want{{url: "https://example.com/"}, {url: "http://other.com/a"}},
+		},
+		{name: "empty list", seeds: "\n# Nothing yet\n"},
+		{name: "list with a bad url", seeds: "https://example.com/\nftp://example.com/", wantErr: true},
+		{
+			name:  "json",
+			seeds: `  [ "https://example.com/", {"url": "https://other.com/", "maxDepth": 2, "scope": "Host"} ]`,
+			want:  []want{{url: "https://example.com/"}, {url: "https://other.com/", maxDepth: 2, scope: "host"}},
+		},
+		{name: "json negative depth", seeds: `[{"url": "https://example.com/", "maxDepth": -1}]`, wantErr: true},
+		{name: "json unknown scope", seeds: `[{"url": "https://example.com/", "scope": "everywhere"}]`, wantErr: true},
+		{name: "json bad url", seeds: `[{"url": "mailto:someone@example.com"}]`, wantErr: true},
+		{name: "json wrong type", seeds: `[42]`, wantErr: true},
+		{name: "broken json", seeds: `["https://example.com/"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seeds, err := Parse(strings.NewReader(tt.seeds))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error = %v", err, tt.wantErr)
+			}
+			var got []want
+			for _, seed := range seeds {
+				got = append(got, want{url: seed.U.String(), maxDepth: seed.MaxDepth, scope: seed.Scope})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
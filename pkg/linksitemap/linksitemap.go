@@ -0,0 +1,139 @@
+package linksitemap
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This is a parser for XML sitemaps and sitemap indexes, as described at https://www.sitemaps.org/protocol.html.
+
+// MaxSitemapSize is the most bytes of a sitemap we read, after decompressing it, which is the limit set by the protocol.
+const MaxSitemapSize = 50 * 1024 * 1024
+
+// DefaultPriority is the priority of a url which doesn't give one.
+const DefaultPriority = 0.5
+
+// Entry is a url listed in a sitemap.
+type Entry struct {
+	U *url.URL
+	// LastMod is when the page last changed, or zero if the sitemap doesn't say.
+	LastMod time.Time
+	// Priority is how important the page is compared to the rest of the site, from 0 to 1.
+	Priority float64
+}
+
+// Sitemap is a parsed sitemap, which is either a list of urls or an index of other sitemaps.
+type Sitemap struct {
+	URLs []Entry
+	// Sitemaps are the other sitemaps listed by a sitemap index, along with when they last changed.
+	Sitemaps []Entry
+}
+
+// xmlEntry is a <url> or <sitemap> element.
+type xmlEntry struct {
+	Loc      string `xml:"loc"`
+	LastMod  string `xml:"lastmod"`
+	Priority string `xml:"priority"`
+}
+
+// Parse reads a sitemap or sitemap index, which may be gzipped.
+// Entries which can't be understood are left out, and at most limit urls are read, or any number if limit is 0 or less.
+// Urls are resolved against base, so relative urls from broken sitemaps still work.
+func Parse(r io.Reader, base *url.URL, limit int) (*Sitemap, error) {
+	buffered := bufio.NewReader(io.LimitReader(r, MaxSitemapSize))
+	// Gzipped sitemaps are often served without saying so, so check for the gzip magic number.
+	var body io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, MaxSitemapSize)
+	}
+
+	sitemap := &Sitemap{}
+	decoder := xml.NewDecoder(body)
+	// Sitemaps are meant to be UTF-8, but if they say otherwise we do our best rather than giving up.
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	for limit <= 0 || len(sitemap.URLs) < limit {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Whatever we managed to read before the sitemap broke is still worth having.
+			if len(sitemap.URLs) > 0 || len(sitemap.Sitemaps) > 0 {
+				break
+			}
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || (start.Name.Local != "url" && start.Name.Local != "sitemap") {
+			continue
+		}
+
+		var element xmlEntry
+		if err = decoder.DecodeElement(&element, &start); err != nil {
+			continue
+		}
+		entry, ok := parseEntry(element, base)
+		if !ok {
+			continue
+		}
+		if start.Name.Local == "url" {
+			sitemap.URLs = append(sitemap.URLs, entry)
+		} else {
+			sitemap.Sitemaps = append(sitemap.Sitemaps, entry)
+		}
+	}
+	return sitemap, nil
+}
+
+// parseEntry turns the element into an entry, returning false if it doesn't have a usable url.
+func parseEntry(element xmlEntry, base *url.URL) (Entry, bool) {
+	loc := strings.TrimSpace(element.Loc)
+	if loc == "" {
+		return Entry{}, false
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return Entry{}, false
+	}
+	entry := Entry{
+		U:        base.ResolveReference(u),
+		LastMod:  parseLastMod(strings.TrimSpace(element.LastMod)),
+		Priority: DefaultPriority,
+	}
+	if priority, err := strconv.ParseFloat(strings.TrimSpace(element.Priority), 64); err == nil && priority >= 0 && priority <= 1 {
+		entry.Priority = priority
+	}
+	return entry, true
+}
+
+// lastModFormats are the W3C datetime formats a lastmod can be written in.
+var lastModFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// parseLastMod returns the time in the lastmod, or zero if it can't be understood.
+func parseLastMod(s string) time.Time {
+	for _, format := range lastModFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,103 @@
+package linksitemap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const urlset = `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>https://example.com/a</loc><lastmod>2021-03-04</lastmod><priority>0.8</priority></url>
+	<url><loc> /relative </loc><lastmod>2021-03-04T05:06:07+01:00</lastmod><priority>2</priority></url>
+	<url><lastmod>2021-03-04</lastmod></url>
+	<url><loc>https://example.com/c</loc><lastmod>whenever</lastmod></url>
+</urlset>`
+
+const index = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap><loc>https://example.com/sitemap-1.xml</loc><lastmod>2021-03</lastmod></sitemap>
+	<sitemap><loc>https://example.com/sitemap-2.xml.gz</loc></sitemap>
+</sitemapindex>`
+
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestParse(t *testing.T) {
+	base := &url.URL{Scheme: "https", Host: "example.com", Path: "/sitemap.xml"}
+	day := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+
+	// entry is the parts of an Entry we compare, so times in other zones compare by instant.
+	type entry struct {
+		url      string
+		lastMod  int64
+		priority float64
+	}
+	urls := []entry{
+		{url: "https://example.com/a", lastMod: day.Unix(), priority: 0.8},
+		{url: "https://example.com/relative", lastMod: time.Date(2021, 3, 4, 4, 6, 7, 0, time.UTC).Unix(), priority: DefaultPriority},
+		{url: "https://example.com/c", lastMod: time.Time{}.Unix(), priority: DefaultPriority},
+	}
+
+	tests := []struct {
+		name         string
+		sitemap      string
+		limit        int
+		wantURLs     []entry
+		wantSitemaps []entry
+		wantErr      bool
+	}{
+		{name: "urlset", sitemap: urlset, wantURLs: urls},
+		{name: "gzipped", sitemap: gzipped(t, urlset), wantURLs: urls},
+		{name: "limit", sitemap: urlset, limit: 2, wantURLs: urls[:2]},
+		{
+			name:    "index",
+			sitemap: index,
+			wantSitemaps: []entry{
+				{url: "https://example.com/sitemap-1.xml", lastMod: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC).Unix(), priority: DefaultPriority},
+				{url: "https://example.com/sitemap-2.xml.gz", lastMod: time.Time{}.Unix(), priority: DefaultPriority},
+			},
+		},
+		{name: "truncated keeps what was read", sitemap: urlset[:strings.Index(urlset, "<url><lastmod>")+10], wantURLs: urls[:2]},
+		{name: "not xml", sitemap: "<html><body>Not found", wantErr: true},
+		{name: "empty", sitemap: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sitemap, err := Parse(strings.NewReader(tt.sitemap), base, tt.limit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error = %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			entries := func(list []Entry) []entry {
+				var out []entry
+				for _, e := range list {
+					out = append(out, entry{url: e.U.String(), lastMod: e.LastMod.Unix(), priority: e.Priority})
+				}
+				return out
+			}
+			if got := entries(sitemap.URLs); !reflect.DeepEqual(got, tt.wantURLs) {
+				t.Errorf("urls %+v, want %+v", got, tt.wantURLs)
+			}
+			if got := entries(sitemap.Sitemaps); !reflect.DeepEqual(got, tt.wantSitemaps) {
+				t.Errorf("sitemaps %+v, want %+v", got, tt.wantSitemaps)
+			}
+		})
+	}
+}
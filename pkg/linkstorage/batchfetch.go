@@ -0,0 +1,148 @@
+package linkstorage
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jamesjarvis/massivelyconcurrentsystems/pool"
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// These are the kinds of error a fetch can fail with.
+const (
+	FetchErrorNone       = ""
+	FetchErrorDNS        = "dns"
+	FetchErrorTimeout    = "timeout"
+	FetchErrorTLS        = "tls"
+	FetchErrorConnection = "connection"
+	FetchErrorHTTPStatus = "http_status"
+	// FetchErrorBadContentType was recorded for anything that wasn't html, before those were kept as leaves.
+	FetchErrorBadContentType = "bad_content_type"
+	FetchErrorParse          = "parse"
+	// FetchErrorTooLarge is a page that was cut off at the maximum body size, whose links we may only have some of.
+	FetchErrorTooLarge = "too_large"
+	FetchErrorOther    = "other"
+)
+
+// FetchResult is the outcome of the last time we tried to fetch a page.
+type FetchResult struct {
+	U *url.URL
+	// StatusCode is 0 if we never got a response.
+	StatusCode  int
+	ContentType string
+	// MIMEType is what the response turned out to be, from its Content-Type or by sniffing the start of it.
+	// Anything other than html is a leaf in the graph, we know what it is but it has no links.
+	MIMEType      string
+	ContentLength int64
+	ResponseTime  time.Duration
+	FetchedAt     time.Time
+	ErrorClass    string
+	// FinalURL is where we ended up after following any redirects, or nil if we never got a response.
+	FinalURL *url.URL
+	// CanonicalURL is the page the document said it was a copy of, if it named one other than itself. It isn't stored.
+	CanonicalURL *url.URL
+	// Metadata is what the fetched page said about itself, or nil if it wasn't parsed. It is stored on the page rather than the fetch.
+	Metadata *PageMetadata
+
+	// ETag and LastModified are sent back on the next fetch, so the server can tell us nothing has changed.
+	ETag         string
+	LastModified string
+	// LinksHash is a hash of the pages linked to, so we can tell if they change between fetches.
+	LinksHash string
+	// RevisitInterval is how long we wait before fetching the page again, and NextFetchAt is when that will be.
+	RevisitInterval time.Duration
+	NextFetchAt     time.Time
+
+	// LinksScraped is set when every link on the page was found by this fetch,
+	// so any links we had from before which weren't found have been removed. It isn't stored.
+	LinksScraped bool
+}
+
+// LinksPage returns the page the links found by this fetch belong to,
+// which is the canonical page if the document named one, or else wherever we were redirected to.
+func (f *FetchResult) LinksPage() *url.URL {
+	if f.CanonicalURL != nil {
+		return f.CanonicalURL
+	}
+	return f.FetchedPage()
+}
+
+// FetchedPage returns the page we actually fetched, which is wherever we were redirected to.
+func (f *FetchResult) FetchedPage() *url.URL {
+	if f.FinalURL != nil {
+		return f.FinalURL
+	}
+	return f.U
+}
+
+// Unchanged returns true if the server told us the page hasn't changed since we last fetched it.
+func (f *FetchResult) Unchanged() bool {
+	return f.StatusCode == http.StatusNotModified
+}
+
+// NewFetchBatcher is a helpfer function for constructing a FetchBatcher object
+func NewFetchBatcher(s Storage, config pool.Config) (*pool.WorkDispatcher[pool.UnitOfWork[*FetchResult, bool]], error) {
+	batchWorker := func(us []pool.UnitOfWork[*FetchResult, bool]) error {
+		// The batch processing
+		// Only the latest result for each page is kept, as the insert can't touch the same row twice.
+		latest := make(map[string]int, len(us))
+		results := make([]*FetchResult, 0, len(us))
+		for _, p := range us {
+			result := p.GetRequest()
+			hash := linkutils.Hash(result.U)
+			if i, ok := latest[hash]; ok {
+				results[i] = result
+				continue
+			}
+			latest[hash] = len(results)
+			results = append(results, result)
+		}
+
+		err := s.BatchAddFetchResults(results)
+		if err != nil {
+			log.Printf("Batch adding fetch results failed!: %v", err)
+			return err
+		}
+
+		for _, result := range results {
+			// If we got an answer, any redirect we didn't follow this time has gone, from the url we asked for and from where we ended up.
+			if result.StatusCode != 0 {
+				err = s.MarkRedirectsRemoved(result.U, result.FetchedAt)
+				if err == nil && linkutils.Hash(result.FetchedPage()) != linkutils.Hash(result.U) {
+					err = s.MarkRedirectsRemoved(result.FetchedPage(), result.FetchedAt)
+				}
+				if err != nil {
+					log.Printf("Marking removed redirects failed!: %v", err)
+					return err
+				}
+			}
+			if !result.LinksScraped {
+				continue
+			}
+			err = s.MarkLinksRemoved(result.LinksPage(), result.FetchedAt)
+			if err != nil {
+				log.Printf("Marking removed links failed!: %v", err)
+				return err
+			}
+			if result.CanonicalURL == nil {
+				continue
+			}
+			// Anything the fetched page had from before it named a canonical page has gone too, apart from the edge to the canonical page.
+			err = s.MarkLinksRemoved(result.FetchedPage(), result.FetchedAt)
+			if err != nil {
+				log.Printf("Marking removed links failed!: %v", err)
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	batchDispatcher := pool.NewBatchDispatcher(
+		batchWorker,
+		config,
+	)
+	return batchDispatcher, nil
+}
@@ -1,21 +1,185 @@
 package linkstorage
 
 import (
+	"fmt"
 	"log"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/jamesjarvis/massivelyconcurrentsystems/pool"
 )
 
+// These are the kinds of edge between two pages.
+const (
+	// LinkTypeLink is a plain old link in the page.
+	LinkTypeLink = "link"
+	// LinkTypeMetaRefresh is a <meta http-equiv="refresh"> redirect.
+	LinkTypeMetaRefresh = "meta_refresh"
+	// LinkTypeCanonical is a page naming another url as the canonical version of itself,
+	// with <link rel="canonical">, a Link header or og:url.
+	LinkTypeCanonical = "canonical"
+	// LinkTypeSitemap is a sitemap listing a page, or a sitemap index listing another sitemap.
+	LinkTypeSitemap = "sitemap"
+	// LinkTypeArea is an <area> in an image map.
+	LinkTypeArea = "area"
+	// LinkTypeIframe is the page embedded by an <iframe>.
+	LinkTypeIframe = "iframe"
+	// LinkTypeFrame is the page shown in a <frame>.
+	LinkTypeFrame = "frame"
+	// LinkTypeAlternate is a <link rel="alternate">, such as a translation or a feed.
+	LinkTypeAlternate = "alternate"
+	// LinkTypeNext and LinkTypePrev are <link rel="next"> and <link rel="prev">, for pages in a series.
+	LinkTypeNext = "next"
+	LinkTypePrev = "prev"
+	// linkTypeRedirectPrefix is followed by the status code of an HTTP redirect, such as "redirect_301".
+	linkTypeRedirectPrefix = "redirect_"
+)
+
+// These are the parts of the page a link can be in, other than the main content.
+const (
+	SectionNav    = "nav"
+	SectionHeader = "header"
+	SectionFooter = "footer"
+)
+
+// linkTypePrecedence is the order of importance of the kinds of edge, after HTTP redirects which come first.
+// There is only one edge between two pages, so when a crawl sees the same link as more than one kind of edge,
+// such as a meta refresh to a page that is also linked to, the most important kind is kept.
+var linkTypePrecedence = []string{
+	LinkTypeMetaRefresh,
+	LinkTypeCanonical,
+	LinkTypeLink,
+	LinkTypeSitemap,
+	LinkTypeFrame,
+	LinkTypeIframe,
+	LinkTypeArea,
+	LinkTypeAlternate,
+	LinkTypeNext,
+	LinkTypePrev,
+}
+
+// linkTypeRank returns where the link type comes in linkTypePrecedence, where lower is more important.
+func linkTypeRank(linkType string) int {
+	if strings.HasPrefix(linkType, linkTypeRedirectPrefix) {
+		return 0
+	}
+	for i, t := range linkTypePrecedence {
+		if t == linkType {
+			return i + 1
+		}
+	}
+	return len(linkTypePrecedence) + 1
+}
+
+// linkTypeRankSQL is linkTypeRank as an SQL expression on the column.
+func linkTypeRankSQL(column string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CASE WHEN %s LIKE '%s%%' THEN 0", column, linkTypeRedirectPrefix)
+	for i, t := range linkTypePrecedence {
+		fmt.Fprintf(&b, " WHEN %s = '%s' THEN %d", column, t, i+1)
+	}
+	fmt.Fprintf(&b, " ELSE %d END", len(linkTypePrecedence)+1)
+	return b.String()
+}
+
+// replacesType returns true if a sighting of a link at seenAt, as the given type,
+// should replace the type of the link last seen at lastSeen as storedType.
+// The latest sighting wins, and within the same crawl the more important kind of edge does.
+func replacesType(seenAt, lastSeen time.Time, linkType, storedType string) bool {
+	if lastSeen.IsZero() || seenAt.After(lastSeen) {
+		return true
+	}
+	return seenAt.Equal(lastSeen) && linkTypeRank(linkType) < linkTypeRank(storedType)
+}
+
+// RedirectLinkType returns the link type of an HTTP redirect with the given status code.
+func RedirectLinkType(statusCode int) string {
+	return fmt.Sprintf("%s%d", linkTypeRedirectPrefix, statusCode)
+}
+
 // Link is a link object
 type Link struct {
 	FromU    *url.URL
 	ToU      *url.URL
 	LinkText string
+	// Texts is every distinct text the link has on the page, the first of which is LinkText.
+	Texts []string
+	// Rel is the space separated rel attribute of the link, such as "nofollow ugc".
+	Rel string
+	// Position is where the link first appears on the page, counting from 1, or 0 if it isn't on the page.
+	Position int
+	// Section is the part of the page the link is in, SectionNav, SectionHeader or SectionFooter, or empty for the main content.
+	Section string
+	// PageNofollow is set when the page the link is on asked robots not to follow any of its links.
+	// It isn't stored, as the page itself keeps track of that.
+	PageNofollow bool
+	// Type is the kind of edge this is, which defaults to LinkTypeLink if empty.
+	Type string
+	// SeenAt is when the crawl that found this link happened, which defaults to now if zero.
+	SeenAt time.Time
+}
+
+// GetSeenAt returns when the link was seen.
+func (l *Link) GetSeenAt() time.Time {
+	if l.SeenAt.IsZero() {
+		return time.Now()
+	}
+	return l.SeenAt
+}
+
+// GetType returns the kind of edge this is.
+func (l *Link) GetType() string {
+	if l.Type == "" {
+		return LinkTypeLink
+	}
+	return l.Type
+}
+
+// IsHTTPRedirect returns true if this edge is an HTTP redirect, which the http client will already have followed.
+func (l *Link) IsHTTPRedirect() bool {
+	return strings.HasPrefix(l.Type, linkTypeRedirectPrefix)
+}
+
+// IsRedirect returns true if this edge is any kind of redirect, rather than a link in the page.
+func (l *Link) IsRedirect() bool {
+	return l.IsHTTPRedirect() || l.Type == LinkTypeMetaRefresh
+}
+
+// HasRel returns true if the link has the given rel value, such as "nofollow".
+func (l *Link) HasRel(rel string) bool {
+	for _, r := range strings.Fields(l.Rel) {
+		if strings.EqualFold(r, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetTexts returns every distinct text the link has, falling back to LinkText.
+func (l *Link) GetTexts() []string {
+	if len(l.Texts) == 0 && l.LinkText != "" {
+		return []string{l.LinkText}
+	}
+	return l.Texts
+}
+
+// validTexts returns the texts with any invalid UTF-8 removed, ready for storing.
+func validTexts(texts []string) []string {
+	valid := make([]string, 0, len(texts))
+	for _, text := range texts {
+		valid = append(valid, strings.ToValidUTF8(text, ""))
+	}
+	return valid
+}
+
+// IsCanonical returns true if this edge is from a page to its canonical version.
+func (l *Link) IsCanonical() bool {
+	return l.Type == LinkTypeCanonical
 }
 
 // NewLinkBatcher is a helpfer function for constructing a LinkBatcher object
-func NewLinkBatcher(s *Storage, config pool.Config) (*pool.WorkDispatcher[pool.UnitOfWork[*Link, bool]], error) {
+func NewLinkBatcher(s Storage, config pool.Config) (*pool.WorkDispatcher[pool.UnitOfWork[*Link, bool]], error) {
 	batchWorker := func(us []pool.UnitOfWork[*Link, bool]) error {
 		// The batch processing
 		links := make([]*Link, 0, len(us))
@@ -23,7 +187,8 @@ func NewLinkBatcher(s *Storage, config pool.Config) (*pool.WorkDispatcher[pool.U
 			links = append(links, p.GetRequest())
 		}
 
-		err := s.ResilientBatchAddLinks(links)
+		// Any pages the page batcher hasn't got round to yet are added along with the links.
+		err := s.BatchAddLinks(links)
 		if err != nil {
 			log.Printf("Batch adding links failed!: %v", err)
 			return err
@@ -9,13 +9,42 @@ import (
 	"github.com/jamesjarvis/web-graph/pkg/linkutils"
 )
 
+// UnknownDepth is the depth of pages when we don't know how far they are from a seed, such as those stored before we kept track.
+const UnknownDepth = -1
+
 // Page is a page object
 type Page struct {
 	U *url.URL
+	// Depth is the number of links from a seed the page was first seen at.
+	Depth int
+	// DiscoveredFrom is the page the page was first seen on, or nil for seeds.
+	DiscoveredFrom *url.URL
+	// Seeds are the seeds the crawl reached the page from.
+	// Adding a page that already exists adds any seeds it didn't have, so a page remembers every seed that led to it.
+	Seeds []*url.URL
+	// Metadata is what the page said about itself the last time it was parsed, or nil if it never has been.
+	// It is stored along with fetch results, so adding a page leaves it alone.
+	Metadata *PageMetadata
+}
+
+// PageMetadata is what a page says about itself, so it can be shown as more than a url.
+type PageMetadata struct {
+	Title       string
+	Description string
+	// Lang is the language in <html lang>.
+	Lang string
+	// Robots is the content of any <meta name="robots"> tags.
+	Robots string
+	// H1 is the text of the first <h1>.
+	H1 string
+	// Noindex and Nofollow are set when the page asked robots not to index it or follow its links,
+	// with <meta name="robots"> or the X-Robots-Tag header.
+	Noindex  bool
+	Nofollow bool
 }
 
 // NewPageBatcher is a helpfer function for constructing a PageBatcher object
-func NewPageBatcher(s *Storage, config pool.Config) (*pool.WorkDispatcher[pool.UnitOfWork[Page, bool]], error) {
+func NewPageBatcher(s Storage, config pool.Config) (*pool.WorkDispatcher[pool.UnitOfWork[Page, bool]], error) {
 	cache, err := lru.New(100000)
 	if err != nil {
 		return nil, err
@@ -27,7 +56,8 @@ func NewPageBatcher(s *Storage, config pool.Config) (*pool.WorkDispatcher[pool.U
 
 		pages := make([]Page, 0, len(us))
 		for _, p := range us {
-			ok, _ := cache.ContainsOrAdd(linkutils.Hash(p.GetRequest().U), struct{}{})
+			// A page reached from another seed still needs adding, so it remembers that seed too.
+			ok, _ := cache.ContainsOrAdd(pageCacheKey(p.GetRequest()), struct{}{})
 			if ok {
 				continue
 			}
@@ -49,3 +79,32 @@ func NewPageBatcher(s *Storage, config pool.Config) (*pool.WorkDispatcher[pool.U
 	)
 	return batchDispatcher, nil
 }
+
+// pageCacheKey identifies the page along with the seeds it was reached from.
+func pageCacheKey(page Page) string {
+	key := linkutils.Hash(page.U)
+	for _, seed := range page.Seeds {
+		key += " " + seed.String()
+	}
+	return key
+}
+
+// addSeeds adds any of the page's seeds which aren't already in seeds, returning true if there were any.
+func addSeeds(seeds []string, page Page) ([]string, bool) {
+	added := false
+	for _, seed := range page.Seeds {
+		s := seed.String()
+		found := false
+		for _, existing := range seeds {
+			if existing == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			seeds = append(seeds, s)
+			added = true
+		}
+	}
+	return seeds, added
+}
@@ -0,0 +1,330 @@
+package linkstorage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+	"github.com/lib/pq"
+)
+
+// This is the bulk loading path for postgres, for pages, links and fetch results.
+// Rows are streamed with COPY into a temporary batch table, and then merged into the real table with a single INSERT ... SELECT,
+// so there is no limit on the batch size and no giant query to build.
+// The batch table is made in the same transaction from the columns of a staging table, and dropped when it commits,
+// so concurrent batches never see each other's rows and the staging tables themselves are never written to.
+
+func (s *PostgresStorage) pageStagingTable() string {
+	return s.PageTable + "_staging"
+}
+
+func (s *PostgresStorage) linkStagingTable() string {
+	return s.LinkTable + "_staging"
+}
+
+func (s *PostgresStorage) fetchStagingTable() string {
+	return s.FetchTable + "_staging"
+}
+
+// batchTable is the temporary table a transaction loads into, shaped like the staging table.
+func batchTable(stagingTable string) string {
+	return stagingTable + "_batch"
+}
+
+// BatchAddPages takes a batch of pages and loads them with COPY, not giving a fuck whether or not they clash.
+// Existing pages keep the first depth they were seen at, but it is filled in for pages stored before we kept track.
+// Any seeds a page didn't already have are added to it.
+func (s *PostgresStorage) BatchAddPages(pages []Page) error {
+	if len(pages) == 0 {
+		return nil
+	}
+
+	// Where a page is in the batch more than once, the shallowest one wins, but it gets the seeds of all of them.
+	merge := fmt.Sprintf(
+		`INSERT INTO %s (page_id, host, path, url, depth, discovered_from, seeds) 
+		SELECT DISTINCT ON (page_id) page_id, host, path, url, depth, discovered_from, 
+		ARRAY(SELECT DISTINCT seed FROM %s staged, unnest(staged.seeds) seed WHERE staged.page_id = batch.page_id) 
+		FROM %s batch 
+		ORDER BY page_id, depth ASC NULLS LAST 
+		%s`,
+		s.PageTable,
+		batchTable(s.pageStagingTable()),
+		batchTable(s.pageStagingTable()),
+		s.pageConflict(),
+	)
+
+	return s.copyAndMerge(
+		s.pageStagingTable(),
+		[]string{"page_id", "host", "path", "url", "depth", "discovered_from", "seeds"},
+		len(pages),
+		func(i int) []interface{} {
+			page := pages[i]
+			return []interface{}{linkutils.Hash(page.U), page.U.Hostname(), page.U.EscapedPath(), page.U.String(), depthValue(page), discoveredFromHash(page), pq.Array(seedStrings(page))}
+		},
+		merge,
+	)
+}
+
+// pageConflict is how an existing page is updated when it is added again, whether by BatchAddPages or InsertPages.
+func (s *PostgresStorage) pageConflict() string {
+	return fmt.Sprintf(
+		`ON CONFLICT (page_id) DO UPDATE SET 
+		depth = COALESCE(%s.depth, EXCLUDED.depth), 
+		discovered_from = CASE WHEN %s.depth IS NULL THEN EXCLUDED.discovered_from ELSE %s.discovered_from END, 
+		seeds = %s 
+		WHERE %s.depth IS NULL OR NOT COALESCE(%s.seeds, '{}') @> EXCLUDED.seeds`,
+		s.PageTable,
+		s.PageTable,
+		s.PageTable,
+		unionSeeds(s.PageTable+".seeds", "EXCLUDED.seeds"),
+		s.PageTable,
+		s.PageTable,
+	)
+}
+
+// unionSeeds returns the SQL for every seed in either of the two seed arrays, once each.
+func unionSeeds(a, b string) string {
+	return fmt.Sprintf(`ARRAY(SELECT DISTINCT unnest(COALESCE(%s, '{}') || COALESCE(%s, '{}')))`, a, b)
+}
+
+// BatchAddFetchResults takes a batch of fetch results and loads them with COPY, so only the latest result per page is kept.
+func (s *PostgresStorage) BatchAddFetchResults(results []*FetchResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	// Where a page was fetched more than once in the batch, the latest fetch wins.
+	merge := fmt.Sprintf(
+		`INSERT INTO %s (page_id, status, content_type, content_length, response_time_ms, fetched_at, error_class, final_url, 
+		etag, last_modified, links_hash, revisit_interval_seconds, next_fetch_at, mime_type) 
+		SELECT DISTINCT ON (page_id) page_id, status, content_type, content_length, response_time_ms, fetched_at, error_class, final_url, 
+		etag, last_modified, links_hash, revisit_interval_seconds, next_fetch_at, mime_type FROM %s 
+		ORDER BY page_id, fetched_at DESC 
+		ON CONFLICT (page_id) DO UPDATE SET 
+		status = EXCLUDED.status, 
+		content_type = EXCLUDED.content_type, 
+		content_length = EXCLUDED.content_length, 
+		response_time_ms = EXCLUDED.response_time_ms, 
+		fetched_at = EXCLUDED.fetched_at, 
+		error_class = EXCLUDED.error_class, 
+		final_url = EXCLUDED.final_url, 
+		etag = EXCLUDED.etag, 
+		last_modified = EXCLUDED.last_modified, 
+		links_hash = EXCLUDED.links_hash, 
+		revisit_interval_seconds = EXCLUDED.revisit_interval_seconds, 
+		next_fetch_at = EXCLUDED.next_fetch_at, 
+		mime_type = EXCLUDED.mime_type`,
+		s.FetchTable,
+		batchTable(s.fetchStagingTable()),
+	)
+
+	err := s.copyAndMerge(
+		s.fetchStagingTable(),
+		[]string{
+			"page_id", "status", "content_type", "content_length", "response_time_ms", "fetched_at", "error_class", "final_url",
+			"etag", "last_modified", "links_hash", "revisit_interval_seconds", "next_fetch_at", "mime_type",
+		},
+		len(results),
+		func(i int) []interface{} {
+			result := results[i]
+			var finalURL interface{}
+			if result.FinalURL != nil {
+				finalURL = result.FinalURL.String()
+			}
+			return []interface{}{
+				linkutils.Hash(result.U), result.StatusCode, strings.ToValidUTF8(result.ContentType, ""), result.ContentLength,
+				result.ResponseTime.Milliseconds(), result.FetchedAt, result.ErrorClass, finalURL,
+				strings.ToValidUTF8(result.ETag, ""), strings.ToValidUTF8(result.LastModified, ""), result.LinksHash,
+				int64(result.RevisitInterval.Seconds()), result.NextFetchAt, strings.ToValidUTF8(result.MIMEType, ""),
+			}
+		},
+		merge,
+	)
+	if err != nil {
+		return err
+	}
+
+	return s.addPageMetadata(results)
+}
+
+// addPageMetadata loads the metadata of every page parsed by the fetches with COPY, adding the pages if they haven't been added yet.
+func (s *PostgresStorage) addPageMetadata(results []*FetchResult) error {
+	var parsed []*FetchResult
+	for _, result := range results {
+		if result.Metadata != nil {
+			parsed = append(parsed, result)
+		}
+	}
+	if len(parsed) == 0 {
+		return nil
+	}
+
+	// Pages are added in page_id order, the same as BatchAddPages, so the two can't deadlock.
+	merge := fmt.Sprintf(
+		`INSERT INTO %s (page_id, host, path, url, title, description, lang, robots, h1, noindex, nofollow) 
+		SELECT DISTINCT ON (page_id) page_id, host, path, url, title, description, lang, robots, h1, noindex, nofollow FROM %s 
+		ORDER BY page_id 
+		ON CONFLICT (page_id) DO UPDATE SET 
+		title = EXCLUDED.title, description = EXCLUDED.description, lang = EXCLUDED.lang, robots = EXCLUDED.robots, h1 = EXCLUDED.h1, 
+		noindex = EXCLUDED.noindex, nofollow = EXCLUDED.nofollow`,
+		s.PageTable,
+		batchTable(s.pageStagingTable()),
+	)
+
+	return s.copyAndMerge(
+		s.pageStagingTable(),
+		[]string{"page_id", "host", "path", "url", "title", "description", "lang", "robots", "h1", "noindex", "nofollow"},
+		len(parsed),
+		func(i int) []interface{} {
+			u, metadata := parsed[i].FetchedPage(), parsed[i].Metadata
+			return []interface{}{
+				linkutils.Hash(u), u.Hostname(), u.EscapedPath(), u.String(),
+				strings.ToValidUTF8(metadata.Title, ""), strings.ToValidUTF8(metadata.Description, ""), strings.ToValidUTF8(metadata.Lang, ""),
+				strings.ToValidUTF8(metadata.Robots, ""), strings.ToValidUTF8(metadata.H1, ""),
+				metadata.Noindex, metadata.Nofollow,
+			}
+		},
+		merge,
+	)
+}
+
+// BatchAddLinks takes a batch of links and loads them with COPY, updating when existing links were last seen.
+// A link that comes back after being removed by an earlier crawl starts its history again.
+// Pages are batched separately, so any pages which haven't been added yet are added first in the same transaction,
+// which means a link can never be rejected by the foreign keys. The page batcher fills in their depth when it gets to them.
+func (s *PostgresStorage) BatchAddLinks(links []*Link) error {
+	if len(links) == 0 {
+		return nil
+	}
+
+	// Pages are added in page_id order, the same as BatchAddPages, so the two can't deadlock.
+	addPages := fmt.Sprintf(
+		`INSERT INTO %s (page_id, host, path, url) 
+		SELECT DISTINCT ON (page_id) page_id, host, path, url FROM (
+			SELECT from_page_id AS page_id, from_host AS host, from_path AS path, from_url AS url FROM %s 
+			UNION ALL 
+			SELECT to_page_id, to_host, to_path, to_url FROM %s
+		) endpoints 
+		ORDER BY page_id 
+		ON CONFLICT (page_id) DO NOTHING`,
+		s.PageTable,
+		batchTable(s.linkStagingTable()),
+		batchTable(s.linkStagingTable()),
+	)
+
+	// Where a link is in the batch more than once, the latest sighting wins, and then the most important kind of edge.
+	mergeLinks := fmt.Sprintf(
+		`INSERT INTO %s (from_page_id, to_page_id, text, link_type, first_seen, last_seen, texts, rel, position, section) 
+		SELECT DISTINCT ON (from_page_id, to_page_id) from_page_id, to_page_id, text, link_type, seen_at, seen_at, texts, rel, position, section FROM %s 
+		ORDER BY from_page_id, to_page_id, seen_at DESC, %s 
+		%s`,
+		s.LinkTable,
+		batchTable(s.linkStagingTable()),
+		linkTypeRankSQL("link_type"),
+		s.linkConflict(),
+	)
+
+	return s.copyAndMerge(
+		s.linkStagingTable(),
+		[]string{
+			"from_page_id", "to_page_id", "text", "link_type", "seen_at",
+			"from_host", "from_path", "from_url", "to_host", "to_path", "to_url",
+			"texts", "rel", "position", "section",
+		},
+		len(links),
+		func(i int) []interface{} {
+			link := links[i]
+			return []interface{}{
+				linkutils.Hash(link.FromU), linkutils.Hash(link.ToU), strings.ToValidUTF8(link.LinkText, ""), link.GetType(), link.GetSeenAt(),
+				link.FromU.Hostname(), link.FromU.EscapedPath(), link.FromU.String(),
+				link.ToU.Hostname(), link.ToU.EscapedPath(), link.ToU.String(),
+				pq.Array(validTexts(link.GetTexts())), nullString(link.Rel), positionValue(link), nullString(link.Section),
+			}
+		},
+		addPages,
+		mergeLinks,
+	)
+}
+
+// linkConflict is how an existing link is updated when it is seen again, whether by BatchAddLinks or InsertLinks.
+// The type of an existing link is replaced by the latest sighting, and then the most important kind of edge, see replacesType.
+// removed_at can be the same crawl's timestamp if MarkLinksRemoved got there first, in which case it wasn't really removed.
+func (s *PostgresStorage) linkConflict() string {
+	// The attributes of a link are whatever its latest sighting said.
+	latest := func(column string) string {
+		return fmt.Sprintf(`%s = CASE WHEN %s.last_seen IS NULL OR EXCLUDED.last_seen >= %s.last_seen THEN EXCLUDED.%s ELSE %s.%s END`,
+			column, s.LinkTable, s.LinkTable, column, s.LinkTable, column)
+	}
+
+	return fmt.Sprintf(
+		`ON CONFLICT (from_page_id, to_page_id) DO UPDATE SET 
+		first_seen = CASE WHEN %s.removed_at < EXCLUDED.last_seen THEN EXCLUDED.first_seen ELSE %s.first_seen END, 
+		link_type = CASE 
+			WHEN %s.last_seen IS NULL OR EXCLUDED.last_seen > %s.last_seen THEN EXCLUDED.link_type 
+			WHEN EXCLUDED.last_seen = %s.last_seen AND %s < %s THEN EXCLUDED.link_type 
+			ELSE %s.link_type END, 
+		%s, %s, %s, %s, 
+		last_seen = GREATEST(%s.last_seen, EXCLUDED.last_seen), 
+		removed_at = NULL`,
+		s.LinkTable,
+		s.LinkTable,
+		s.LinkTable, s.LinkTable,
+		s.LinkTable, linkTypeRankSQL("EXCLUDED.link_type"), linkTypeRankSQL(s.LinkTable+".link_type"),
+		s.LinkTable,
+		latest("texts"), latest("rel"), latest("position"), latest("section"),
+		s.LinkTable,
+	)
+}
+
+// copyAndMerge copies n rows into a batch table shaped like the staging table, and runs the merge queries in order.
+// The batch table only lives as long as the transaction, so nothing is left behind to clean up, even when the merge fails.
+func (s *PostgresStorage) copyAndMerge(stagingTable string, columns []string, n int, row func(i int) []interface{}, merges ...string) error {
+	txn, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	batch := batchTable(stagingTable)
+	_, err = txn.Exec(fmt.Sprintf(`CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP`, batch, stagingTable))
+	if err != nil {
+		return err
+	}
+
+	err = copyRows(txn, batch, columns, n, row)
+	if err != nil {
+		return err
+	}
+
+	for _, merge := range merges {
+		if _, err = txn.Exec(merge); err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit()
+}
+
+// copyRows streams n rows into the table with COPY.
+func copyRows(txn *sql.Tx, table string, columns []string, n int, row func(i int) []interface{}) error {
+	stmt, err := txn.Prepare(pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		if _, err = stmt.Exec(row(i)...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+
+	// An empty Exec flushes everything buffered so far.
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+
+	return stmt.Close()
+}
@@ -0,0 +1,157 @@
+package linkstorage
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// benchSchema is the scratch schema the benchmarks work in, so it is safe to point them at the real database.
+const benchSchema = "web_graph_bench"
+
+// openBenchStorage sets up the tables in the scratch schema, which is dropped again once the benchmark is done, however it ends.
+func openBenchStorage(b *testing.B) (*PostgresStorage, *sql.DB) {
+	b.Helper()
+	if os.Getenv("POSTGRES_HOST") == "" {
+		b.Skip("set POSTGRES_HOST, POSTGRES_USER, POSTGRES_PASSWORD and POSTGRES_DB to benchmark against postgres")
+	}
+	uri := fmt.Sprintf(
+		"postgres://%s:%s@%s:5432/%s?sslmode=disable",
+		os.Getenv("POSTGRES_USER"),
+		os.Getenv("POSTGRES_PASSWORD"),
+		os.Getenv("POSTGRES_HOST"),
+		os.Getenv("POSTGRES_DB"),
+	)
+
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		b.Fatalf("Failed to connect to postgres: %v", err)
+	}
+	b.Cleanup(func() { db.Close() })
+	_, err = db.Exec(fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS %s`, benchSchema))
+	if err != nil {
+		b.Fatalf("Failed to create the bench schema: %v", err)
+	}
+	b.Cleanup(func() {
+		_, err := db.Exec(fmt.Sprintf(`DROP SCHEMA %s CASCADE`, benchSchema))
+		if err != nil {
+			b.Errorf("Failed to drop the bench schema: %v", err)
+		}
+	})
+
+	storage, err := NewPostgresStorage(uri+"&search_path="+benchSchema, "pages_visited", "links_visited", "page_fetches")
+	if err != nil {
+		b.Fatalf("Failed to set up the bench schema: %v", err)
+	}
+	b.Cleanup(func() { storage.Close() })
+	return storage, db
+}
+
+// benchSeed is the seed every bench page was reached from, so the seeds are written too.
+var benchSeed = &url.URL{Scheme: "https", Host: "seed.example.com", Path: "/"}
+
+// benchPages returns a batch of pages, which are different for every batch number.
+func benchPages(batch, size int) []Page {
+	pages := make([]Page, size)
+	for i := range pages {
+		pages[i] = Page{
+			U: &url.URL{
+				Scheme: "https",
+				Host:   fmt.Sprintf("host%d.example.com", i%100),
+				Path:   fmt.Sprintf("/batch/%d/page/%d", batch, i),
+			},
+			Depth: 1,
+			Seeds: []*url.URL{benchSeed},
+		}
+	}
+	return pages
+}
+
+// benchLinks returns a link from each page to the next, with every attribute a link can have.
+func benchLinks(pages []Page, seenAt time.Time) []*Link {
+	links := make([]*Link, len(pages))
+	for i := range links {
+		links[i] = &Link{
+			FromU:    pages[i].U,
+			ToU:      pages[(i+1)%len(pages)].U,
+			LinkText: "some link text",
+			Texts:    []string{"some link text", "some other link text"},
+			Rel:      "nofollow",
+			Position: i%50 + 1,
+			Section:  SectionNav,
+			Type:     LinkTypeLink,
+			SeenAt:   seenAt,
+		}
+	}
+	return links
+}
+
+// BenchmarkBatchWrites compares writing pages and links with the old multi-VALUES INSERT against the COPY path.
+// Run it with: go test ./pkg/linkstorage -run '^$' -bench BatchWrites
+func BenchmarkBatchWrites(b *testing.B) {
+	storage, db := openBenchStorage(b)
+
+	writers := []struct {
+		name  string
+		pages func([]Page) error
+		links func([]*Link) error
+		// maxSize is the biggest batch the writer can take, or 0 for no limit.
+		maxSize int
+	}{
+		{name: "insert", pages: storage.InsertPages, links: storage.InsertLinks, maxSize: maxQueryParams / insertLinkColumns},
+		{name: "copy", pages: storage.BatchAddPages, links: storage.BatchAddLinks},
+	}
+
+	for _, size := range []int{100, 1000, 5000, 20000} {
+		for _, w := range writers {
+			if w.maxSize > 0 && size > w.maxSize {
+				continue
+			}
+			// Every run starts from empty tables, so no path is penalised for another's rows.
+			empty := func(b *testing.B) {
+				b.Helper()
+				_, err := db.Exec(fmt.Sprintf(`TRUNCATE %s.links_visited, %s.pages_visited`, benchSchema, benchSchema))
+				if err != nil {
+					b.Fatalf("Failed to empty the bench tables: %v", err)
+				}
+			}
+
+			b.Run(fmt.Sprintf("pages/%s/%d", w.name, size), func(b *testing.B) {
+				empty(b)
+				var took time.Duration
+				for n := 0; n < b.N; n++ {
+					pages := benchPages(n, size)
+					start := time.Now()
+					if err := w.pages(pages); err != nil {
+						b.Fatal(err)
+					}
+					took += time.Since(start)
+				}
+				b.ReportMetric(float64(size*b.N)/took.Seconds(), "rows/s")
+			})
+
+			b.Run(fmt.Sprintf("links/%s/%d", w.name, size), func(b *testing.B) {
+				empty(b)
+				seenAt := time.Now()
+				var took time.Duration
+				for n := 0; n < b.N; n++ {
+					// The insert path needs the pages to be there already, so they are written first for both.
+					pages := benchPages(n, size)
+					if err := w.pages(pages); err != nil {
+						b.Fatal(err)
+					}
+					links := benchLinks(pages, seenAt)
+					start := time.Now()
+					if err := w.links(links); err != nil {
+						b.Fatal(err)
+					}
+					took += time.Since(start)
+				}
+				b.ReportMetric(float64(size*b.N)/took.Seconds(), "rows/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,828 @@
+package linkstorage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// This is an embedded storage backend on top of leveldb, so a single machine crawl doesn't need a postgres server.
+// Everything lives under a few key prefixes:
+//   p/<page>          the page
+//   h/<host>/<page>   pages by host
+//   l/<from>/<to>     the link
+//   r/<to>/<from>     links by the page they point to
+//   f/<page>          the last fetch result
+//   n/<time>/<page>   pages by when they are next due a fetch
+//   c/pages, c/links  how many pages and links there are
+//   m/url_identity    the url identity the graph was built with
+
+const (
+	prefixPage    = "p/"
+	prefixHost    = "h/"
+	prefixLink    = "l/"
+	prefixLinkTo  = "r/"
+	prefixFetch   = "f/"
+	prefixNextDue = "n/"
+	keyPageCount  = "c/pages"
+	keyLinkCount  = "c/links"
+	keyIdentity   = "m/url_identity"
+)
+
+// levelDBPage is how a page is stored, the depth is nil if we don't know it.
+type levelDBPage struct {
+	URL            string `json:"url"`
+	Depth          *int   `json:"depth,omitempty"`
+	DiscoveredFrom string `json:"discovered_from,omitempty"`
+	// Metadata is nil for pages which have never been parsed.
+	Metadata *levelDBMetadata `json:"metadata,omitempty"`
+	Seeds    []string         `json:"seeds,omitempty"`
+}
+
+// levelDBMetadata is how the metadata of a page is stored.
+type levelDBMetadata struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Lang        string `json:"lang"`
+	Robots      string `json:"robots"`
+	H1          string `json:"h1"`
+	Noindex     bool   `json:"noindex,omitempty"`
+	Nofollow    bool   `json:"nofollow,omitempty"`
+}
+
+// levelDBLink is how a link is stored, the times are nil for links we don't know the history of.
+type levelDBLink struct {
+	Text      string     `json:"text"`
+	Type      string     `json:"type"`
+	Texts     []string   `json:"texts,omitempty"`
+	Rel       string     `json:"rel,omitempty"`
+	Position  int        `json:"position,omitempty"`
+	Section   string     `json:"section,omitempty"`
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	RemovedAt *time.Time `json:"removed_at,omitempty"`
+}
+
+// levelDBFetch is how a fetch result is stored.
+type levelDBFetch struct {
+	URL             string        `json:"url"`
+	StatusCode      int           `json:"status"`
+	ContentType     string        `json:"content_type"`
+	MIMEType        string        `json:"mime_type,omitempty"`
+	ContentLength   int64         `json:"content_length"`
+	ResponseTime    time.Duration `json:"response_time"`
+	FetchedAt       time.Time     `json:"fetched_at"`
+	ErrorClass      string        `json:"error_class"`
+	FinalURL        string        `json:"final_url,omitempty"`
+	ETag            string        `json:"etag,omitempty"`
+	LastModified    string        `json:"last_modified,omitempty"`
+	LinksHash       string        `json:"links_hash,omitempty"`
+	RevisitInterval time.Duration `json:"revisit_interval"`
+	NextFetchAt     time.Time     `json:"next_fetch_at"`
+}
+
+// LevelDBStorage implements an embedded storage backend, kept in a directory on disk.
+type LevelDBStorage struct {
+	DataDir string
+	db      *leveldb.DB
+	// lock is held for anything that reads and then writes, as leveldb doesn't do transactions.
+	lock *sync.Mutex
+}
+
+// NewLevelDBStorage is a wrapper for easily creating a leveldb storage object in dataDir.
+func NewLevelDBStorage(dataDir string) (*LevelDBStorage, error) {
+	db, err := leveldb.OpenFile(dataDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDBStorage{
+		DataDir: dataDir,
+		db:      db,
+		lock:    &sync.Mutex{},
+	}, nil
+}
+
+// CheckURLIdentity makes sure the graph is only used with one url identity, see linkcanon.PolicyByName.
+// Page ids depend on it and a leveldb graph can't be rehashed, so the graph stays with the identity it was first opened with.
+// Graphs from before the identity was recorded are taken to be using the one they are opened with now.
+func (s *LevelDBStorage) CheckURLIdentity(name string) error {
+	if name == "" {
+		name = "legacy"
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var stored string
+	ok, err := s.getJSON(keyIdentity, &stored)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		batch := new(leveldb.Batch)
+		err = putJSON(batch, keyIdentity, name)
+		if err != nil {
+			return err
+		}
+		return s.db.Write(batch, nil)
+	}
+	if stored != name {
+		return fmt.Errorf("the graph in %s uses the url identity %q, not %q, and leveldb graphs can't be rehashed, so start a new graph somewhere else to change it",
+			s.DataDir, stored, name)
+	}
+	return nil
+}
+
+// Close closes the database.
+func (s *LevelDBStorage) Close() error {
+	return s.db.Close()
+}
+
+// getJSON reads the value at key into v, returning false if there isn't one.
+func (s *LevelDBStorage) getJSON(key string, v interface{}) (bool, error) {
+	b, err := s.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(b, v)
+}
+
+// putJSON adds v to the batch at key.
+func putJSON(batch *leveldb.Batch, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(key), b)
+	return nil
+}
+
+// getCount reads one of the counters.
+func (s *LevelDBStorage) getCount(key string) (int, error) {
+	b, err := s.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, errors.New("corrupt counter " + key)
+	}
+	return int(binary.BigEndian.Uint64(b)), nil
+}
+
+// addCount adds the new value of one of the counters to the batch.
+func (s *LevelDBStorage) addCount(batch *leveldb.Batch, key string, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	count, err := s.getCount(key)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(count+delta))
+	batch.Put([]byte(key), b)
+	return nil
+}
+
+// scanKeys returns the last part of up to limit keys with this prefix.
+// A limit of 0 or less means no limit.
+func (s *LevelDBStorage) scanKeys(prefix string, limit int, keep func(suffix string) (bool, error)) ([]string, error) {
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	var suffixes []string
+	for iter.Next() {
+		if limit > 0 && len(suffixes) >= limit {
+			break
+		}
+		suffix := strings.TrimPrefix(string(iter.Key()), prefix)
+		if keep != nil {
+			ok, err := keep(suffix)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		suffixes = append(suffixes, suffix)
+	}
+	return suffixes, iter.Error()
+}
+
+// CheckPageExists checks that the page exists in the visited database
+func (s *LevelDBStorage) CheckPageExists(u *url.URL) (bool, error) {
+	return s.db.Has([]byte(prefixPage+linkutils.Hash(u)), nil)
+}
+
+// GetPage retrieves info about the page hash if it exists.
+func (s *LevelDBStorage) GetPage(pageHash string) (*Page, error) {
+	var stored levelDBPage
+	ok, err := s.getJSON(prefixPage+pageHash, &stored)
+	if err != nil || !ok {
+		return nil, err
+	}
+	u, err := url.Parse(stored.URL)
+	if err != nil {
+		return nil, err
+	}
+	page := &Page{
+		U:     u,
+		Depth: UnknownDepth,
+	}
+	if stored.Depth != nil {
+		page.Depth = *stored.Depth
+	}
+	for _, seed := range stored.Seeds {
+		if u, err := url.Parse(seed); err == nil {
+			page.Seeds = append(page.Seeds, u)
+		}
+	}
+	if stored.Metadata != nil {
+		page.Metadata = &PageMetadata{
+			Title:       stored.Metadata.Title,
+			Description: stored.Metadata.Description,
+			Lang:        stored.Metadata.Lang,
+			Robots:      stored.Metadata.Robots,
+			H1:          stored.Metadata.H1,
+			Noindex:     stored.Metadata.Noindex,
+			Nofollow:    stored.Metadata.Nofollow,
+		}
+	}
+	if stored.DiscoveredFrom != "" {
+		var from levelDBPage
+		ok, err = s.getJSON(prefixPage+stored.DiscoveredFrom, &from)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			page.DiscoveredFrom, err = url.Parse(from.URL)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return page, nil
+}
+
+// GetPageHashesFromHost retrieves the page hashes of all pages with this host.
+func (s *LevelDBStorage) GetPageHashesFromHost(host string, limit int, includeNoindex bool) ([]string, error) {
+	if includeNoindex {
+		return s.scanKeys(prefixHost+host+"/", limit, nil)
+	}
+	return s.scanKeys(prefixHost+host+"/", limit, s.indexed)
+}
+
+// indexed returns true unless the page asked not to be indexed.
+func (s *LevelDBStorage) indexed(hash string) (bool, error) {
+	var stored levelDBPage
+	ok, err := s.getJSON(prefixPage+hash, &stored)
+	if err != nil || !ok {
+		return ok, err
+	}
+	return stored.Metadata == nil || !stored.Metadata.Noindex, nil
+}
+
+// AddPage first checks that it does not exist, and then inserts the page
+func (s *LevelDBStorage) AddPage(page *Page) error {
+	return s.BatchAddPages([]Page{*page})
+}
+
+// BatchAddPages takes a batch of pages and inserts them.
+// Existing pages keep the first depth they were seen at, unless they didn't know it.
+func (s *LevelDBStorage) BatchAddPages(pages []Page) error {
+	if len(pages) == 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	batch := new(leveldb.Batch)
+	err := s.addPages(batch, pages)
+	if err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+// addPages adds the pages to the batch, it must be called with the lock held.
+func (s *LevelDBStorage) addPages(batch *leveldb.Batch, pages []Page) error {
+	// A page can be in the batch more than once, so later pages need to see the earlier ones.
+	pending := make(map[string]*levelDBPage, len(pages))
+	var added int
+	for _, page := range pages {
+		hash := linkutils.Hash(page.U)
+		stored, ok := pending[hash]
+		changed := false
+		if !ok {
+			stored = &levelDBPage{}
+			exists, err := s.getJSON(prefixPage+hash, stored)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				added++
+				batch.Put([]byte(prefixHost+page.U.Hostname()+"/"+hash), nil)
+				stored.URL = page.U.String()
+				if page.DiscoveredFrom != nil {
+					stored.DiscoveredFrom = linkutils.Hash(page.DiscoveredFrom)
+				}
+				changed = true
+			}
+			pending[hash] = stored
+		}
+		if stored.Depth == nil && page.Depth != UnknownDepth {
+			depth := page.Depth
+			stored.Depth = &depth
+			stored.DiscoveredFrom = ""
+			if page.DiscoveredFrom != nil {
+				stored.DiscoveredFrom = linkutils.Hash(page.DiscoveredFrom)
+			}
+			changed = true
+		}
+		var seedsAdded bool
+		stored.Seeds, seedsAdded = addSeeds(stored.Seeds, page)
+		if !changed && !seedsAdded {
+			continue
+		}
+		err := putJSON(batch, prefixPage+hash, stored)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.addCount(batch, keyPageCount, added)
+}
+
+// CountPages retrieves the number of pages scraped.
+func (s *LevelDBStorage) CountPages() (int, error) {
+	return s.getCount(keyPageCount)
+}
+
+// CheckLinkExists checks that the link exists in the visited database
+func (s *LevelDBStorage) CheckLinkExists(fromU *url.URL, toU *url.URL) (bool, error) {
+	return s.db.Has([]byte(prefixLink+linkutils.Hash(fromU)+"/"+linkutils.Hash(toU)), nil)
+}
+
+// getLink reads the link between the two page hashes, returning nil if there isn't one.
+func (s *LevelDBStorage) getLink(fromHash, toHash string) (*levelDBLink, error) {
+	var stored levelDBLink
+	ok, err := s.getJSON(prefixLink+fromHash+"/"+toHash, &stored)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// setAttributes copies the attributes of the link as it was last seen.
+func (l *levelDBLink) setAttributes(link *Link) {
+	l.Texts = validTexts(link.GetTexts())
+	l.Rel = link.Rel
+	l.Position = link.Position
+	l.Section = link.Section
+}
+
+// current returns true if the link hasn't been removed.
+func (l *levelDBLink) current() bool {
+	return l.RemovedAt == nil
+}
+
+// existedAt returns true if the link was there at the given time.
+func (l *levelDBLink) existedAt(at time.Time) bool {
+	return (l.FirstSeen == nil || !l.FirstSeen.After(at)) && (l.RemovedAt == nil || l.RemovedAt.After(at))
+}
+
+// GetLinksFrom retrieves the current links from this page hash.
+func (s *LevelDBStorage) GetLinksFrom(pageHash string, limit int, includeNoindex bool) ([]string, error) {
+	return s.scanKeys(prefixLink+pageHash+"/", limit, func(toHash string) (bool, error) {
+		link, err := s.getLink(pageHash, toHash)
+		if err != nil || link == nil || !link.current() {
+			return false, err
+		}
+		if includeNoindex {
+			return true, nil
+		}
+		return s.indexed(toHash)
+	})
+}
+
+// GetLinksFromAsOf retrieves the links from this page hash as they were at the given time.
+func (s *LevelDBStorage) GetLinksFromAsOf(pageHash string, at time.Time, limit int, includeNoindex bool) ([]string, error) {
+	return s.scanKeys(prefixLink+pageHash+"/", limit, func(toHash string) (bool, error) {
+		link, err := s.getLink(pageHash, toHash)
+		if err != nil || link == nil || !link.existedAt(at) {
+			return false, err
+		}
+		if includeNoindex {
+			return true, nil
+		}
+		return s.indexed(toHash)
+	})
+}
+
+// GetLinksTo retrieves the current links to this page hash.
+func (s *LevelDBStorage) GetLinksTo(pageHash string, limit int, includeNoindex bool) ([]string, error) {
+	return s.scanKeys(prefixLinkTo+pageHash+"/", limit, func(fromHash string) (bool, error) {
+		link, err := s.getLink(fromHash, pageHash)
+		if err != nil || link == nil || !link.current() {
+			return false, err
+		}
+		if includeNoindex {
+			return true, nil
+		}
+		return s.indexed(fromHash)
+	})
+}
+
+// GetLinksToAsOf retrieves the links to this page hash as they were at the given time.
+func (s *LevelDBStorage) GetLinksToAsOf(pageHash string, at time.Time, limit int, includeNoindex bool) ([]string, error) {
+	return s.scanKeys(prefixLinkTo+pageHash+"/", limit, func(fromHash string) (bool, error) {
+		link, err := s.getLink(fromHash, pageHash)
+		if err != nil || link == nil || !link.existedAt(at) {
+			return false, err
+		}
+		if includeNoindex {
+			return true, nil
+		}
+		return s.indexed(fromHash)
+	})
+}
+
+// GetRedirect retrieves the page hash this page currently redirects to, or an empty string if it doesn't redirect.
+func (s *LevelDBStorage) GetRedirect(pageHash string) (string, error) {
+	var redirect string
+	var latest *levelDBLink
+	_, err := s.scanKeys(prefixLink+pageHash+"/", 0, func(toHash string) (bool, error) {
+		link, err := s.getLink(pageHash, toHash)
+		if err != nil || link == nil || !link.current() {
+			return false, err
+		}
+		if !strings.HasPrefix(link.Type, linkTypeRedirectPrefix) && link.Type != LinkTypeMetaRefresh {
+			return false, nil
+		}
+		if latest == nil || latest.LastSeen == nil || (link.LastSeen != nil && link.LastSeen.After(*latest.LastSeen)) {
+			redirect, latest = toHash, link
+		}
+		return false, nil
+	})
+	return redirect, err
+}
+
+// GetCanonical retrieves the page hash this page currently says is its canonical version, or an empty string if it doesn't name one.
+func (s *LevelDBStorage) GetCanonical(pageHash string) (string, error) {
+	hashes, err := s.scanKeys(prefixLink+pageHash+"/", 1, func(toHash string) (bool, error) {
+		link, err := s.getLink(pageHash, toHash)
+		if err != nil || link == nil {
+			return false, err
+		}
+		return link.Type == LinkTypeCanonical && link.current(), nil
+	})
+	if err != nil || len(hashes) == 0 {
+		return "", err
+	}
+	return hashes[0], nil
+}
+
+// AddLink first checks that it does not exist, and then inserts the link along with its pages
+func (s *LevelDBStorage) AddLink(link *Link) error {
+	visited, err := s.CheckLinkExists(link.FromU, link.ToU)
+	if err != nil || visited {
+		return err
+	}
+	return s.BatchAddLinks([]*Link{link})
+}
+
+// BatchAddLinks takes a batch of links and inserts them, updating when existing links were last seen.
+// A link that comes back after being removed by an earlier crawl starts its history again.
+// Any pages which haven't been added yet are added along with the links.
+func (s *LevelDBStorage) BatchAddLinks(links []*Link) error {
+	if len(links) == 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	batch := new(leveldb.Batch)
+	pages := make([]Page, 0, 2*len(links))
+	for _, link := range links {
+		pages = append(pages, Page{U: link.FromU, Depth: UnknownDepth}, Page{U: link.ToU, Depth: UnknownDepth})
+	}
+	err := s.addPages(batch, pages)
+	if err != nil {
+		return err
+	}
+
+	// pending holds the links written by this batch, so a link that is in the batch more than once sees its earlier sightings.
+	pending := make(map[[2]string]*levelDBLink, len(links))
+	var added int
+	for _, link := range links {
+		fromHash, toHash := linkutils.Hash(link.FromU), linkutils.Hash(link.ToU)
+		seenAt := link.GetSeenAt()
+		stored, ok := pending[[2]string{fromHash, toHash}]
+		if !ok {
+			stored, err = s.getLink(fromHash, toHash)
+			if err != nil {
+				return err
+			}
+		}
+		if stored == nil {
+			added++
+			batch.Put([]byte(prefixLinkTo+toHash+"/"+fromHash), nil)
+			stored = &levelDBLink{
+				Text:      strings.ToValidUTF8(link.LinkText, ""),
+				Type:      link.GetType(),
+				FirstSeen: &seenAt,
+				LastSeen:  &seenAt,
+			}
+			stored.setAttributes(link)
+			pending[[2]string{fromHash, toHash}] = stored
+			continue
+		}
+		pending[[2]string{fromHash, toHash}] = stored
+
+		// removed_at can be the same crawl's timestamp if MarkLinksRemoved got there first, in which case it wasn't really removed.
+		if stored.RemovedAt != nil && stored.RemovedAt.Before(seenAt) {
+			stored.FirstSeen = &seenAt
+		}
+		var lastSeen time.Time
+		if stored.LastSeen != nil {
+			lastSeen = *stored.LastSeen
+		}
+		if replacesType(seenAt, lastSeen, link.GetType(), stored.Type) {
+			stored.Type = link.GetType()
+		}
+		// The attributes of a link are whatever its latest sighting said.
+		if stored.LastSeen == nil || !stored.LastSeen.After(seenAt) {
+			stored.LastSeen = &seenAt
+			stored.setAttributes(link)
+		}
+		stored.RemovedAt = nil
+	}
+	for key, stored := range pending {
+		err = putJSON(batch, prefixLink+key[0]+"/"+key[1], stored)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.addCount(batch, keyLinkCount, added)
+	if err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+// MarkLinksRemoved marks every link on the page which wasn't seen by the crawl at seenAt as removed.
+// HTTP redirects aren't on the page, so they are left alone.
+func (s *LevelDBStorage) MarkLinksRemoved(fromU *url.URL, seenAt time.Time) error {
+	return s.markRemoved(fromU, seenAt, false)
+}
+
+// MarkRedirectsRemoved marks every HTTP redirect from the page which wasn't followed by the crawl at seenAt as removed.
+func (s *LevelDBStorage) MarkRedirectsRemoved(fromU *url.URL, seenAt time.Time) error {
+	return s.markRemoved(fromU, seenAt, true)
+}
+
+// markRemoved marks either the HTTP redirects or the links on the page which weren't seen at seenAt as removed.
+func (s *LevelDBStorage) markRemoved(fromU *url.URL, seenAt time.Time, redirects bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fromHash := linkutils.Hash(fromU)
+	batch := new(leveldb.Batch)
+	_, err := s.scanKeys(prefixLink+fromHash+"/", 0, func(toHash string) (bool, error) {
+		link, err := s.getLink(fromHash, toHash)
+		if err != nil || link == nil {
+			return false, err
+		}
+		if !link.current() || strings.HasPrefix(link.Type, linkTypeRedirectPrefix) != redirects {
+			return false, nil
+		}
+		if link.LastSeen != nil && !link.LastSeen.Before(seenAt) {
+			return false, nil
+		}
+		link.RemovedAt = &seenAt
+		return false, putJSON(batch, prefixLink+fromHash+"/"+toHash, link)
+	})
+	if err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+// CountLinks retrieves the number of links scraped.
+func (s *LevelDBStorage) CountLinks() (int, error) {
+	return s.getCount(keyLinkCount)
+}
+
+// nextDueKey is the key which orders pages by when they are next due a fetch.
+func nextDueKey(at time.Time, pageHash string) []byte {
+	// Anything from before 1970 is long overdue.
+	var nanos uint64
+	if at.After(time.Unix(0, 0)) {
+		nanos = uint64(at.UnixNano())
+	}
+	key := make([]byte, len(prefixNextDue)+8, len(prefixNextDue)+8+1+len(pageHash))
+	copy(key, prefixNextDue)
+	binary.BigEndian.PutUint64(key[len(prefixNextDue):], nanos)
+	key = append(key, '/')
+	return append(key, pageHash...)
+}
+
+// BatchAddFetchResults takes a batch of fetch results and stores them, so only the latest result per page is kept.
+func (s *LevelDBStorage) BatchAddFetchResults(results []*FetchResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	batch := new(leveldb.Batch)
+	for _, result := range results {
+		hash := linkutils.Hash(result.U)
+		var previous levelDBFetch
+		ok, err := s.getJSON(prefixFetch+hash, &previous)
+		if err != nil {
+			return err
+		}
+		if ok {
+			batch.Delete(nextDueKey(previous.NextFetchAt, hash))
+		}
+
+		stored := levelDBFetch{
+			URL:             result.U.String(),
+			StatusCode:      result.StatusCode,
+			ContentType:     result.ContentType,
+			MIMEType:        result.MIMEType,
+			ContentLength:   result.ContentLength,
+			ResponseTime:    result.ResponseTime,
+			FetchedAt:       result.FetchedAt,
+			ErrorClass:      result.ErrorClass,
+			ETag:            result.ETag,
+			LastModified:    result.LastModified,
+			LinksHash:       result.LinksHash,
+			RevisitInterval: result.RevisitInterval,
+			NextFetchAt:     result.NextFetchAt,
+		}
+		if result.FinalURL != nil {
+			stored.FinalURL = result.FinalURL.String()
+		}
+		err = putJSON(batch, prefixFetch+hash, stored)
+		if err != nil {
+			return err
+		}
+		batch.Put(nextDueKey(stored.NextFetchAt, hash), nil)
+	}
+
+	err := s.addPageMetadata(batch, results)
+	if err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+// addPageMetadata adds the metadata of every page parsed by the fetches to the batch, adding the pages if they haven't been added yet.
+// It must be called with the lock held.
+func (s *LevelDBStorage) addPageMetadata(batch *leveldb.Batch, results []*FetchResult) error {
+	// A page can be in the batch more than once, so later results need to see the earlier ones.
+	pending := make(map[string]*levelDBPage)
+	var added int
+	for _, result := range results {
+		if result.Metadata == nil {
+			continue
+		}
+		u := result.FetchedPage()
+		hash := linkutils.Hash(u)
+		stored, ok := pending[hash]
+		if !ok {
+			stored = &levelDBPage{}
+			exists, err := s.getJSON(prefixPage+hash, stored)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				stored.URL = u.String()
+				batch.Put([]byte(prefixHost+u.Hostname()+"/"+hash), nil)
+				added++
+			}
+			pending[hash] = stored
+		}
+		stored.Metadata = &levelDBMetadata{
+			Title:       result.Metadata.Title,
+			Description: result.Metadata.Description,
+			Lang:        result.Metadata.Lang,
+			Robots:      result.Metadata.Robots,
+			H1:          result.Metadata.H1,
+			Noindex:     result.Metadata.Noindex,
+			Nofollow:    result.Metadata.Nofollow,
+		}
+		err := putJSON(batch, prefixPage+hash, stored)
+		if err != nil {
+			return err
+		}
+	}
+	return s.addCount(batch, keyPageCount, added)
+}
+
+// GetFetchResult retrieves the outcome of the last fetch of the page hash, or nil if it has never been fetched.
+func (s *LevelDBStorage) GetFetchResult(pageHash string) (*FetchResult, error) {
+	var stored levelDBFetch
+	ok, err := s.getJSON(prefixFetch+pageHash, &stored)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	result := &FetchResult{
+		StatusCode:      stored.StatusCode,
+		ContentType:     stored.ContentType,
+		MIMEType:        stored.MIMEType,
+		ContentLength:   stored.ContentLength,
+		ResponseTime:    stored.ResponseTime,
+		FetchedAt:       stored.FetchedAt,
+		ErrorClass:      stored.ErrorClass,
+		ETag:            stored.ETag,
+		LastModified:    stored.LastModified,
+		LinksHash:       stored.LinksHash,
+		RevisitInterval: stored.RevisitInterval,
+		NextFetchAt:     stored.NextFetchAt,
+	}
+	result.U, err = url.Parse(stored.URL)
+	if err != nil {
+		return nil, err
+	}
+	if stored.FinalURL != "" {
+		result.FinalURL, err = url.Parse(stored.FinalURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// ClaimPagesDueForRecrawl retrieves up to limit pages whose next fetch is due,
+// and pushes their next fetch back by lease so that nobody else picks them up in the meantime.
+func (s *LevelDBStorage) ClaimPagesDueForRecrawl(limit int, lease time.Duration) ([]Page, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	iter := s.db.NewIterator(&util.Range{
+		Start: []byte(prefixNextDue),
+		Limit: nextDueKey(now, "~"),
+	}, nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	var pages []Page
+	for iter.Next() && len(pages) < limit {
+		key := iter.Key()
+		hash := string(key[len(prefixNextDue)+8+1:])
+
+		var fetch levelDBFetch
+		ok, err := s.getJSON(prefixFetch+hash, &fetch)
+		if err != nil {
+			return nil, err
+		}
+		batch.Delete(append([]byte(nil), key...))
+		if !ok {
+			continue
+		}
+		fetch.NextFetchAt = now.Add(lease)
+		err = putJSON(batch, prefixFetch+hash, fetch)
+		if err != nil {
+			return nil, err
+		}
+		batch.Put(nextDueKey(fetch.NextFetchAt, hash), nil)
+
+		page, err := s.GetPage(hash)
+		if err != nil {
+			return nil, err
+		}
+		if page == nil {
+			continue
+		}
+		pages = append(pages, *page)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	return pages, s.db.Write(batch, nil)
+}
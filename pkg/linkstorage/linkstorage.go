@@ -14,26 +14,37 @@ import (
 	"github.com/lib/pq"
 )
 
-// Storage implements a PostgreSQL storage backend for colly
-type Storage struct {
-	URI       string
-	PageTable string
-	LinkTable string
-	db        *sql.DB
-	linkLock  *sync.RWMutex
-	pageLock  *sync.RWMutex
-}
-
-// NewStorage is a wrapper for easily creating a storage object.
-func NewStorage(
+const (
+	// maxQueryParams is the most parameters postgres takes in one statement.
+	maxQueryParams = 65535
+	// insertPageColumns and insertLinkColumns are how many parameters each row of InsertPages and InsertLinks takes.
+	insertPageColumns = 7
+	insertLinkColumns = 10
+)
+
+// PostgresStorage implements a PostgreSQL storage backend for colly
+type PostgresStorage struct {
+	URI        string
+	PageTable  string
+	LinkTable  string
+	FetchTable string
+	db         *sql.DB
+	linkLock   *sync.RWMutex
+	pageLock   *sync.RWMutex
+}
+
+// NewPostgresStorage is a wrapper for easily creating a storage object.
+func NewPostgresStorage(
 	uri string,
 	pageTable string,
 	linkTable string,
-) (*Storage, error) {
-	storage := &Storage{
-		URI:       uri,
-		PageTable: pageTable,
-		LinkTable: linkTable,
+	fetchTable string,
+) (*PostgresStorage, error) {
+	storage := &PostgresStorage{
+		URI:        uri,
+		PageTable:  pageTable,
+		LinkTable:  linkTable,
+		FetchTable: fetchTable,
 	}
 	err := storage.Init()
 	if err != nil {
@@ -44,7 +55,7 @@ func NewStorage(
 
 // KeepPingingOn periodically sends a ping to the db to keep the connection alive.
 // You can kill this process by sending a boolean to the returned channel.
-func (s *Storage) KeepPingingOn(d time.Duration) chan<- bool {
+func (s *PostgresStorage) KeepPingingOn(d time.Duration) chan<- bool {
 	ticker := time.NewTicker(d)
 	killChan := make(chan bool)
 	go func() {
@@ -68,12 +79,22 @@ func (s *Storage) KeepPingingOn(d time.Duration) chan<- bool {
 }
 
 // Close closes connections.
-func (s *Storage) Close() error {
+func (s *PostgresStorage) Close() error {
 	return s.db.Close()
 }
 
-// Init initializes the PostgreSQL storage
-func (s *Storage) Init() error {
+// Init connects to the PostgreSQL storage, and brings the schema up to date.
+func (s *PostgresStorage) Init() error {
+	err := s.Open()
+	if err != nil {
+		return err
+	}
+
+	return s.Migrate()
+}
+
+// Open connects to the PostgreSQL storage, without touching the schema.
+func (s *PostgresStorage) Open() error {
 	var err error
 
 	if s.linkLock == nil {
@@ -88,53 +109,11 @@ func (s *Storage) Init() error {
 		return err
 	}
 
-	if err = s.db.Ping(); err != nil {
-		return err
-	}
-
-	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
-		page_id text NOT NULL PRIMARY KEY UNIQUE, 
-		host text NOT NULL, 
-		path text NOT NULL, 
-		url text NOT NULL
-		);`, s.PageTable)
-
-	if _, err = s.db.Exec(query); err != nil {
-		return err
-	}
-
-	query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
-		from_page_id text NOT NULL, 
-		to_page_id text NOT NULL, 
-		text text, 
-		CONSTRAINT PK_Link PRIMARY KEY (from_page_id,to_page_id),
-		CONSTRAINT FK_from_page_id FOREIGN KEY (from_page_id) REFERENCES %s(page_id),
-		CONSTRAINT FK_to_page_id FOREIGN KEY (to_page_id) REFERENCES %s(page_id)
-		);`, s.LinkTable, s.PageTable, s.PageTable)
-
-	if _, err = s.db.Exec(query); err != nil {
-		return err
-	}
-
-	query = fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_to_page_id 
-	ON %s(to_page_id)`, s.LinkTable)
-
-	if _, err = s.db.Exec(query); err != nil {
-		return err
-	}
-
-	query = fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_page_host 
-	ON %s(host)`, s.PageTable)
-
-	if _, err = s.db.Exec(query); err != nil {
-		return err
-	}
-
-	return nil
+	return s.db.Ping()
 }
 
 // CheckPageExists checks that the page exists in the visited database
-func (s *Storage) CheckPageExists(u *url.URL) (bool, error) {
+func (s *PostgresStorage) CheckPageExists(u *url.URL) (bool, error) {
 	var isVisited bool
 
 	query := fmt.Sprintf(`SELECT EXISTS(SELECT 1 FROM %s WHERE page_id = $1)`, s.PageTable)
@@ -146,8 +125,12 @@ func (s *Storage) CheckPageExists(u *url.URL) (bool, error) {
 }
 
 // GetPage retrieves info about the page hash if it exists.
-func (s *Storage) GetPage(pageHash string) (*Page, error) {
-	query := fmt.Sprintf(`SELECT url FROM %s WHERE page_id = $1`, s.PageTable)
+func (s *PostgresStorage) GetPage(pageHash string) (*Page, error) {
+	query := fmt.Sprintf(`SELECT p.url, p.depth, d.url, 
+	p.title, COALESCE(p.description, ''), COALESCE(p.lang, ''), COALESCE(p.robots, ''), COALESCE(p.h1, ''), 
+	COALESCE(p.noindex, false), COALESCE(p.nofollow, false), COALESCE(p.seeds, '{}') 
+	FROM %s p LEFT JOIN %s d ON d.page_id = p.discovered_from 
+	WHERE p.page_id = $1`, s.PageTable, s.PageTable)
 
 	// Prepare query
 	stmt, err := s.db.Prepare(query)
@@ -158,8 +141,15 @@ func (s *Storage) GetPage(pageHash string) (*Page, error) {
 
 	// Execute query
 	var urlString string
+	var depth sql.NullInt64
+	var discoveredFrom sql.NullString
+	var title sql.NullString
+	var seeds []string
+	metadata := &PageMetadata{}
 	s.pageLock.RLock()
-	err = stmt.QueryRow(pageHash).Scan(&urlString)
+	err = stmt.QueryRow(pageHash).Scan(&urlString, &depth, &discoveredFrom,
+		&title, &metadata.Description, &metadata.Lang, &metadata.Robots, &metadata.H1,
+		&metadata.Noindex, &metadata.Nofollow, pq.Array(&seeds))
 	s.pageLock.RUnlock()
 	if err == sql.ErrNoRows {
 		// Return nothing if nothing found
@@ -174,14 +164,34 @@ func (s *Storage) GetPage(pageHash string) (*Page, error) {
 		return nil, err
 	}
 
-	return &Page{
-		U: u,
-	}, nil
+	page := &Page{
+		U:     u,
+		Depth: UnknownDepth,
+	}
+	if depth.Valid {
+		page.Depth = int(depth.Int64)
+	}
+	if discoveredFrom.Valid {
+		page.DiscoveredFrom, err = url.Parse(discoveredFrom.String)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if title.Valid {
+		metadata.Title = title.String
+		page.Metadata = metadata
+	}
+	for _, seed := range seeds {
+		if u, err := url.Parse(seed); err == nil {
+			page.Seeds = append(page.Seeds, u)
+		}
+	}
+	return page, nil
 }
 
 // GetPageHashesFromHost retrieves the page hashes of all pages with this host.
-func (s *Storage) GetPageHashesFromHost(host string, limit int) ([]string, error) {
-	query := fmt.Sprintf(`SELECT page_id FROM %s WHERE host = $1 LIMIT $2`, s.PageTable)
+func (s *PostgresStorage) GetPageHashesFromHost(host string, limit int, includeNoindex bool) ([]string, error) {
+	query := fmt.Sprintf(`SELECT page_id FROM %s WHERE host = $1 AND ($3 OR noindex IS NOT TRUE) LIMIT $2`, s.PageTable)
 
 	// Prepare query
 	stmt, err := s.db.Prepare(query)
@@ -193,7 +203,7 @@ func (s *Storage) GetPageHashesFromHost(host string, limit int) ([]string, error
 	// Execute query
 	var pageHashes []string
 	s.pageLock.RLock()
-	rows, err := stmt.Query(host, limit)
+	rows, err := stmt.Query(host, limit, includeNoindex)
 	s.pageLock.RUnlock()
 	defer rows.Close()
 	for rows.Next() {
@@ -214,7 +224,7 @@ func (s *Storage) GetPageHashesFromHost(host string, limit int) ([]string, error
 }
 
 // AddPage first checks that it does not exist, and then inserts the page
-func (s *Storage) AddPage(page *Page) error {
+func (s *PostgresStorage) AddPage(page *Page) error {
 	visited, err := s.CheckPageExists(page.U)
 	if err != nil {
 		return err
@@ -224,7 +234,7 @@ func (s *Storage) AddPage(page *Page) error {
 		return nil
 	}
 
-	query := fmt.Sprintf(`INSERT INTO %s (page_id, host, path, url) VALUES($1, $2, $3, $4);`, s.PageTable)
+	query := fmt.Sprintf(`INSERT INTO %s (page_id, host, path, url, depth, discovered_from, seeds) VALUES($1, $2, $3, $4, $5, $6, $7);`, s.PageTable)
 
 	// Prepare query
 	stmt, err := s.db.Prepare(query)
@@ -234,13 +244,13 @@ func (s *Storage) AddPage(page *Page) error {
 	defer stmt.Close()
 
 	s.pageLock.Lock()
-	_, err = stmt.Exec(linkutils.Hash(page.U), page.U.Hostname(), page.U.EscapedPath(), page.U.String())
+	_, err = stmt.Exec(linkutils.Hash(page.U), page.U.Hostname(), page.U.EscapedPath(), page.U.String(), depthValue(*page), discoveredFromHash(*page), pq.Array(seedStrings(*page)))
 	s.pageLock.Unlock()
 	return err
 }
 
 // CheckLinkExists checks that the link exists in the visited database
-func (s *Storage) CheckLinkExists(fromU *url.URL, toU *url.URL) (bool, error) {
+func (s *PostgresStorage) CheckLinkExists(fromU *url.URL, toU *url.URL) (bool, error) {
 	var isVisited bool
 
 	query := fmt.Sprintf(`SELECT EXISTS(SELECT 1 FROM %s WHERE from_page_id = $1 AND to_page_id = $2)`, s.LinkTable)
@@ -251,44 +261,58 @@ func (s *Storage) CheckLinkExists(fromU *url.URL, toU *url.URL) (bool, error) {
 	return isVisited, err
 }
 
-// GetLinksFrom retrieves the links from this page hash.
-func (s *Storage) GetLinksFrom(pageHash string, limit int) ([]string, error) {
-	query := fmt.Sprintf(`SELECT to_page_id FROM %s WHERE from_page_id = $1 LIMIT $2`, s.LinkTable)
+// GetLinksFrom retrieves the current links from this page hash.
+func (s *PostgresStorage) GetLinksFrom(pageHash string, limit int, includeNoindex bool) ([]string, error) {
+	query := fmt.Sprintf(`SELECT to_page_id FROM %s 
+	WHERE from_page_id = $1 AND removed_at IS NULL 
+	AND %s 
+	LIMIT $2`, s.LinkTable, s.indexedFilter("to_page_id", 3))
 
-	// Prepare query
-	stmt, err := s.db.Prepare(query)
-	if err != nil {
-		return nil, err
-	}
-	defer stmt.Close()
+	return s.queryLinkHashes(query, pageHash, limit, includeNoindex)
+}
 
-	// Execute query
-	var pageHashes []string
-	s.linkLock.RLock()
-	rows, err := stmt.Query(pageHash, limit)
-	s.linkLock.RUnlock()
-	defer rows.Close()
-	for rows.Next() {
-		var pageID string
-		err = rows.Scan(&pageID)
-		if err != nil {
-			return nil, err
-		}
-		pageHashes = append(pageHashes, pageID)
-	}
-	// get any error encountered during iteration
-	err = rows.Err()
-	if err != nil {
-		return nil, err
-	}
+// GetLinksFromAsOf retrieves the links from this page hash as they were at the given time.
+func (s *PostgresStorage) GetLinksFromAsOf(pageHash string, at time.Time, limit int, includeNoindex bool) ([]string, error) {
+	query := fmt.Sprintf(`SELECT to_page_id FROM %s 
+	WHERE from_page_id = $1 
+	AND (first_seen IS NULL OR first_seen <= $2) 
+	AND (removed_at IS NULL OR removed_at > $2) 
+	AND %s 
+	LIMIT $3`, s.LinkTable, s.indexedFilter("to_page_id", 4))
 
-	return pageHashes, nil
+	return s.queryLinkHashes(query, pageHash, at, limit, includeNoindex)
 }
 
-// GetLinksTo retrieves the links from this page hash.
-func (s *Storage) GetLinksTo(pageHash string, limit int) ([]string, error) {
-	query := fmt.Sprintf(`SELECT from_page_id FROM %s WHERE to_page_id = $1 LIMIT $2`, s.LinkTable)
+// GetLinksTo retrieves the current links to this page hash.
+func (s *PostgresStorage) GetLinksTo(pageHash string, limit int, includeNoindex bool) ([]string, error) {
+	query := fmt.Sprintf(`SELECT from_page_id FROM %s 
+	WHERE to_page_id = $1 AND removed_at IS NULL 
+	AND %s 
+	LIMIT $2`, s.LinkTable, s.indexedFilter("from_page_id", 3))
 
+	return s.queryLinkHashes(query, pageHash, limit, includeNoindex)
+}
+
+// GetLinksToAsOf retrieves the links to this page hash as they were at the given time.
+func (s *PostgresStorage) GetLinksToAsOf(pageHash string, at time.Time, limit int, includeNoindex bool) ([]string, error) {
+	query := fmt.Sprintf(`SELECT from_page_id FROM %s 
+	WHERE to_page_id = $1 
+	AND (first_seen IS NULL OR first_seen <= $2) 
+	AND (removed_at IS NULL OR removed_at > $2) 
+	AND %s 
+	LIMIT $3`, s.LinkTable, s.indexedFilter("from_page_id", 4))
+
+	return s.queryLinkHashes(query, pageHash, at, limit, includeNoindex)
+}
+
+// indexedFilter is a condition on the links table which leaves out links whose page in the column asked not to be indexed,
+// unless the boolean query parameter with this number is true.
+func (s *PostgresStorage) indexedFilter(column string, param int) string {
+	return fmt.Sprintf(`($%d OR NOT EXISTS (SELECT 1 FROM %s p WHERE p.page_id = %s.%s AND p.noindex))`, param, s.PageTable, s.LinkTable, column)
+}
+
+// queryLinkHashes runs a query against the links table which returns a single column of page hashes.
+func (s *PostgresStorage) queryLinkHashes(query string, args ...interface{}) ([]string, error) {
 	// Prepare query
 	stmt, err := s.db.Prepare(query)
 	if err != nil {
@@ -299,8 +323,11 @@ func (s *Storage) GetLinksTo(pageHash string, limit int) ([]string, error) {
 	// Execute query
 	var pageHashes []string
 	s.linkLock.RLock()
-	rows, err := stmt.Query(pageHash, limit)
+	rows, err := stmt.Query(args...)
 	s.linkLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 	for rows.Next() {
 		var pageID string
@@ -320,7 +347,7 @@ func (s *Storage) GetLinksTo(pageHash string, limit int) ([]string, error) {
 }
 
 // CountLinks retrieves an estimate of the number of links scraped.
-func (s *Storage) CountLinks() (int, error) {
+func (s *PostgresStorage) CountLinks() (int, error) {
 	var count int
 	query := fmt.Sprintf(`SELECT reltuples::bigint AS estimate 
 	FROM pg_class 
@@ -343,7 +370,7 @@ func (s *Storage) CountLinks() (int, error) {
 }
 
 // CountPages retrieves an estimate of the number of pages scraped.
-func (s *Storage) CountPages() (int, error) {
+func (s *PostgresStorage) CountPages() (int, error) {
 	var count int
 	query := fmt.Sprintf(`SELECT reltuples::bigint AS estimate 
 	FROM pg_class 
@@ -366,7 +393,7 @@ func (s *Storage) CountPages() (int, error) {
 }
 
 // AddLink first checks that it does not exist, and then inserts the page
-func (s *Storage) AddLink(link *Link) error {
+func (s *PostgresStorage) AddLink(link *Link) error {
 	s.linkLock.Lock()
 	defer s.linkLock.Unlock()
 	// First, check the link already exists
@@ -380,17 +407,19 @@ func (s *Storage) AddLink(link *Link) error {
 	}
 
 	// Then try to add the pages
-	s.AddPage(&Page{U: link.FromU})
-	s.AddPage(&Page{U: link.ToU})
+	s.AddPage(&Page{U: link.FromU, Depth: UnknownDepth})
+	s.AddPage(&Page{U: link.ToU, Depth: UnknownDepth})
 
-	query := fmt.Sprintf(`INSERT INTO %s (from_page_id, to_page_id, text) VALUES($1, $2, $3);`, s.LinkTable)
+	query := fmt.Sprintf(`INSERT INTO %s (from_page_id, to_page_id, text, link_type, first_seen, last_seen) VALUES($1, $2, $3, $4, $5, $5);`, s.LinkTable)
 
-	_, err = s.db.Exec(query, linkutils.Hash(link.FromU), linkutils.Hash(link.ToU), link.LinkText)
+	_, err = s.db.Exec(query, linkutils.Hash(link.FromU), linkutils.Hash(link.ToU), link.LinkText, link.GetType(), link.GetSeenAt())
 	return err
 }
 
-// BatchAddLinks takes a batch of links and inserts them, not giving a fuck whether or not they clash
-func (s *Storage) BatchAddLinks(links []*Link) error {
+// InsertLinks takes a batch of links and inserts them with one big INSERT, updating links that already exist the same way BatchAddLinks does.
+// BatchAddLinks does the same thing faster using COPY, this is kept around to compare against.
+// Unlike BatchAddLinks, the pages of every link must already exist, and the batch has to fit in one statement's parameters.
+func (s *PostgresStorage) InsertLinks(links []*Link) error {
 	// Hmmm, not sure what to do about this page bullshit, maybe I'll make a batch process for that too
 	// // Then try to add the pages
 	// s.AddPage(fromU)
@@ -400,18 +429,43 @@ func (s *Storage) BatchAddLinks(links []*Link) error {
 		return nil
 	}
 
-	valueStrings := make([]string, 0, len(links))
-	vals := []interface{}{}
-
+	// The upsert can't touch the same row twice, so where a link is in the batch more than once,
+	// the latest sighting wins, and then the most important kind of edge, like BatchAddLinks.
+	var kept []*Link
+	index := make(map[[2]string]int, len(links))
 	for _, link := range links {
-		valueStrings = append(valueStrings, "(?, ?, ?)")
-		vals = append(vals, linkutils.Hash(link.FromU), linkutils.Hash(link.ToU), strings.ToValidUTF8(link.LinkText, ""))
+		key := [2]string{linkutils.Hash(link.FromU), linkutils.Hash(link.ToU)}
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(kept)
+			kept = append(kept, link)
+			continue
+		}
+		if replacesType(link.GetSeenAt(), kept[i].GetSeenAt(), link.GetType(), kept[i].GetType()) {
+			kept[i] = link
+		}
+	}
+	if len(kept)*insertLinkColumns > maxQueryParams {
+		return fmt.Errorf("%d links are too many for one INSERT", len(kept))
+	}
+
+	valueStrings := make([]string, 0, len(kept))
+	vals := []interface{}{}
+	for _, link := range kept {
+		valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		seenAt := link.GetSeenAt()
+		vals = append(vals,
+			linkutils.Hash(link.FromU), linkutils.Hash(link.ToU), strings.ToValidUTF8(link.LinkText, ""), link.GetType(), seenAt, seenAt,
+			pq.Array(validTexts(link.GetTexts())), nullString(link.Rel), positionValue(link), nullString(link.Section),
+		)
 	}
 
 	sqlStr := fmt.Sprintf(
-		"INSERT INTO %s (from_page_id, to_page_id, text) VALUES %s ON CONFLICT DO NOTHING",
+		`INSERT INTO %s (from_page_id, to_page_id, text, link_type, first_seen, last_seen, texts, rel, position, section) VALUES %s 
+		%s`,
 		s.LinkTable,
 		strings.Join(valueStrings, ","),
+		s.linkConflict(),
 	)
 
 	//Replacing ? with $n for postgres
@@ -430,69 +484,78 @@ func (s *Storage) BatchAddLinks(links []*Link) error {
 	return err
 }
 
-// ResilientBatchAddLinks shrinks the batch sizes until it eventually works :shrug:
-func (s *Storage) ResilientBatchAddLinks(links []*Link) error {
-	maxRetries := 20
-	var retryCount int
-	var err error
-	batchSize := len(links)
-	tempBatch := links
-	// This simply backs off retries with this shitty foreign key error.
-	for batchSize >= 1 {
-		err = s.BatchAddLinks(tempBatch[:batchSize])
-		if err != nil {
-			// If we know this kind of error, we backoff for a bit and retry the same batch.
-			if pqErr, ok := err.(*pq.Error); ok {
-				// Here err is of type *pq.Error, you may inspect all its fields, e.g.:
-				if pqErr.Code == "23503" {
-					retryCount++
-					// Here the error code is a foreign_key_violation, and we can maaaybe assume that the link will eventually be added so we retry this for 10 seconds or so.
-					if retryCount > 10 {
-						log.Printf("retrying foreign_key_violation %d/%d\n", retryCount+1, maxRetries)
-					}
-					if retryCount == maxRetries {
-						log.Printf("Gave up after %d retries!\n", retryCount)
-						break
-					}
-					time.Sleep(time.Duration(retryCount) * 50 * time.Millisecond)
-					continue
-				}
-			}
-			// Here we do not know the kind of error, but know there is one.
-			if batchSize > 1 {
-				log.Printf("Encountered weird error with batch size %d, splitting the batch...", batchSize)
-				batchSize = batchSize / 2
-				// time.Sleep(50 * time.Millisecond)
-				continue
-			}
-			log.Printf("Skipping failed message %d\n", len(links)-len(tempBatch))
-		}
-		// Here the batch size == 1, and there is an error we do not know, so we decide to skip that message.
-		// Or if there was no error, we continue through the batch.
-		tempBatch = tempBatch[batchSize:]
-		batchSize = len(tempBatch)
+// MarkLinksRemoved marks every link on the page which wasn't seen by the crawl at seenAt as removed.
+// HTTP redirects aren't on the page, so they are left alone.
+func (s *PostgresStorage) MarkLinksRemoved(fromU *url.URL, seenAt time.Time) error {
+	return s.markRemoved(fromU, seenAt, false)
+}
+
+// MarkRedirectsRemoved marks every HTTP redirect from the page which wasn't followed by the crawl at seenAt as removed.
+func (s *PostgresStorage) MarkRedirectsRemoved(fromU *url.URL, seenAt time.Time) error {
+	return s.markRemoved(fromU, seenAt, true)
+}
+
+// markRemoved marks either the HTTP redirects or the links on the page which weren't seen at seenAt as removed.
+func (s *PostgresStorage) markRemoved(fromU *url.URL, seenAt time.Time, redirects bool) error {
+	like := "NOT LIKE"
+	if redirects {
+		like = "LIKE"
 	}
+	query := fmt.Sprintf(`UPDATE %s SET removed_at = $2 
+	WHERE from_page_id = $1 AND removed_at IS NULL AND link_type %s '%s%%' 
+	AND (last_seen IS NULL OR last_seen < $2)`, s.LinkTable, like, linkTypeRedirectPrefix)
+
+	s.linkLock.Lock()
+	_, err := s.db.Exec(query, linkutils.Hash(fromU), seenAt)
+	s.linkLock.Unlock()
 	return err
 }
 
-// BatchAddPages takes a batch of pages and inserts them, not giving a fuck whether or not they clash
-func (s *Storage) BatchAddPages(pages []Page) error {
+// InsertPages takes a batch of pages and inserts them with one big INSERT, not giving a fuck whether or not they clash
+// BatchAddPages does the same thing faster using COPY, this is kept around to compare against.
+// Unlike BatchAddPages, the batch has to fit in one statement's parameters.
+func (s *PostgresStorage) InsertPages(pages []Page) error {
 	if len(pages) == 0 {
 		return nil
 	}
 
-	valueStrings := make([]string, 0, len(pages))
-	vals := []interface{}{}
-
+	// The upsert can't touch the same row twice, so where a page is in the batch more than once,
+	// the shallowest one wins, but it gets the seeds of all of them, like BatchAddPages.
+	var kept []Page
+	seeds := make(map[string][]string, len(pages))
+	index := make(map[string]int, len(pages))
 	for _, page := range pages {
-		valueStrings = append(valueStrings, "(?, ?, ?, ?)")
-		vals = append(vals, linkutils.Hash(page.U), page.U.Hostname(), page.U.EscapedPath(), page.U.String())
+		hash := linkutils.Hash(page.U)
+		i, ok := index[hash]
+		if !ok {
+			index[hash] = len(kept)
+			kept = append(kept, page)
+			seeds[hash] = seedStrings(page)
+			continue
+		}
+		seeds[hash], _ = addSeeds(seeds[hash], page)
+		if page.Depth != UnknownDepth && (kept[i].Depth == UnknownDepth || page.Depth < kept[i].Depth) {
+			kept[i] = page
+		}
+	}
+	if len(kept)*insertPageColumns > maxQueryParams {
+		return fmt.Errorf("%d pages are too many for one INSERT", len(kept))
+	}
+
+	valueStrings := make([]string, 0, len(kept))
+	vals := []interface{}{}
+	for _, page := range kept {
+		hash := linkutils.Hash(page.U)
+		valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?)")
+		vals = append(vals, hash, page.U.Hostname(), page.U.EscapedPath(), page.U.String(), depthValue(page), discoveredFromHash(page), pq.Array(seeds[hash]))
 	}
 
 	sqlStr := fmt.Sprintf(
-		"INSERT INTO %s (page_id, host, path, url) VALUES %s ON CONFLICT DO NOTHING ",
+		`INSERT INTO %s (page_id, host, path, url, depth, discovered_from, seeds) VALUES %s 
+		%s`,
 		s.PageTable,
 		strings.Join(valueStrings, ","),
+		s.pageConflict(),
 	)
 
 	//Replacing ? with $n for postgres
@@ -512,6 +575,223 @@ func (s *Storage) BatchAddPages(pages []Page) error {
 	return err
 }
 
+// depthValue returns the depth of the page, or nil if we don't know it.
+func depthValue(page Page) interface{} {
+	if page.Depth == UnknownDepth {
+		return nil
+	}
+	return page.Depth
+}
+
+// discoveredFromHash returns the page id of the page this page was discovered from, or nil for seeds.
+func discoveredFromHash(page Page) interface{} {
+	if page.DiscoveredFrom == nil {
+		return nil
+	}
+	return linkutils.Hash(page.DiscoveredFrom)
+}
+
+// seedStrings returns the urls of the seeds the page was reached from.
+func seedStrings(page Page) []string {
+	seeds := make([]string, 0, len(page.Seeds))
+	for _, seed := range page.Seeds {
+		seeds = append(seeds, seed.String())
+	}
+	return seeds
+}
+
+// positionValue returns the position of the link, or nil if it isn't on the page.
+func positionValue(link *Link) interface{} {
+	if link.Position == 0 {
+		return nil
+	}
+	return link.Position
+}
+
+// nullString returns the string, or nil if it is empty.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// GetFetchResult retrieves the outcome of the last fetch of the page hash, or nil if it has never been fetched.
+func (s *PostgresStorage) GetFetchResult(pageHash string) (*FetchResult, error) {
+	query := fmt.Sprintf(`SELECT p.url, f.status, f.content_type, f.content_length, f.response_time_ms, f.fetched_at, f.error_class, f.final_url, 
+	COALESCE(f.etag, ''), COALESCE(f.last_modified, ''), COALESCE(f.links_hash, ''), 
+	COALESCE(f.revisit_interval_seconds, 0), COALESCE(f.next_fetch_at, f.fetched_at), COALESCE(f.mime_type, '') 
+	FROM %s f JOIN %s p ON p.page_id = f.page_id 
+	WHERE f.page_id = $1`, s.FetchTable, s.PageTable)
+
+	// Prepare query
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	// Execute query
+	var urlString string
+	var responseTimeMs int64
+	var finalURL sql.NullString
+	var revisitIntervalSeconds int64
+	result := &FetchResult{}
+	err = stmt.QueryRow(pageHash).Scan(
+		&urlString,
+		&result.StatusCode,
+		&result.ContentType,
+		&result.ContentLength,
+		&responseTimeMs,
+		&result.FetchedAt,
+		&result.ErrorClass,
+		&finalURL,
+		&result.ETag,
+		&result.LastModified,
+		&result.LinksHash,
+		&revisitIntervalSeconds,
+		&result.NextFetchAt,
+		&result.MIMEType,
+	)
+	if err == sql.ErrNoRows {
+		// Return nothing if nothing found
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.U, err = url.Parse(urlString)
+	if err != nil {
+		return nil, err
+	}
+	result.ResponseTime = time.Duration(responseTimeMs) * time.Millisecond
+	result.RevisitInterval = time.Duration(revisitIntervalSeconds) * time.Second
+	if finalURL.Valid {
+		result.FinalURL, err = url.Parse(finalURL.String)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// ClaimPagesDueForRecrawl retrieves up to limit pages whose next fetch is due,
+// and pushes their next fetch back by lease so that nobody else picks them up in the meantime.
+func (s *PostgresStorage) ClaimPagesDueForRecrawl(limit int, lease time.Duration) ([]Page, error) {
+	query := fmt.Sprintf(`UPDATE %s f SET next_fetch_at = $1 
+	FROM %s p 
+	WHERE f.page_id = p.page_id AND f.page_id IN (
+		SELECT page_id FROM %s 
+		WHERE next_fetch_at <= now() 
+		ORDER BY next_fetch_at 
+		LIMIT $2 
+		FOR UPDATE SKIP LOCKED
+	) 
+	RETURNING p.url, p.depth`, s.FetchTable, s.PageTable, s.FetchTable)
+
+	// Prepare query
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	// Execute query
+	var pages []Page
+	rows, err := stmt.Query(time.Now().Add(lease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var urlString string
+		var depth sql.NullInt64
+		err = rows.Scan(&urlString, &depth)
+		if err != nil {
+			return nil, err
+		}
+		u, err := url.Parse(urlString)
+		if err != nil {
+			log.Printf("Skipping unparseable url %s: %v", urlString, err)
+			continue
+		}
+		page := Page{
+			U:     u,
+			Depth: UnknownDepth,
+		}
+		if depth.Valid {
+			page.Depth = int(depth.Int64)
+		}
+		pages = append(pages, page)
+	}
+	// get any error encountered during iteration
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return pages, nil
+}
+
+// GetRedirect retrieves the page hash this page currently redirects to, or an empty string if it doesn't redirect.
+func (s *PostgresStorage) GetRedirect(pageHash string) (string, error) {
+	query := fmt.Sprintf(`SELECT to_page_id FROM %s 
+	WHERE from_page_id = $1 AND (link_type LIKE '%s%%' OR link_type = '%s') AND removed_at IS NULL 
+	ORDER BY last_seen DESC NULLS LAST 
+	LIMIT 1`, s.LinkTable, linkTypeRedirectPrefix, LinkTypeMetaRefresh)
+
+	// Prepare query
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	// Execute query
+	var redirectHash string
+	s.linkLock.RLock()
+	err = stmt.QueryRow(pageHash).Scan(&redirectHash)
+	s.linkLock.RUnlock()
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return redirectHash, nil
+}
+
+// GetCanonical retrieves the page hash this page currently says is its canonical version, or an empty string if it doesn't name one.
+func (s *PostgresStorage) GetCanonical(pageHash string) (string, error) {
+	query := fmt.Sprintf(`SELECT to_page_id FROM %s 
+	WHERE from_page_id = $1 AND link_type = '%s' AND removed_at IS NULL 
+	LIMIT 1`, s.LinkTable, LinkTypeCanonical)
+
+	// Prepare query
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	// Execute query
+	var canonicalHash string
+	s.linkLock.RLock()
+	err = stmt.QueryRow(pageHash).Scan(&canonicalHash)
+	s.linkLock.RUnlock()
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return canonicalHash, nil
+}
+
 // ReplaceSQL replaces the instance occurrence of any string pattern with an increasing $n based sequence
 func ReplaceSQL(old, searchPattern string) string {
 	tmpCount := strings.Count(old, searchPattern)
@@ -0,0 +1,412 @@
+package linkstorage
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+// This is a storage backend that keeps everything in memory, for tests and crawls you don't need to keep.
+
+// memoryPage is a page, the discovered from is a page hash.
+type memoryPage struct {
+	u              *url.URL
+	depth          int
+	discoveredFrom string
+	metadata       *PageMetadata
+	seeds          []string
+}
+
+// memoryLink is a link, the zero time means we don't know.
+type memoryLink struct {
+	text      string
+	linkType  string
+	texts     []string
+	rel       string
+	position  int
+	section   string
+	firstSeen time.Time
+	lastSeen  time.Time
+	removedAt time.Time
+}
+
+// setAttributes copies the attributes of the link as it was last seen.
+func (l *memoryLink) setAttributes(link *Link) {
+	l.texts = validTexts(link.GetTexts())
+	l.rel = link.Rel
+	l.position = link.Position
+	l.section = link.Section
+}
+
+// existedAt returns true if the link was there at the given time.
+func (l *memoryLink) existedAt(at time.Time) bool {
+	return !l.firstSeen.After(at) && (l.removedAt.IsZero() || l.removedAt.After(at))
+}
+
+// MemoryStorage implements a storage backend which only lives as long as the process.
+type MemoryStorage struct {
+	pages map[string]*memoryPage
+	// hosts, linksFrom and linksTo keep page hashes in the order they were added.
+	hosts     map[string][]string
+	links     map[[2]string]*memoryLink
+	linksFrom map[string][]string
+	linksTo   map[string][]string
+	fetches   map[string]FetchResult
+	lock      *sync.RWMutex
+}
+
+// NewMemoryStorage is a wrapper for easily creating an empty in-memory storage object.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		pages:     make(map[string]*memoryPage),
+		hosts:     make(map[string][]string),
+		links:     make(map[[2]string]*memoryLink),
+		linksFrom: make(map[string][]string),
+		linksTo:   make(map[string][]string),
+		fetches:   make(map[string]FetchResult),
+		lock:      &sync.RWMutex{},
+	}
+}
+
+// Close does nothing, everything is forgotten once the storage is no longer used.
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// CheckPageExists checks that the page exists in the visited database
+func (s *MemoryStorage) CheckPageExists(u *url.URL) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.pages[linkutils.Hash(u)]
+	return ok, nil
+}
+
+// GetPage retrieves info about the page hash if it exists.
+func (s *MemoryStorage) GetPage(pageHash string) (*Page, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.getPage(pageHash), nil
+}
+
+// getPage must be called with the lock held.
+func (s *MemoryStorage) getPage(pageHash string) *Page {
+	stored, ok := s.pages[pageHash]
+	if !ok {
+		return nil
+	}
+	page := &Page{
+		U:        stored.u,
+		Depth:    stored.depth,
+		Metadata: stored.metadata,
+	}
+	if from, ok := s.pages[stored.discoveredFrom]; ok {
+		page.DiscoveredFrom = from.u
+	}
+	for _, seed := range stored.seeds {
+		if u, err := url.Parse(seed); err == nil {
+			page.Seeds = append(page.Seeds, u)
+		}
+	}
+	return page
+}
+
+// GetPageHashesFromHost retrieves the page hashes of all pages with this host.
+func (s *MemoryStorage) GetPageHashesFromHost(host string, limit int, includeNoindex bool) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return firstN(s.hosts[host], limit, func(hash string) bool {
+		return includeNoindex || !s.noindex(hash)
+	}), nil
+}
+
+// noindex returns true if the page asked not to be indexed, it must be called with the lock held.
+func (s *MemoryStorage) noindex(hash string) bool {
+	page, ok := s.pages[hash]
+	return ok && page.metadata != nil && page.metadata.Noindex
+}
+
+// firstN returns up to limit of the hashes that keep returns true for.
+func firstN(hashes []string, limit int, keep func(hash string) bool) []string {
+	var kept []string
+	for _, hash := range hashes {
+		if len(kept) >= limit {
+			break
+		}
+		if keep == nil || keep(hash) {
+			kept = append(kept, hash)
+		}
+	}
+	return kept
+}
+
+// AddPage first checks that it does not exist, and then inserts the page
+func (s *MemoryStorage) AddPage(page *Page) error {
+	return s.BatchAddPages([]Page{*page})
+}
+
+// BatchAddPages takes a batch of pages and inserts them.
+// Existing pages keep the first depth they were seen at, unless they didn't know it.
+func (s *MemoryStorage) BatchAddPages(pages []Page) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, page := range pages {
+		s.addPage(page)
+	}
+	return nil
+}
+
+// addPage must be called with the lock held.
+func (s *MemoryStorage) addPage(page Page) {
+	hash := linkutils.Hash(page.U)
+	stored, ok := s.pages[hash]
+	if !ok {
+		stored = &memoryPage{u: page.U, depth: UnknownDepth}
+		s.pages[hash] = stored
+		s.hosts[page.U.Hostname()] = append(s.hosts[page.U.Hostname()], hash)
+	}
+	stored.seeds, _ = addSeeds(stored.seeds, page)
+	if ok && (stored.depth != UnknownDepth || page.Depth == UnknownDepth) {
+		return
+	}
+	stored.u = page.U
+	stored.depth = page.Depth
+	stored.discoveredFrom = ""
+	if page.DiscoveredFrom != nil {
+		stored.discoveredFrom = linkutils.Hash(page.DiscoveredFrom)
+	}
+}
+
+// CountPages retrieves the number of pages scraped.
+func (s *MemoryStorage) CountPages() (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.pages), nil
+}
+
+// CheckLinkExists checks that the link exists in the visited database
+func (s *MemoryStorage) CheckLinkExists(fromU *url.URL, toU *url.URL) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.links[[2]string{linkutils.Hash(fromU), linkutils.Hash(toU)}]
+	return ok, nil
+}
+
+// GetLinksFrom retrieves the current links from this page hash.
+func (s *MemoryStorage) GetLinksFrom(pageHash string, limit int, includeNoindex bool) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return firstN(s.linksFrom[pageHash], limit, func(toHash string) bool {
+		return s.links[[2]string{pageHash, toHash}].removedAt.IsZero() && (includeNoindex || !s.noindex(toHash))
+	}), nil
+}
+
+// GetLinksFromAsOf retrieves the links from this page hash as they were at the given time.
+func (s *MemoryStorage) GetLinksFromAsOf(pageHash string, at time.Time, limit int, includeNoindex bool) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return firstN(s.linksFrom[pageHash], limit, func(toHash string) bool {
+		return s.links[[2]string{pageHash, toHash}].existedAt(at) && (includeNoindex || !s.noindex(toHash))
+	}), nil
+}
+
+// GetLinksTo retrieves the current links to this page hash.
+func (s *MemoryStorage) GetLinksTo(pageHash string, limit int, includeNoindex bool) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return firstN(s.linksTo[pageHash], limit, func(fromHash string) bool {
+		return s.links[[2]string{fromHash, pageHash}].removedAt.IsZero() && (includeNoindex || !s.noindex(fromHash))
+	}), nil
+}
+
+// GetLinksToAsOf retrieves the links to this page hash as they were at the given time.
+func (s *MemoryStorage) GetLinksToAsOf(pageHash string, at time.Time, limit int, includeNoindex bool) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return firstN(s.linksTo[pageHash], limit, func(fromHash string) bool {
+		return s.links[[2]string{fromHash, pageHash}].existedAt(at) && (includeNoindex || !s.noindex(fromHash))
+	}), nil
+}
+
+// GetRedirect retrieves the page hash this page currently redirects to, or an empty string if it doesn't redirect.
+func (s *MemoryStorage) GetRedirect(pageHash string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var redirect string
+	var latest *memoryLink
+	for _, toHash := range s.linksFrom[pageHash] {
+		link := s.links[[2]string{pageHash, toHash}]
+		if !link.removedAt.IsZero() || !(strings.HasPrefix(link.linkType, linkTypeRedirectPrefix) || link.linkType == LinkTypeMetaRefresh) {
+			continue
+		}
+		if latest == nil || link.lastSeen.After(latest.lastSeen) {
+			redirect, latest = toHash, link
+		}
+	}
+	return redirect, nil
+}
+
+// GetCanonical retrieves the page hash this page currently says is its canonical version, or an empty string if it doesn't name one.
+func (s *MemoryStorage) GetCanonical(pageHash string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, toHash := range s.linksFrom[pageHash] {
+		link := s.links[[2]string{pageHash, toHash}]
+		if link.linkType == LinkTypeCanonical && link.removedAt.IsZero() {
+			return toHash, nil
+		}
+	}
+	return "", nil
+}
+
+// AddLink first checks that it does not exist, and then inserts the link along with its pages
+func (s *MemoryStorage) AddLink(link *Link) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.links[[2]string{linkutils.Hash(link.FromU), linkutils.Hash(link.ToU)}]; ok {
+		return nil
+	}
+	s.addLink(link)
+	return nil
+}
+
+// BatchAddLinks takes a batch of links and inserts them, updating when existing links were last seen.
+// A link that comes back after being removed by an earlier crawl starts its history again.
+// Any pages which haven't been added yet are added along with the links.
+func (s *MemoryStorage) BatchAddLinks(links []*Link) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, link := range links {
+		s.addLink(link)
+	}
+	return nil
+}
+
+// addLink adds the link along with its pages, it must be called with the lock held.
+func (s *MemoryStorage) addLink(link *Link) {
+	s.addPage(Page{U: link.FromU, Depth: UnknownDepth})
+	s.addPage(Page{U: link.ToU, Depth: UnknownDepth})
+
+	fromHash, toHash := linkutils.Hash(link.FromU), linkutils.Hash(link.ToU)
+	seenAt := link.GetSeenAt()
+	stored, ok := s.links[[2]string{fromHash, toHash}]
+	if !ok {
+		s.links[[2]string{fromHash, toHash}] = &memoryLink{
+			text:      strings.ToValidUTF8(link.LinkText, ""),
+			linkType:  link.GetType(),
+			firstSeen: seenAt,
+			lastSeen:  seenAt,
+		}
+		s.links[[2]string{fromHash, toHash}].setAttributes(link)
+		s.linksFrom[fromHash] = append(s.linksFrom[fromHash], toHash)
+		s.linksTo[toHash] = append(s.linksTo[toHash], fromHash)
+		return
+	}
+	// removedAt can be the same crawl's timestamp if MarkLinksRemoved got there first, in which case it wasn't really removed.
+	if !stored.removedAt.IsZero() && stored.removedAt.Before(seenAt) {
+		stored.firstSeen = seenAt
+	}
+	if replacesType(seenAt, stored.lastSeen, link.GetType(), stored.linkType) {
+		stored.linkType = link.GetType()
+	}
+	// The attributes of a link are whatever its latest sighting said.
+	if !stored.lastSeen.After(seenAt) {
+		stored.lastSeen = seenAt
+		stored.setAttributes(link)
+	}
+	stored.removedAt = time.Time{}
+}
+
+// MarkLinksRemoved marks every link on the page which wasn't seen by the crawl at seenAt as removed.
+// HTTP redirects aren't on the page, so they are left alone.
+func (s *MemoryStorage) MarkLinksRemoved(fromU *url.URL, seenAt time.Time) error {
+	return s.markRemoved(fromU, seenAt, false)
+}
+
+// MarkRedirectsRemoved marks every HTTP redirect from the page which wasn't followed by the crawl at seenAt as removed.
+func (s *MemoryStorage) MarkRedirectsRemoved(fromU *url.URL, seenAt time.Time) error {
+	return s.markRemoved(fromU, seenAt, true)
+}
+
+// markRemoved marks either the HTTP redirects or the links on the page which weren't seen at seenAt as removed.
+func (s *MemoryStorage) markRemoved(fromU *url.URL, seenAt time.Time, redirects bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fromHash := linkutils.Hash(fromU)
+	for _, toHash := range s.linksFrom[fromHash] {
+		link := s.links[[2]string{fromHash, toHash}]
+		if !link.removedAt.IsZero() || strings.HasPrefix(link.linkType, linkTypeRedirectPrefix) != redirects || !link.lastSeen.Before(seenAt) {
+			continue
+		}
+		link.removedAt = seenAt
+	}
+	return nil
+}
+
+// CountLinks retrieves the number of links scraped.
+func (s *MemoryStorage) CountLinks() (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.links), nil
+}
+
+// BatchAddFetchResults takes a batch of fetch results and stores them, so only the latest result per page is kept.
+func (s *MemoryStorage) BatchAddFetchResults(results []*FetchResult) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, result := range results {
+		s.fetches[linkutils.Hash(result.U)] = *result
+		if result.Metadata == nil {
+			continue
+		}
+		s.addPage(Page{U: result.FetchedPage(), Depth: UnknownDepth})
+		metadata := *result.Metadata
+		s.pages[linkutils.Hash(result.FetchedPage())].metadata = &metadata
+	}
+	return nil
+}
+
+// GetFetchResult retrieves the outcome of the last fetch of the page hash, or nil if it has never been fetched.
+func (s *MemoryStorage) GetFetchResult(pageHash string) (*FetchResult, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result, ok := s.fetches[pageHash]
+	if !ok {
+		return nil, nil
+	}
+	// Like the other backends, only what goes in the fetch table comes back.
+	result.LinksScraped = false
+	result.CanonicalURL = nil
+	result.Metadata = nil
+	return &result, nil
+}
+
+// ClaimPagesDueForRecrawl retrieves up to limit pages whose next fetch is due,
+// and pushes their next fetch back by lease so that nobody else picks them up in the meantime.
+func (s *MemoryStorage) ClaimPagesDueForRecrawl(limit int, lease time.Duration) ([]Page, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	var due []string
+	for hash, result := range s.fetches {
+		if _, ok := s.pages[hash]; ok && !result.NextFetchAt.After(now) {
+			due = append(due, hash)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return s.fetches[due[i]].NextFetchAt.Before(s.fetches[due[j]].NextFetchAt)
+	})
+
+	var pages []Page
+	for _, hash := range firstN(due, limit, nil) {
+		result := s.fetches[hash]
+		result.NextFetchAt = now.Add(lease)
+		s.fetches[hash] = result
+		pages = append(pages, *s.getPage(hash))
+	}
+	return pages, nil
+}
@@ -0,0 +1,371 @@
+package linkstorage
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+)
+
+var (
+	t0 = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 = t0.Add(24 * time.Hour)
+	t2 = t1.Add(24 * time.Hour)
+)
+
+// page returns the url of a page on example.com, such as "https://example.com/a".
+func page(t *testing.T, name string) *url.URL {
+	t.Helper()
+	u, err := url.Parse("https://example.com/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func link(t *testing.T, from, to, linkType string, seenAt time.Time) *Link {
+	t.Helper()
+	return &Link{FromU: page(t, from), ToU: page(t, to), LinkText: from + " to " + to, Type: linkType, SeenAt: seenAt}
+}
+
+// names turns page hashes back into the page names they were made from.
+func names(t *testing.T, s *MemoryStorage, hashes []string) []string {
+	t.Helper()
+	var names []string
+	for _, hash := range hashes {
+		p, err := s.GetPage(hash)
+		if err != nil || p == nil {
+			t.Fatalf("page %s not found: %v", hash, err)
+		}
+		names = append(names, p.U.Path[1:])
+	}
+	return names
+}
+
+func TestBatchAddLinks(t *testing.T) {
+	tests := []struct {
+		name          string
+		batches       [][]*Link
+		wantType      string
+		wantFirstSeen time.Time
+		wantLastSeen  time.Time
+		wantText      string
+	}{
+		{
+			name:          "new link",
+			batches:       [][]*Link{{link(t, "a", "b", "", t0)}},
+			wantType:      LinkTypeLink,
+			wantFirstSeen: t0,
+			wantLastSeen:  t0,
+			wantText:      "a to b",
+		},
+		{
+			name: "later sighting replaces the type",
+			batches: [][]*Link{
+				{link(t, "a", "b", LinkTypeLink, t0)},
+				{link(t, "a", "b", LinkTypeSitemap, t1)},
+			},
+			wantType:      LinkTypeSitemap,
+			wantFirstSeen: t0,
+			wantLastSeen:  t1,
+			wantText:      "a to b",
+		},
+		{
+			name: "older sighting doesn't replace the type",
+			batches: [][]*Link{
+				{link(t, "a", "b", LinkTypeLink, t1)},
+				{link(t, "a", "b", LinkTypeCanonical, t0)},
+			},
+			wantType:      LinkTypeLink,
+			wantFirstSeen: t1,
+			wantLastSeen:  t1,
+			wantText:      "a to b",
+		},
+		{
+			name: "same crawl keeps the more important type",
+			batches: [][]*Link{
+				{link(t, "a", "b", RedirectLinkType(301), t0), link(t, "a", "b", LinkTypeLink, t0)},
+				{link(t, "a", "b", LinkTypeMetaRefresh, t0)},
+			},
+			wantType:      RedirectLinkType(301),
+			wantFirstSeen: t0,
+			wantLastSeen:  t0,
+			wantText:      "a to b",
+		},
+		{
+			name: "same crawl upgrades the type",
+			batches: [][]*Link{
+				{link(t, "a", "b", LinkTypeAlternate, t0)},
+				{link(t, "a", "b", LinkTypeCanonical, t0)},
+			},
+			wantType:      LinkTypeCanonical,
+			wantFirstSeen: t0,
+			wantLastSeen:  t0,
+			wantText:      "a to b",
+		},
+		{
+			name:          "text is made valid",
+			batches:       [][]*Link{{{FromU: page(t, "a"), ToU: page(t, "b"), LinkText: "bad \xff text", SeenAt: t0}}},
+			wantType:      LinkTypeLink,
+			wantFirstSeen: t0,
+			wantLastSeen:  t0,
+			wantText:      "bad  text",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStorage()
+			for _, batch := range tt.batches {
+				if err := s.BatchAddLinks(batch); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Both pages are added along with the link, without a depth.
+			if pages, _ := s.CountPages(); pages != 2 {
+				t.Errorf("%d pages, want 2", pages)
+			}
+			if links, _ := s.CountLinks(); links != 1 {
+				t.Errorf("%d links, want 1", links)
+			}
+			if p, _ := s.GetPage(linkutils.Hash(page(t, "b"))); p == nil || p.Depth != UnknownDepth {
+				t.Errorf("page b is %+v, want an unknown depth", p)
+			}
+
+			stored := s.links[[2]string{linkutils.Hash(page(t, "a")), linkutils.Hash(page(t, "b"))}]
+			if stored.linkType != tt.wantType {
+				t.Errorf("type %s, want %s", stored.linkType, tt.wantType)
+			}
+			if !stored.firstSeen.Equal(tt.wantFirstSeen) || !stored.lastSeen.Equal(tt.wantLastSeen) {
+				t.Errorf("seen from %v to %v, want %v to %v", stored.firstSeen, stored.lastSeen, tt.wantFirstSeen, tt.wantLastSeen)
+			}
+			if stored.text != tt.wantText {
+				t.Errorf("text %q, want %q", stored.text, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestMarkLinksRemoved(t *testing.T) {
+	tests := []struct {
+		name string
+		// seen is what the crawl at t1 found on page a, and markFirst marks the links removed before storing them.
+		seen      []string
+		markFirst bool
+		// seenAgain is what a later crawl at t2 found on page a, without marking anything removed.
+		seenAgain []string
+		want      []string
+		wantAtT0  []string
+		wantAtT1  []string
+	}{
+		{
+			name:     "nothing changed",
+			seen:     []string{"b", "d"},
+			want:     []string{"b", "c", "d"},
+			wantAtT0: []string{"b", "c", "d"},
+			wantAtT1: []string{"b", "c", "d"},
+		},
+		{
+			name:     "link gone, redirect left alone",
+			seen:     []string{"b"},
+			want:     []string{"b", "c"},
+			wantAtT0: []string{"b", "c", "d"},
+			wantAtT1: []string{"b", "c"},
+		},
+		{
+			name:     "every link gone",
+			want:     []string{"c"},
+			wantAtT0: []string{"b", "c", "d"},
+			wantAtT1: []string{"c"},
+		},
+		{
+			name:      "same crawl marked first",
+			seen:      []string{"b"},
+			markFirst: true,
+			want:      []string{"b", "c"},
+			wantAtT0:  []string{"b", "c", "d"},
+			wantAtT1:  []string{"b", "c"},
+		},
+		{
+			// Its history starts again, so it no longer looks like it was there before it was removed either.
+			name:      "link comes back",
+			seen:      []string{"b"},
+			seenAgain: []string{"b", "d"},
+			want:      []string{"b", "c", "d"},
+			wantAtT0:  []string{"b", "c"},
+			wantAtT1:  []string{"b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStorage()
+			err := s.BatchAddLinks([]*Link{
+				link(t, "a", "b", LinkTypeLink, t0),
+				link(t, "a", "c", RedirectLinkType(301), t0),
+				link(t, "a", "d", LinkTypeLink, t0),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var seen []*Link
+			for _, to := range tt.seen {
+				seen = append(seen, link(t, "a", to, LinkTypeLink, t1))
+			}
+			if tt.markFirst {
+				if err = s.MarkLinksRemoved(page(t, "a"), t1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = s.BatchAddLinks(seen); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.markFirst {
+				if err = s.MarkLinksRemoved(page(t, "a"), t1); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var seenAgain []*Link
+			for _, to := range tt.seenAgain {
+				seenAgain = append(seenAgain, link(t, "a", to, LinkTypeLink, t2))
+			}
+			if err = s.BatchAddLinks(seenAgain); err != nil {
+				t.Fatal(err)
+			}
+
+			hash := linkutils.Hash(page(t, "a"))
+			current, _ := s.GetLinksFrom(hash, 100, true)
+			if got := names(t, s, current); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("links %v, want %v", got, tt.want)
+			}
+			atT0, _ := s.GetLinksFromAsOf(hash, t0, 100, true)
+			if got := names(t, s, atT0); !reflect.DeepEqual(got, tt.wantAtT0) {
+				t.Errorf("links at t0 %v, want %v", got, tt.wantAtT0)
+			}
+			atT1, _ := s.GetLinksFromAsOf(hash, t1, 100, true)
+			if got := names(t, s, atT1); !reflect.DeepEqual(got, tt.wantAtT1) {
+				t.Errorf("links at t1 %v, want %v", got, tt.wantAtT1)
+			}
+		})
+	}
+}
+
+func TestGetRedirect(t *testing.T) {
+	tests := []struct {
+		name  string
+		links []*Link
+		// redirectsRemovedAt, if set, is when a crawl followed no redirects from page a.
+		redirectsRemovedAt time.Time
+		want               string
+	}{
+		{name: "no links"},
+		{name: "plain link", links: []*Link{link(t, "a", "b", LinkTypeLink, t0)}},
+		{name: "canonical isn't a redirect", links: []*Link{link(t, "a", "b", LinkTypeCanonical, t0)}},
+		{name: "http redirect", links: []*Link{link(t, "a", "b", RedirectLinkType(301), t0)}, want: "b"},
+		{name: "meta refresh", links: []*Link{link(t, "a", "b", LinkTypeMetaRefresh, t0)}, want: "b"},
+		{
+			name: "latest redirect wins",
+			links: []*Link{
+				link(t, "a", "b", RedirectLinkType(301), t0),
+				link(t, "a", "c", RedirectLinkType(302), t1),
+				link(t, "a", "d", LinkTypeLink, t2),
+			},
+			want: "c",
+		},
+		{
+			name:               "removed redirect",
+			links:              []*Link{link(t, "a", "b", RedirectLinkType(301), t0)},
+			redirectsRemovedAt: t1,
+		},
+		{
+			name:               "redirect followed by the same crawl",
+			links:              []*Link{link(t, "a", "b", RedirectLinkType(301), t1)},
+			redirectsRemovedAt: t1,
+			want:               "b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStorage()
+			if err := s.BatchAddLinks(tt.links); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.redirectsRemovedAt.IsZero() {
+				if err := s.MarkRedirectsRemoved(page(t, "a"), tt.redirectsRemovedAt); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := s.GetRedirect(linkutils.Hash(page(t, "a")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := ""
+			if tt.want != "" {
+				want = linkutils.Hash(page(t, tt.want))
+			}
+			if got != want {
+				t.Errorf("redirect %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestClaimPagesDueForRecrawl(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		want      []string
+		wantAgain []string
+	}{
+		{name: "most overdue first", limit: 1, want: []string{"a"}, wantAgain: []string{"b"}},
+		{name: "every page due", limit: 10, want: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStorage()
+			now := time.Now()
+			err := s.BatchAddPages([]Page{{U: page(t, "a"), Depth: 0}, {U: page(t, "b"), Depth: 1}, {U: page(t, "c"), Depth: 1}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Page d was fetched, but has never been stored, so isn't ours to recrawl.
+			err = s.BatchAddFetchResults([]*FetchResult{
+				{U: page(t, "b"), StatusCode: 200, FetchedAt: now, NextFetchAt: now.Add(-time.Hour)},
+				{U: page(t, "a"), StatusCode: 200, FetchedAt: now, NextFetchAt: now.Add(-2 * time.Hour)},
+				{U: page(t, "c"), StatusCode: 200, FetchedAt: now, NextFetchAt: now.Add(time.Hour)},
+				{U: page(t, "d"), StatusCode: 200, FetchedAt: now, NextFetchAt: now.Add(-3 * time.Hour)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claim := func() []string {
+				pages, err := s.ClaimPagesDueForRecrawl(tt.limit, time.Hour)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, p := range pages {
+					names = append(names, p.U.Path[1:])
+				}
+				return names
+			}
+			if got := claim(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("claimed %v, want %v", got, tt.want)
+			}
+			// Claimed pages are leased, so they aren't handed out again.
+			if got := claim(); !reflect.DeepEqual(got, tt.wantAgain) {
+				t.Errorf("claimed %v the second time, want %v", got, tt.wantAgain)
+			}
+
+			result, _ := s.GetFetchResult(linkutils.Hash(page(t, "a")))
+			if !result.NextFetchAt.After(now) {
+				t.Errorf("page a is due again at %v, want it leased", result.NextFetchAt)
+			}
+		})
+	}
+}
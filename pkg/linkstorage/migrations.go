@@ -0,0 +1,341 @@
+package linkstorage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// This is how the postgres schema is created and upgraded.
+// Migrations are run in order, each in its own transaction, and the schema_version table remembers which have been applied.
+// Never edit a migration that has been released, add a new one to the end instead.
+
+// schemaVersionTable records which migrations have been applied.
+const schemaVersionTable = "schema_version"
+
+// migrationLockKey is the postgres advisory lock held while migrating, so the api and the processor can't both migrate at once.
+const migrationLockKey int64 = 7405932196
+
+// Migration is a single step in upgrading the schema.
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// Migrations returns every migration for these tables, in the order they must be applied.
+// The early ones are written so they also work on databases created before we had migrations.
+func (s *PostgresStorage) Migrations() []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "create pages and links tables",
+			Statements: []string{
+				fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		page_id text NOT NULL PRIMARY KEY UNIQUE,
+		host text NOT NULL,
+		path text NOT NULL,
+		url text NOT NULL
+		);`, s.PageTable),
+				fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		from_page_id text NOT NULL,
+		to_page_id text NOT NULL,
+		text text,
+		CONSTRAINT PK_Link PRIMARY KEY (from_page_id,to_page_id),
+		CONSTRAINT FK_from_page_id FOREIGN KEY (from_page_id) REFERENCES %s(page_id),
+		CONSTRAINT FK_to_page_id FOREIGN KEY (to_page_id) REFERENCES %s(page_id)
+		);`, s.LinkTable, s.PageTable, s.PageTable),
+				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_to_page_id
+	ON %s(to_page_id)`, s.LinkTable),
+				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_page_host
+	ON %s(host)`, s.PageTable),
+			},
+		},
+		{
+			Version:     2,
+			Description: "track page depth and where pages were discovered",
+			Statements: []string{
+				fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS depth integer,
+		ADD COLUMN IF NOT EXISTS discovered_from text;`, s.PageTable),
+			},
+		},
+		{
+			Version:     3,
+			Description: "create fetch results table",
+			Statements: []string{
+				// There is no foreign key to the pages table, as fetch results are batched separately to pages.
+				fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		page_id text NOT NULL PRIMARY KEY,
+		status integer NOT NULL,
+		content_type text NOT NULL,
+		content_length bigint NOT NULL,
+		response_time_ms integer NOT NULL,
+		fetched_at timestamptz NOT NULL,
+		error_class text NOT NULL
+		);`, s.FetchTable),
+			},
+		},
+		{
+			Version:     4,
+			Description: "store link types, for redirects",
+			Statements: []string{
+				fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS link_type text NOT NULL DEFAULT '%s';`, s.LinkTable, LinkTypeLink),
+			},
+		},
+		{
+			Version:     5,
+			Description: "store what is needed to recrawl pages",
+			Statements: []string{
+				fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS final_url text,
+		ADD COLUMN IF NOT EXISTS etag text,
+		ADD COLUMN IF NOT EXISTS last_modified text,
+		ADD COLUMN IF NOT EXISTS links_hash text,
+		ADD COLUMN IF NOT EXISTS revisit_interval_seconds integer,
+		ADD COLUMN IF NOT EXISTS next_fetch_at timestamptz;`, s.FetchTable),
+				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_fetch_next_fetch_at
+	ON %s(next_fetch_at)`, s.FetchTable),
+			},
+		},
+		{
+			Version:     6,
+			Description: "keep link history",
+			Statements: []string{
+				// Links from before then have no first_seen, and are treated as having always been there.
+				fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS first_seen timestamptz,
+		ADD COLUMN IF NOT EXISTS last_seen timestamptz,
+		ADD COLUMN IF NOT EXISTS removed_at timestamptz;`, s.LinkTable),
+			},
+		},
+		{
+			Version:     7,
+			Description: "create staging tables for bulk loading",
+			Statements: []string{
+				// These are only ever written to inside a transaction which empties them again, so they don't need to survive a crash.
+				fmt.Sprintf(`CREATE UNLOGGED TABLE IF NOT EXISTS %s (
+		page_id text NOT NULL,
+		host text NOT NULL,
+		path text NOT NULL,
+		url text NOT NULL,
+		depth integer,
+		discovered_from text
+		);`, s.pageStagingTable()),
+				fmt.Sprintf(`CREATE UNLOGGED TABLE IF NOT EXISTS %s (
+		from_page_id text NOT NULL,
+		to_page_id text NOT NULL,
+		text text,
+		link_type text NOT NULL,
+		seen_at timestamptz NOT NULL
+		);`, s.linkStagingTable()),
+			},
+		},
+		{
+			Version:     8,
+			Description: "stage the pages of links, so they can be added along with the links",
+			Statements: []string{
+				fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS from_host text,
+		ADD COLUMN IF NOT EXISTS from_path text,
+		ADD COLUMN IF NOT EXISTS from_url text,
+		ADD COLUMN IF NOT EXISTS to_host text,
+		ADD COLUMN IF NOT EXISTS to_path text,
+		ADD COLUMN IF NOT EXISTS to_url text;`, s.linkStagingTable()),
+			},
+		},
+		{
+			Version:     9,
+			Description: "store link attributes",
+			Statements: []string{
+				fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS texts text[],
+		ADD COLUMN IF NOT EXISTS rel text,
+		ADD COLUMN IF NOT EXISTS position integer,
+		ADD COLUMN IF NOT EXISTS section text;`, s.LinkTable),
+				fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS texts text[],
+		ADD COLUMN IF NOT EXISTS rel text,
+		ADD COLUMN IF NOT EXISTS position integer,
+		ADD COLUMN IF NOT EXISTS section text;`, s.linkStagingTable()),
+			},
+		},
+		{
+			Version:     10,
+			Description: "store page metadata",
+			Statements: []string{
+				// Pages which have never been parsed have a NULL title.
+				fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS title text,
+		ADD COLUMN IF NOT EXISTS description text,
+		ADD COLUMN IF NOT EXISTS lang text,
+		ADD COLUMN IF NOT EXISTS robots text,
+		ADD COLUMN IF NOT EXISTS h1 text;`, s.PageTable),
+				fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS title text,
+		ADD COLUMN IF NOT EXISTS description text,
+		ADD COLUMN IF NOT EXISTS lang text,
+		ADD COLUMN IF NOT EXISTS robots text,
+		ADD COLUMN IF NOT EXISTS h1 text;`, s.pageStagingTable()),
+			},
+		},
+		{
+			Version:     11,
+			Description: "flag pages which ask robots not to index them or follow their links",
+			Statements: []string{
+				fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS noindex boolean,
+		ADD COLUMN IF NOT EXISTS nofollow boolean;`, s.PageTable),
+				fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS noindex boolean,
+		ADD COLUMN IF NOT EXISTS nofollow boolean;`, s.pageStagingTable()),
+			},
+		},
+		{
+			Version:     12,
+			Description: "remember which seeds each page was reached from",
+			Statements: []string{
+				// Seeds are kept as urls rather than page ids, so they survive a rehash untouched.
+				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS seeds text[];`, s.PageTable),
+				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS seeds text[];`, s.pageStagingTable()),
+			},
+		},
+		{
+			Version:     13,
+			Description: "record what each fetched page turned out to be",
+			Statements: []string{
+				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS mime_type text;`, s.FetchTable),
+			},
+		},
+		{
+			Version:     14,
+			Description: "create a staging table for bulk loading fetch results",
+			Statements: []string{
+				fmt.Sprintf(`CREATE UNLOGGED TABLE IF NOT EXISTS %s (
+		page_id text NOT NULL,
+		status integer NOT NULL,
+		content_type text NOT NULL,
+		content_length bigint NOT NULL,
+		response_time_ms integer NOT NULL,
+		fetched_at timestamptz NOT NULL,
+		error_class text NOT NULL,
+		final_url text,
+		etag text,
+		last_modified text,
+		links_hash text,
+		revisit_interval_seconds integer,
+		next_fetch_at timestamptz,
+		mime_type text
+		);`, s.fetchStagingTable()),
+			},
+		},
+		{
+			Version:     15,
+			Description: "empty the staging tables, which batches now only copy the columns of",
+			Statements: []string{
+				fmt.Sprintf(`TRUNCATE %s, %s, %s;`, s.pageStagingTable(), s.linkStagingTable(), s.fetchStagingTable()),
+			},
+		},
+	}
+}
+
+// SchemaVersion returns the version of the last migration applied, or 0 if none have been.
+func (s *PostgresStorage) SchemaVersion() (int, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, schemaVersionTable).Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version int
+	query := fmt.Sprintf(`SELECT COALESCE(MAX(version), 0) FROM %s`, schemaVersionTable)
+	err = s.db.QueryRow(query).Scan(&version)
+	return version, err
+}
+
+// PendingMigrations returns the migrations which haven't been applied yet.
+func (s *PostgresStorage) PendingMigrations() ([]Migration, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, migration := range s.Migrations() {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies any pending migrations.
+// It holds an advisory lock while it does, so anyone else migrating at the same time waits and then finds nothing to do.
+func (s *PostgresStorage) Migrate() error {
+	ctx := context.Background()
+
+	// The advisory lock belongs to a connection, so everything has to happen on the same one.
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey); err != nil {
+			log.Printf("Failed to release the migration lock: %v", err)
+		}
+	}()
+
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		version integer NOT NULL PRIMARY KEY,
+		description text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+		);`, schemaVersionTable)
+
+	if _, err = conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	// Only look at what is pending once we hold the lock, in case someone else just migrated.
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range pending {
+		log.Printf("Applying migration %d: %s", migration.Version, migration.Description)
+		err = applyMigration(ctx, conn, migration)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+		}
+	}
+
+	return nil
+}
+
+// applyMigration runs the migration and records it as applied, all in one transaction.
+func applyMigration(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range migration.Statements {
+		if _, err = tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	query := fmt.Sprintf(`INSERT INTO %s (version, description) VALUES ($1, $2)`, schemaVersionTable)
+	if _, err = tx.ExecContext(ctx, query, migration.Version, migration.Description); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
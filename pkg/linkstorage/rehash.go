@@ -0,0 +1,409 @@
+package linkstorage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/jamesjarvis/web-graph/pkg/linkutils"
+	"github.com/lib/pq"
+)
+
+// This moves every page to the id it has under the current url policy, for when the policy is changed on an existing graph.
+// Pages which end up with the same id are merged, along with their links and fetch results.
+// Only postgres graphs can be rehashed, a leveldb graph refuses to open with a different url identity instead, see CheckURLIdentity.
+
+// RehashStats is what a rehash changed, or would change.
+type RehashStats struct {
+	Pages int
+	// Moved is the number of pages whose id changes.
+	Moved int
+	// Merged is the number of pages which are folded into another page.
+	Merged int
+}
+
+func (s *PostgresStorage) pageIDMapTable() string {
+	return s.PageTable + "_id_map"
+}
+
+func (s *PostgresStorage) rehashBatchTable() string {
+	return s.PageTable + "_rehash_batch"
+}
+
+// Rehash recomputes every page id with linkutils.Hash, and moves everything over to the new ids.
+// Nothing should be writing to the graph while this runs.
+// The new id of every page is worked out first and kept in the id map table, and then the pages are moved batchSize new ids at a time,
+// each batch in its own transaction, with progress logged as it goes.
+// If it is interrupted, running it again with the same policy carries on with the pages that haven't been moved yet.
+// The map is dropped once everything has been moved.
+// With dryRun, the new ids are worked out and counted, but nothing is changed.
+func (s *PostgresStorage) Rehash(dryRun bool, batchSize int) (*RehashStats, error) {
+	var resuming bool
+	err := s.db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, s.pageIDMapTable()).Scan(&resuming)
+	if err != nil {
+		return nil, err
+	}
+
+	if !resuming {
+		if dryRun {
+			return s.countRehash()
+		}
+		err = s.createPageIDMap()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("Carrying on with the rehash that was interrupted, using the new ids already worked out")
+	}
+
+	stats, err := s.rehashStats(s.db)
+	if err != nil || dryRun {
+		return stats, err
+	}
+
+	err = s.movePages(batchSize)
+	if err != nil {
+		return nil, err
+	}
+	err = s.tidyUnmovedPages(batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf(`DROP TABLE %s`, s.pageIDMapTable()))
+	return stats, err
+}
+
+// queryRower is a connection or a transaction.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rehashStats counts what the id map changes.
+func (s *PostgresStorage) rehashStats(db queryRower) (*RehashStats, error) {
+	stats := &RehashStats{}
+	err := db.QueryRow(fmt.Sprintf(
+		`SELECT count(*), count(*) FILTER (WHERE new_id <> old_id), count(*) - count(DISTINCT new_id) FROM %s`,
+		s.pageIDMapTable(),
+	)).Scan(&stats.Pages, &stats.Moved, &stats.Merged)
+	return stats, err
+}
+
+// countRehash works out the new ids in a temporary map, just to count them.
+func (s *PostgresStorage) countRehash() (*RehashStats, error) {
+	txn, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	_, err = txn.Exec(fmt.Sprintf(`CREATE TEMP TABLE %s (
+		old_id text NOT NULL PRIMARY KEY,
+		new_id text NOT NULL,
+		host text NOT NULL,
+		path text NOT NULL,
+		url text NOT NULL
+		) ON COMMIT DROP;`, s.pageIDMapTable()))
+	if err != nil {
+		return nil, err
+	}
+	err = s.buildPageIDMap(txn)
+	if err != nil {
+		return nil, err
+	}
+	return s.rehashStats(txn)
+}
+
+// createPageIDMap works out the new id of every page, and keeps them in the id map table.
+// The map is only there once it is complete, so a rehash interrupted at this point just starts again.
+func (s *PostgresStorage) createPageIDMap() error {
+	txn, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	// done is set once the page has been dealt with, which is what lets an interrupted rehash carry on.
+	_, err = txn.Exec(fmt.Sprintf(`CREATE TABLE %s (
+		old_id text NOT NULL PRIMARY KEY,
+		new_id text NOT NULL,
+		host text NOT NULL,
+		path text NOT NULL,
+		url text NOT NULL,
+		done boolean NOT NULL DEFAULT false
+		);`, s.pageIDMapTable()))
+	if err != nil {
+		return err
+	}
+	err = s.buildPageIDMap(txn)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(fmt.Sprintf(`CREATE INDEX ON %s (new_id) WHERE NOT done`, s.pageIDMapTable()))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Worked out the new id of every page")
+	return txn.Commit()
+}
+
+// movePages moves the pages whose id changes, batchSize new ids at a time.
+// Every page moving to the same id is moved in the same batch, so they are merged in one go.
+func (s *PostgresStorage) movePages(batchSize int) error {
+	var remaining int
+	err := s.db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM %s WHERE NOT done AND new_id <> old_id`, s.pageIDMapTable())).Scan(&remaining)
+	if err != nil {
+		return err
+	}
+
+	moved := 0
+	// A batch can't move a page onto an id still held by a page which is yet to move away,
+	// so those are left until last, when anything still waiting is moved together.
+	waitForHolders := true
+	for {
+		n, err := s.moveBatch(batchSize, waitForHolders)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			if !waitForHolders {
+				return nil
+			}
+			waitForHolders = false
+			batchSize = remaining - moved
+			continue
+		}
+		moved += n
+		log.Printf("Moved %d of %d pages", moved, remaining)
+	}
+}
+
+// moveBatch moves the pages of the next batch of new ids in one transaction, returning how many pages it moved.
+func (s *PostgresStorage) moveBatch(batchSize int, waitForHolders bool) (int, error) {
+	txn, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Rollback()
+
+	m := s.pageIDMapTable()
+	held := ""
+	if waitForHolders {
+		held = fmt.Sprintf(`AND NOT EXISTS (SELECT 1 FROM %s holder WHERE holder.old_id = candidate.new_id AND NOT holder.done
+			AND holder.new_id <> holder.old_id AND holder.new_id <> candidate.new_id)`, m)
+	}
+	// A page already at one of the new ids is left for tidyUnmovedPages, the others are merged into it.
+	_, err = txn.Exec(fmt.Sprintf(`CREATE TEMP TABLE %s ON COMMIT DROP AS
+		SELECT old_id, new_id, host, path, url FROM %s
+		WHERE NOT done AND new_id <> old_id AND new_id IN (
+			SELECT DISTINCT new_id FROM %s candidate WHERE NOT done AND new_id <> old_id %s
+			ORDER BY new_id LIMIT %d
+		)`, s.rehashBatchTable(), m, m, held, batchSize))
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	err = txn.QueryRow(fmt.Sprintf(`SELECT count(*) FROM %s`, s.rehashBatchTable())).Scan(&n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	if _, err = txn.Exec(fmt.Sprintf(`ANALYZE %s`, s.rehashBatchTable())); err != nil {
+		return 0, err
+	}
+
+	for _, query := range s.rehashQueries(s.rehashBatchTable()) {
+		if _, err = txn.Exec(query); err != nil {
+			return 0, err
+		}
+	}
+	_, err = txn.Exec(fmt.Sprintf(`UPDATE %s m SET done = true FROM %s b WHERE m.old_id = b.old_id`, m, s.rehashBatchTable()))
+	if err != nil {
+		return 0, err
+	}
+
+	return n, txn.Commit()
+}
+
+// tidyUnmovedPages cleans up the urls of the pages which kept their id, and points them at the new id of the page they were discovered from,
+// batchSize pages at a time.
+func (s *PostgresStorage) tidyUnmovedPages(batchSize int) error {
+	m := s.pageIDMapTable()
+	queries := []string{
+		fmt.Sprintf(`CREATE TEMP TABLE %s ON COMMIT DROP AS
+		SELECT old_id, host, path, url FROM %s WHERE NOT done ORDER BY old_id LIMIT %d`, s.rehashBatchTable(), m, batchSize),
+		fmt.Sprintf(`UPDATE %s p SET host = b.host, path = b.path, url = b.url
+		FROM %s b WHERE p.page_id = b.old_id AND b.url <> '' AND p.url <> b.url`,
+			s.PageTable, s.rehashBatchTable()),
+		fmt.Sprintf(`UPDATE %s p SET discovered_from = d.new_id
+		FROM %s b, %s d WHERE p.page_id = b.old_id AND p.discovered_from = d.old_id AND d.new_id <> d.old_id`,
+			s.PageTable, s.rehashBatchTable(), m),
+		fmt.Sprintf(`UPDATE %s m SET done = true FROM %s b WHERE m.old_id = b.old_id`, m, s.rehashBatchTable()),
+	}
+
+	for {
+		txn, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		var n int64
+		for _, query := range queries {
+			result, err := txn.Exec(query)
+			if err != nil {
+				txn.Rollback()
+				return err
+			}
+			// The last query marks the batch done, so it says how many pages there were.
+			n, err = result.RowsAffected()
+			if err != nil {
+				txn.Rollback()
+				return err
+			}
+		}
+		if err = txn.Commit(); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		log.Printf("Tidied up %d pages which kept their id", n)
+	}
+}
+
+// buildPageIDMap works out the new id of every page, and copies it into the map table.
+// The pages are read on a separate connection, so they can be streamed straight into the COPY.
+func (s *PostgresStorage) buildPageIDMap(txn *sql.Tx) error {
+	rows, err := s.db.Query(fmt.Sprintf(`SELECT page_id, url FROM %s`, s.PageTable))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	stmt, err := txn.Prepare(pq.CopyIn(s.pageIDMapTable(), "old_id", "new_id", "host", "path", "url"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for rows.Next() {
+		var oldID, urlString string
+		err = rows.Scan(&oldID, &urlString)
+		if err != nil {
+			return err
+		}
+
+		u, err := url.Parse(urlString)
+		if err != nil {
+			// We can't work out a new id, so the page stays as it is.
+			log.Printf("Keeping unparseable url %s as it is: %v", urlString, err)
+			_, err = stmt.Exec(oldID, oldID, "", "", "")
+		} else {
+			u = linkutils.Canonicalise(u)
+			_, err = stmt.Exec(oldID, linkutils.Hash(u), u.Hostname(), u.EscapedPath(), u.String())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// An empty Exec flushes everything buffered so far.
+	if _, err = stmt.Exec(); err != nil {
+		return err
+	}
+
+	_, err = txn.Exec(fmt.Sprintf(`ANALYZE %s`, s.pageIDMapTable()))
+	return err
+}
+
+// rehashQueries moves the pages of the batch over to their new ids.
+// The moved rows are worked out first and the old ones deleted before anything is inserted,
+// so it doesn't matter if one page's new id is another page's old id within the batch.
+// The other end of a link to or from a page in the batch keeps whatever id it has now, and is moved along with its own batch.
+// Where several pages merge, the shallowest depth, the earliest first sighting, the latest last sighting and the latest fetch win.
+func (s *PostgresStorage) rehashQueries(batch string) []string {
+	m := s.pageIDMapTable()
+	movedPages := s.PageTable + "_moved"
+	movedLinks := s.LinkTable + "_moved"
+	movedFetches := s.FetchTable + "_moved"
+	// moving is the old ids of the pages in the batch, every one of which gets a new id.
+	moving := fmt.Sprintf(`(SELECT old_id FROM %s)`, batch)
+	return []string{
+		fmt.Sprintf(`CREATE TEMP TABLE %s ON COMMIT DROP AS
+		SELECT DISTINCT ON (m.new_id) m.new_id AS page_id, m.host, m.path, m.url, p.depth, COALESCE(d.new_id, p.discovered_from) AS discovered_from,
+		p.title, p.description, p.lang, p.robots, p.h1, p.noindex, p.nofollow,
+		ARRAY(SELECT DISTINCT seed FROM %s merged JOIN %s mp ON mp.page_id = merged.old_id, unnest(mp.seeds) seed WHERE merged.new_id = m.new_id) AS seeds
+		FROM %s m JOIN %s p ON p.page_id = m.old_id LEFT JOIN %s d ON d.old_id = p.discovered_from
+		WHERE m.new_id <> m.old_id
+		ORDER BY m.new_id, p.depth ASC NULLS LAST`,
+			movedPages, batch, s.PageTable, batch, s.PageTable, m),
+		// Links which now link a page to itself are left out.
+		fmt.Sprintf(`CREATE TEMP TABLE %s ON COMMIT DROP AS
+		SELECT DISTINCT ON (from_page_id, to_page_id) * FROM (
+			SELECT COALESCE(f.new_id, l.from_page_id) AS from_page_id, COALESCE(t.new_id, l.to_page_id) AS to_page_id,
+			l.text, l.link_type, l.first_seen, l.last_seen, l.removed_at, l.texts, l.rel, l.position, l.section
+			FROM %s l LEFT JOIN %s f ON f.old_id = l.from_page_id LEFT JOIN %s t ON t.old_id = l.to_page_id
+			WHERE l.from_page_id IN %s OR l.to_page_id IN %s
+		) translated
+		WHERE from_page_id <> to_page_id
+		ORDER BY from_page_id, to_page_id, last_seen DESC NULLS LAST`,
+			movedLinks, s.LinkTable, batch, batch, moving, moving),
+		fmt.Sprintf(`CREATE TEMP TABLE %s ON COMMIT DROP AS
+		SELECT DISTINCT ON (m.new_id) m.new_id AS page_id, f.status, f.content_type, f.content_length, f.response_time_ms, f.fetched_at, f.error_class,
+		f.final_url, f.etag, f.last_modified, f.links_hash, f.revisit_interval_seconds, f.next_fetch_at, f.mime_type
+		FROM %s f JOIN %s m ON m.old_id = f.page_id
+		WHERE m.new_id <> m.old_id
+		ORDER BY m.new_id, f.fetched_at DESC`,
+			movedFetches, s.FetchTable, batch),
+
+		fmt.Sprintf(`DELETE FROM %s WHERE from_page_id IN %s`, s.LinkTable, moving),
+		fmt.Sprintf(`DELETE FROM %s WHERE to_page_id IN %s`, s.LinkTable, moving),
+		fmt.Sprintf(`DELETE FROM %s WHERE page_id IN %s`, s.FetchTable, moving),
+		fmt.Sprintf(`DELETE FROM %s WHERE page_id IN %s`, s.PageTable, moving),
+
+		fmt.Sprintf(`INSERT INTO %s (page_id, host, path, url, depth, discovered_from, title, description, lang, robots, h1, noindex, nofollow, seeds)
+		SELECT page_id, host, path, url, depth, discovered_from, title, description, lang, robots, h1, noindex, nofollow, seeds FROM %s
+		ON CONFLICT (page_id) DO UPDATE SET depth = LEAST(%s.depth, EXCLUDED.depth),
+		seeds = %s,
+		title = COALESCE(%s.title, EXCLUDED.title),
+		description = COALESCE(%s.description, EXCLUDED.description),
+		lang = COALESCE(%s.lang, EXCLUDED.lang),
+		robots = COALESCE(%s.robots, EXCLUDED.robots),
+		h1 = COALESCE(%s.h1, EXCLUDED.h1),
+		noindex = COALESCE(%s.noindex, EXCLUDED.noindex),
+		nofollow = COALESCE(%s.nofollow, EXCLUDED.nofollow)`,
+			s.PageTable, movedPages, s.PageTable, unionSeeds(s.PageTable+".seeds", "EXCLUDED.seeds"),
+			s.PageTable, s.PageTable, s.PageTable, s.PageTable, s.PageTable, s.PageTable, s.PageTable),
+		fmt.Sprintf(`INSERT INTO %s (from_page_id, to_page_id, text, link_type, first_seen, last_seen, removed_at, texts, rel, position, section)
+		SELECT from_page_id, to_page_id, text, link_type, first_seen, last_seen, removed_at, texts, rel, position, section FROM %s
+		ON CONFLICT (from_page_id, to_page_id) DO UPDATE SET
+		first_seen = LEAST(%s.first_seen, EXCLUDED.first_seen),
+		last_seen = GREATEST(%s.last_seen, EXCLUDED.last_seen),
+		removed_at = CASE WHEN %s.removed_at IS NULL OR EXCLUDED.removed_at IS NULL THEN NULL
+			ELSE GREATEST(%s.removed_at, EXCLUDED.removed_at) END`,
+			s.LinkTable, movedLinks, s.LinkTable, s.LinkTable, s.LinkTable, s.LinkTable),
+		fmt.Sprintf(`INSERT INTO %s (page_id, status, content_type, content_length, response_time_ms, fetched_at, error_class,
+		final_url, etag, last_modified, links_hash, revisit_interval_seconds, next_fetch_at, mime_type)
+		SELECT * FROM %s
+		ON CONFLICT (page_id) DO UPDATE SET
+		status = EXCLUDED.status,
+		content_type = EXCLUDED.content_type,
+		content_length = EXCLUDED.content_length,
+		response_time_ms = EXCLUDED.response_time_ms,
+		fetched_at = EXCLUDED.fetched_at,
+		error_class = EXCLUDED.error_class,
+		final_url = EXCLUDED.final_url,
+		etag = EXCLUDED.etag,
+		last_modified = EXCLUDED.last_modified,
+		links_hash = EXCLUDED.links_hash,
+		revisit_interval_seconds = EXCLUDED.revisit_interval_seconds,
+		next_fetch_at = EXCLUDED.next_fetch_at,
+		mime_type = EXCLUDED.mime_type
+		WHERE EXCLUDED.fetched_at > %s.fetched_at`,
+			s.FetchTable, movedFetches, s.FetchTable),
+	}
+}
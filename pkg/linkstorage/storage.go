@@ -0,0 +1,70 @@
+package linkstorage
+
+import (
+	"net/url"
+	"time"
+)
+
+// This is the interface every storage backend implements, so the crawler and the api don't care where the graph lives.
+
+// Storage stores the pages and links of the graph, along with how fetching each page went.
+type Storage interface {
+	// Close closes the storage, it shouldn't be used afterwards.
+	Close() error
+
+	// CheckPageExists checks whether the page has been stored.
+	CheckPageExists(u *url.URL) (bool, error)
+	// GetPage retrieves the page with this hash, or nil if there isn't one.
+	GetPage(pageHash string) (*Page, error)
+	// GetPageHashesFromHost retrieves up to limit page hashes from this host.
+	// Pages which asked not to be indexed are left out, unless includeNoindex is set.
+	GetPageHashesFromHost(host string, limit int, includeNoindex bool) ([]string, error)
+	// AddPage adds the page if it doesn't already exist.
+	AddPage(page *Page) error
+	// BatchAddPages adds the pages, filling in the depth of any existing pages which don't know theirs and adding any seeds they didn't have.
+	BatchAddPages(pages []Page) error
+	// CountPages retrieves the number of pages stored, which may be an estimate.
+	CountPages() (int, error)
+
+	// CheckLinkExists checks whether the link has been stored.
+	CheckLinkExists(fromU *url.URL, toU *url.URL) (bool, error)
+	// GetLinksFrom retrieves up to limit hashes of pages currently linked to from this page.
+	// Like the other link queries, pages which asked not to be indexed are left out, unless includeNoindex is set.
+	GetLinksFrom(pageHash string, limit int, includeNoindex bool) ([]string, error)
+	// GetLinksFromAsOf retrieves up to limit hashes of pages linked to from this page at the given time.
+	GetLinksFromAsOf(pageHash string, at time.Time, limit int, includeNoindex bool) ([]string, error)
+	// GetLinksTo retrieves up to limit hashes of pages currently linking to this page.
+	GetLinksTo(pageHash string, limit int, includeNoindex bool) ([]string, error)
+	// GetLinksToAsOf retrieves up to limit hashes of pages linking to this page at the given time.
+	GetLinksToAsOf(pageHash string, at time.Time, limit int, includeNoindex bool) ([]string, error)
+	// GetRedirect retrieves the hash of the page this page currently redirects to, or an empty string if it doesn't redirect.
+	// If there is more than one, the most recently seen wins.
+	GetRedirect(pageHash string) (string, error)
+	// GetCanonical retrieves the hash of the page this page currently says is its canonical version, or an empty string if it doesn't name one.
+	GetCanonical(pageHash string) (string, error)
+	// AddLink adds the link, along with its pages, if it doesn't already exist.
+	AddLink(link *Link) error
+	// BatchAddLinks adds the links, updating when existing links were last seen.
+	// Any pages the links are between which haven't been added yet are added first, with an unknown depth.
+	BatchAddLinks(links []*Link) error
+	// MarkLinksRemoved marks the links on the page which weren't seen by the crawl at seenAt as removed.
+	MarkLinksRemoved(fromU *url.URL, seenAt time.Time) error
+	// MarkRedirectsRemoved marks the HTTP redirects from the page which weren't followed by the crawl at seenAt as removed.
+	MarkRedirectsRemoved(fromU *url.URL, seenAt time.Time) error
+	// CountLinks retrieves the number of links stored, which may be an estimate.
+	CountLinks() (int, error)
+
+	// BatchAddFetchResults stores the fetch results, replacing any previous result for the same page.
+	BatchAddFetchResults(results []*FetchResult) error
+	// GetFetchResult retrieves the last fetch result for the page, or nil if it has never been fetched.
+	GetFetchResult(pageHash string) (*FetchResult, error)
+	// ClaimPagesDueForRecrawl retrieves up to limit pages due a fetch, pushing their next fetch back by lease.
+	ClaimPagesDueForRecrawl(limit int, lease time.Duration) ([]Page, error)
+}
+
+// Make sure every backend keeps up with the interface.
+var (
+	_ Storage = &PostgresStorage{}
+	_ Storage = &LevelDBStorage{}
+	_ Storage = &MemoryStorage{}
+)
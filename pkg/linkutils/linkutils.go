@@ -7,81 +7,52 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/jamesjarvis/web-graph/pkg/linkcanon"
 	"github.com/ncruces/go-dns"
 )
 
-var (
-	acceptSchemes = map[string]struct{}{
-		"http":  {},
-		"https": {},
-	}
-	ignoreHosts = map[string]struct{}{
-		"t.co":          {},
-		"pbs.twimg.com": {},
-	}
-)
+// policy decides how urls are cleaned up and which urls are the same page, it must be the same everywhere that shares a graph.
+var policy linkcanon.Policy = linkcanon.Legacy{}
 
-// ScrapeDaTing gives us a yes/no on whether or not we should scrape the following URL, based on our opinionated filters
-func ScrapeDaTing(u *url.URL) bool {
-	var ok bool
-	if _, ok = acceptSchemes[u.Scheme]; !ok {
-		return false
-	}
-	if _, ok = ignoreHosts[u.Host]; ok {
-		return false
-	}
-	return IsNiceFileType(u)
+// SetPolicy changes how urls are cleaned up and identified, it should only be called on startup.
+func SetPolicy(p linkcanon.Policy) {
+	policy = p
 }
 
-// IsNiceFileType returns true if the file extension is of type html (or unknown)
-func IsNiceFileType(u *url.URL) bool {
-	fileExtension := filepath.Ext(u.EscapedPath())
-	if fileExtension == ".html" || fileExtension == ".htm" {
-		return true
-	}
-	if fileExtension == "" {
-		return true
-	}
-	return false
+// Canonicalise returns the canonical form of the url, according to the policy.
+func Canonicalise(u *url.URL) *url.URL {
+	return policy.Canonicalise(u)
 }
 
-// HappyResponse returns true if we want to continue scraping this thing.
-func HappyResponse(resp *http.Response) bool {
-	h := strings.Split(resp.Header.Get("Content-Type"), ";")
-	switch h[0] {
-	case "application/xhtml+xml":
-		return true
-	case "text/html":
-		return true
-	default:
-		return false
-	}
+// IsWebURL returns true if the url is an absolute http or https url, the only kind we can fetch.
+// Which of them we actually crawl is up to the link processor's scope.
+func IsWebURL(u *url.URL) bool {
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
 }
 
-// Hash returns a SHA1 hash of the host and path
+// Hash returns a SHA1 hash of the url's identity, which for the legacy policy is the host and path
 func Hash(u *url.URL) string {
 	h := sha1.New()
-	h.Write([]byte(u.Hostname() + u.EscapedPath()))
+	h.Write([]byte(policy.Identity(u)))
 	bs := h.Sum(nil)
 	return fmt.Sprintf("%x", bs)
 }
 
 // ParseURL is a helper function that takes a string url, trims whitespace,
-// parses into a url.URL and finally checks whether it fits our url requirements.
+// parses into a url.URL, checks that it is a web url and finally canonicalises it.
 func ParseURL(s string) (*url.URL, error) {
 	s = strings.TrimSpace(s)
 	u, err := url.Parse(s)
 	if err != nil {
 		return nil, err
 	}
-	if !ScrapeDaTing(u) {
-		return nil, errors.New("We do not want to scrape this URL")
+	if !IsWebURL(u) {
+		return nil, errors.New("We can only scrape http and https URLs")
 	}
-	return u, nil
+	return Canonicalise(u), nil
 }
 
 func CreateHTTPClient() (*http.Client, error) {